@@ -0,0 +1,567 @@
+// Self-service management pages for linked users.
+package account
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/activitypub"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/notify"
+	"github.com/ml8/ap-bot/pocket"
+	"github.com/ml8/ap-bot/util"
+)
+
+var log = util.Logger("account")
+
+const (
+	AccountUrl       = "/account"
+	SettingsUrl      = AccountUrl + "/settings"
+	ProfileUrl       = AccountUrl + "/profile"
+	FollowRequestUrl = AccountUrl + "/follow_request"
+	BlocksUrl        = AccountUrl + "/blocks"
+	MigrationUrl     = AccountUrl + "/migration"
+	NotificationsUrl = AccountUrl + "/notifications"
+	KeysUrl          = AccountUrl + "/keys"
+	DeleteUrl        = AccountUrl + "/delete"
+	LogoutUrl        = AccountUrl + "/logout"
+)
+
+type Account interface {
+	PageHandler(w http.ResponseWriter, r *http.Request)
+	SettingsHandler(w http.ResponseWriter, r *http.Request)
+	ProfileHandler(w http.ResponseWriter, r *http.Request)
+	FollowRequestHandler(w http.ResponseWriter, r *http.Request)
+	BlocksHandler(w http.ResponseWriter, r *http.Request)
+	MigrationHandler(w http.ResponseWriter, r *http.Request)
+	NotificationsHandler(w http.ResponseWriter, r *http.Request)
+	KeysHandler(w http.ResponseWriter, r *http.Request)
+	DeleteHandler(w http.ResponseWriter, r *http.Request)
+	LogoutHandler(w http.ResponseWriter, r *http.Request)
+}
+
+type account struct {
+	Pocket      pocket.Pocket
+	ActivityPub activitypub.ActivityPub
+	Moderation  moderation.Moderation
+	Notifier    notify.Notifier
+	Cookies     *util.CookieSigner
+	Host        string
+}
+
+func Init(p pocket.Pocket, ap activitypub.ActivityPub, mod moderation.Moderation, n notify.Notifier, cookies *util.CookieSigner, host string) Account {
+	return &account{
+		Pocket:      p,
+		ActivityPub: ap,
+		Moderation:  mod,
+		Notifier:    n,
+		Cookies:     cookies,
+		Host:        host,
+	}
+}
+
+type pageData struct {
+	Name      string
+	Host      string
+	CSRF      string
+	Followers []string
+	Pending   []string
+	Blocks    []moderation.DomainBlock
+	Posts     []activitypub.PostRecord // posts that got any interaction, most popular first
+	Migration activitypub.Migration
+	Notify    notify.Preferences
+	Digest    string // notify.Preferences.Digest, as a duration string
+	Email     bool   // whether email notifications are available
+	Relays    bool   // whether the instance is subscribed to any relay
+	Settings  activitypub.Settings
+	Profile   activitypub.Profile
+	Fields    []activitypub.Field // profile fields padded to the maximum
+	Message   string
+}
+
+// owner returns the linked user the request is authenticated as, or
+// redirects to registration.
+func (a *account) owner(w http.ResponseWriter, r *http.Request) string {
+	name, generation := a.Cookies.SessionUser(r)
+	if name == "" || !a.Pocket.ValidSession(name, generation) {
+		http.Redirect(w, r, "/pocket"+pocket.RegisterUrlRoot, http.StatusFound)
+		return ""
+	}
+	return name
+}
+
+// ownerForm is owner for state-changing POSTs, which must carry a CSRF token.
+func (a *account) ownerForm(w http.ResponseWriter, r *http.Request) string {
+	if r.Method != "POST" {
+		util.ErrorResponse(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v not supported", r.Method))
+		return ""
+	}
+	name := a.owner(w, r)
+	if name == "" {
+		return ""
+	}
+	if !a.Cookies.CheckCSRF(r) {
+		util.ErrorResponse(w, http.StatusForbidden, "Invalid form token")
+		return ""
+	}
+	return name
+}
+
+func (a *account) render(w http.ResponseWriter, r *http.Request, name, message string) {
+	settings, _ := a.ActivityPub.Settings(name)
+	profile, _ := a.ActivityPub.Profile(name)
+	migration, _ := a.ActivityPub.Migration(name)
+	prefs := a.Notifier.Preferences(name)
+	fields := make([]activitypub.Field, activitypub.MaxProfileFields)
+	copy(fields, profile.Fields)
+	data := pageData{
+		Name:      name,
+		Host:      a.Host,
+		CSRF:      a.Cookies.CSRFToken(r),
+		Followers: a.ActivityPub.Followers(name),
+		Pending:   a.ActivityPub.PendingFollows(name),
+		Blocks:    a.Moderation.UserBlocks(name),
+		Posts:     popular(a.ActivityPub.Posts(name)),
+		Migration: migration,
+		Notify:    prefs,
+		Digest:    prefs.Digest.String(),
+		Email:     a.Notifier.EmailEnabled(),
+		Relays:    len(a.ActivityPub.Relays()) > 0,
+		Settings:  settings,
+		Profile:   profile,
+		Fields:    fields,
+		Message:   message,
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := pageTemplate.Execute(w, data); err != nil {
+		log.ErrorContext(r.Context(), "Error rendering account page", "user", name, "error", err)
+	}
+}
+
+// popular returns the posts that were liked, shared or replied to, the most
+// interacted with first.
+func popular(posts []activitypub.PostRecord) []activitypub.PostRecord {
+	var res []activitypub.PostRecord
+	for _, post := range posts {
+		if len(post.Likes)+len(post.Shares)+len(post.Replies) > 0 {
+			res = append(res, post)
+		}
+	}
+	score := func(post activitypub.PostRecord) int {
+		return len(post.Likes) + 2*len(post.Shares) + 2*len(post.Replies)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return score(res[i]) > score(res[j]) })
+	return res
+}
+
+func (a *account) PageHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.owner(w, r)
+	if name == "" {
+		return
+	}
+	a.render(w, r, name, "")
+}
+
+func (a *account) SettingsHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	settings, _ := a.ActivityPub.Settings(name)
+	settings.Paused = r.FormValue("paused") != ""
+	settings.Locked = r.FormValue("locked") != ""
+	settings.Interval = r.FormValue("interval")
+	settings.Relay = r.FormValue("relay") != ""
+	if err := a.ActivityPub.UpdateSettings(name, settings); err != nil {
+		a.render(w, r, name, err.Error())
+		return
+	}
+	a.render(w, r, name, "Settings saved.")
+}
+
+// upload stores the image in form field key, if one was sent.
+func (a *account) upload(r *http.Request, key string) (string, error) {
+	f, _, err := r.FormFile(key)
+	if err == http.ErrMissingFile {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, activitypub.MaxMediaSize+1))
+	if err != nil {
+		return "", err
+	}
+	return a.ActivityPub.SaveMedia(data)
+}
+
+func (a *account) ProfileHandler(w http.ResponseWriter, r *http.Request) {
+	// The form token is part of the upload, so only the method and session
+	// can be checked before it is read.
+	if r.Method != "POST" {
+		util.ErrorResponse(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v not supported", r.Method))
+		return
+	}
+	if a.owner(w, r) == "" {
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 3*activitypub.MaxMediaSize)
+	if err := r.ParseMultipartForm(activitypub.MaxMediaSize); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Error parsing form: %v", err))
+		return
+	}
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	profile, _ := a.ActivityPub.Profile(name)
+	profile.DisplayName = strings.TrimSpace(r.FormValue("displayname"))
+	profile.Summary = strings.TrimSpace(r.FormValue("summary"))
+	profile.Fields = nil
+	for i := 0; i < activitypub.MaxProfileFields; i++ {
+		k := strings.TrimSpace(r.FormValue(fmt.Sprintf("field%d_name", i)))
+		v := strings.TrimSpace(r.FormValue(fmt.Sprintf("field%d_value", i)))
+		if k != "" {
+			profile.Fields = append(profile.Fields, activitypub.Field{Name: k, Value: v})
+		}
+	}
+	// Images saved before an error are not part of any profile.
+	var uploaded []string
+	discard := func() {
+		for _, file := range uploaded {
+			a.ActivityPub.DeleteMedia(file)
+		}
+	}
+	for _, image := range []struct {
+		key  string
+		file *string
+	}{{"avatar", &profile.Avatar}, {"header", &profile.Header}} {
+		if r.FormValue("remove_"+image.key) != "" {
+			*image.file = ""
+		}
+		file, err := a.upload(r, image.key)
+		if err != nil {
+			discard()
+			a.render(w, r, name, err.Error())
+			return
+		}
+		if file != "" {
+			*image.file = file
+			uploaded = append(uploaded, file)
+		}
+	}
+	if err := a.ActivityPub.UpdateProfile(name, profile); err != nil {
+		discard()
+		a.render(w, r, name, err.Error())
+		return
+	}
+	a.render(w, r, name, "Profile saved.")
+}
+
+func (a *account) FollowRequestHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	actor := r.FormValue("actor")
+	accept := r.FormValue("answer") == "accept"
+	if err := a.ActivityPub.AnswerFollow(name, actor, accept); err != nil {
+		a.render(w, r, name, err.Error())
+		return
+	}
+	if accept {
+		a.render(w, r, name, fmt.Sprintf("Accepted %v.", actor))
+	} else {
+		a.render(w, r, name, fmt.Sprintf("Rejected %v.", actor))
+	}
+}
+
+func (a *account) BlocksHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	domain := moderation.Domain(r.FormValue("domain"))
+	if r.FormValue("action") == "unblock" {
+		a.Moderation.UnblockForUser(name, domain)
+		a.render(w, r, name, fmt.Sprintf("Unblocked %v.", domain))
+		return
+	}
+	if err := a.Moderation.BlockForUser(name, domain); err != nil {
+		a.render(w, r, name, err.Error())
+		return
+	}
+	a.render(w, r, name, fmt.Sprintf("Blocked %v; its followers have been removed.", domain))
+}
+
+func (a *account) MigrationHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	var err error
+	var message string
+	switch r.FormValue("action") {
+	case "aliases":
+		err = a.ActivityPub.SetAliases(name, strings.Fields(r.FormValue("aliases")))
+		message = "Aliases saved."
+	case "move":
+		err = a.ActivityPub.Move(name, r.FormValue("target"))
+		message = "Moved; followers are being redirected."
+	case "cancel":
+		err = a.ActivityPub.Move(name, "")
+		message = "Move cancelled."
+	}
+	if err != nil {
+		message = err.Error()
+	}
+	a.render(w, r, name, message)
+}
+
+func (a *account) NotificationsHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	digest, err := time.ParseDuration(r.FormValue("digest"))
+	if err != nil {
+		a.render(w, r, name, fmt.Sprintf("Invalid digest interval %q", r.FormValue("digest")))
+		return
+	}
+	message := "Notification settings saved."
+	err = a.Notifier.SetPreferences(name, notify.Preferences{
+		Fediverse: r.FormValue("fediverse"),
+		Email:     r.FormValue("email"),
+		Webhook:   r.FormValue("webhook"),
+		Digest:    digest,
+	})
+	if err != nil {
+		message = err.Error()
+	}
+	a.render(w, r, name, message)
+}
+
+func (a *account) KeysHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	message := "Key rotated; followers are being sent the new one."
+	if err := a.ActivityPub.RotateKey(name, r.FormValue("ed25519") != ""); err != nil {
+		message = err.Error()
+	}
+	a.render(w, r, name, message)
+}
+
+func (a *account) DeleteHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	if r.FormValue("confirm") != name {
+		a.render(w, r, name, "Type your handle to confirm deletion.")
+		return
+	}
+	if err := a.ActivityPub.DeleteUser(name); err != nil {
+		a.render(w, r, name, err.Error())
+		return
+	}
+	a.Cookies.ClearSession(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(deletedSrc))
+}
+
+// LogoutHandler ends the request's session or, if asked, every session of
+// the user.
+func (a *account) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	name := a.ownerForm(w, r)
+	if name == "" {
+		return
+	}
+	if r.FormValue("everywhere") != "" {
+		a.Pocket.RevokeSessions(name)
+	}
+	a.Cookies.ClearSession(w)
+	http.Redirect(w, r, "/pocket"+pocket.RegisterUrlRoot, http.StatusFound)
+}
+
+const deletedSrc = `
+<html>
+  <head></head>
+  <body>
+    Your account has been deleted and your followers have been notified.
+  </body>
+</html>
+`
+
+var pageTemplate = template.Must(template.New("account").Parse(`
+<html>
+  <head><title>{{.Name}}@{{.Host}}</title></head>
+  <body>
+    <h1>{{.Name}}@{{.Host}}</h1>
+    {{if .Message}}<p><em>{{.Message}}</em></p>{{end}}
+
+    {{if .Pending}}
+    <h2>Follow requests ({{len .Pending}})</h2>
+    <ul>
+      {{range .Pending}}
+      <li>
+        <a href="{{.}}">{{.}}</a>
+        <form method="post" action="` + FollowRequestUrl + `" style="display:inline">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
+          <input type="hidden" name="actor" value="{{.}}"/>
+          <button type="submit" name="answer" value="accept">Accept</button>
+          <button type="submit" name="answer" value="reject">Reject</button>
+        </form>
+      </li>
+      {{end}}
+    </ul>
+    {{end}}
+
+    <h2>Followers ({{len .Followers}})</h2>
+    <ul>
+      {{range .Followers}}<li><a href="{{.}}">{{.}}</a></li>{{end}}
+    </ul>
+
+    <h2>Popular saves</h2>
+    {{if .Posts}}
+    <ul>
+      {{range .Posts}}
+      <li>
+        <a href="{{.Url}}">{{if .Title}}{{.Title}}{{else}}{{.Url}}{{end}}</a>:
+        {{len .Likes}} likes, {{len .Shares}} boosts, {{len .Replies}} replies
+        {{if .Replies}}
+        <ul>
+          {{range .Replies}}<li><a href="{{.Actor}}">{{.Actor}}</a>: {{.Content}}</li>{{end}}
+        </ul>
+        {{end}}
+      </li>
+      {{end}}
+    </ul>
+    {{else}}
+    <p>None of your posts have been liked, boosted or replied to yet.</p>
+    {{end}}
+
+    <h2>Profile</h2>
+    <form method="post" action="` + ProfileUrl + `" enctype="multipart/form-data">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="displayname">Display name:</label>
+      <input type="text" id="displayname" name="displayname" value="{{.Profile.DisplayName}}"/><br/>
+      <label for="summary">Bio:</label><br/>
+      <textarea id="summary" name="summary" rows="4" cols="60">{{.Profile.Summary}}</textarea><br/>
+      {{range $i, $f := .Fields}}
+      <input type="text" name="field{{$i}}_name" placeholder="Label" value="{{$f.Name}}"/>
+      <input type="text" name="field{{$i}}_value" placeholder="Content" value="{{$f.Value}}"/><br/>
+      {{end}}
+      <label for="avatar">Avatar:</label>
+      <input type="file" id="avatar" name="avatar" accept="image/*"/>
+      {{if .Profile.Avatar}}<label><input type="checkbox" name="remove_avatar"/> Remove</label>{{end}}<br/>
+      <label for="header">Header:</label>
+      <input type="file" id="header" name="header" accept="image/*"/>
+      {{if .Profile.Header}}<label><input type="checkbox" name="remove_header"/> Remove</label>{{end}}<br/>
+      <input type="submit" value="Save"/>
+    </form>
+
+    <h2>Posting</h2>
+    <form method="post" action="` + SettingsUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label><input type="checkbox" name="paused" {{if .Settings.Paused}}checked{{end}}/> Pause posting</label><br/>
+      <label><input type="checkbox" name="locked" {{if .Settings.Locked}}checked{{end}}/> Approve followers manually</label><br/>
+      {{if .Relays}}<label><input type="checkbox" name="relay" {{if .Settings.Relay}}checked{{end}}/> Share posts with this server's relays</label><br/>{{end}}
+      <label for="interval">Minimum time between posts (e.g. 6h; blank for default):</label>
+      <input type="text" id="interval" name="interval" value="{{.Settings.Interval}}"/><br/>
+      <input type="submit" value="Save"/>
+    </form>
+
+    <h2>Blocked domains</h2>
+    <ul>
+      {{range .Blocks}}
+      <li>
+        {{.Domain}}
+        <form method="post" action="` + BlocksUrl + `" style="display:inline">
+          <input type="hidden" name="csrf" value="{{$.CSRF}}"/>
+          <input type="hidden" name="domain" value="{{.Domain}}"/>
+          <button type="submit" name="action" value="unblock">Unblock</button>
+        </form>
+      </li>
+      {{end}}
+    </ul>
+    <form method="post" action="` + BlocksUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <input type="text" name="domain" placeholder="example.social"/>
+      <button type="submit" name="action" value="block">Block</button>
+    </form>
+
+    <h2>Notifications</h2>
+    <p>Replies and mentions of your bridge account are sent to:</p>
+    <form method="post" action="` + NotificationsUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="fediverse">Your fediverse account (direct message):</label>
+      <input type="text" id="fediverse" name="fediverse" placeholder="@you@example.social" value="{{.Notify.Fediverse}}"/><br/>
+      {{if .Email}}
+      <label for="email">Email:</label>
+      <input type="email" id="email" name="email" value="{{.Notify.Email}}"/><br/>
+      {{end}}
+      <label for="webhook">Webhook url:</label>
+      <input type="url" id="webhook" name="webhook" value="{{.Notify.Webhook}}"/><br/>
+      <label for="digest">Send:</label>
+      <select id="digest" name="digest">
+        <option value="0s"{{if eq .Digest "0s"}} selected{{end}}>right away</option>
+        <option value="1h0m0s"{{if eq .Digest "1h0m0s"}} selected{{end}}>hourly digest</option>
+        <option value="24h0m0s"{{if eq .Digest "24h0m0s"}} selected{{end}}>daily digest</option>
+      </select><br/>
+      <button type="submit">Save</button>
+    </form>
+
+    <h2>Moving</h2>
+    <form method="post" action="` + MigrationUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="aliases">Accounts that may move here (urls or @user@domain, one per line):</label><br/>
+      <textarea id="aliases" name="aliases" rows="3" cols="60">{{range .Migration.AlsoKnownAs}}{{.}}
+{{end}}</textarea><br/>
+      <button type="submit" name="action" value="aliases">Save aliases</button>
+    </form>
+    {{if .Migration.MovedTo}}
+    <form method="post" action="` + MigrationUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      Moved to <a href="{{.Migration.MovedTo}}">{{.Migration.MovedTo}}</a>.
+      <button type="submit" name="action" value="cancel">Cancel redirect</button>
+    </form>
+    {{else}}
+    <form method="post" action="` + MigrationUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="target">Move followers to (the new account must list this one as an alias):</label>
+      <input type="text" id="target" name="target" placeholder="@me@new.example"/>
+      <button type="submit" name="action" value="move">Move</button>
+    </form>
+    {{end}}
+
+    <h2>Keys</h2>
+    <form method="post" action="` + KeysUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <input type="checkbox" id="ed25519" name="ed25519"/>
+      <label for="ed25519">Also publish a new Ed25519 key</label><br/>
+      <button type="submit">Rotate signing key</button>
+    </form>
+
+    <h2>Delete account</h2>
+    <form method="post" action="` + DeleteUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <label for="confirm">Type <b>{{.Name}}</b> to permanently delete this account:</label>
+      <input type="text" id="confirm" name="confirm"/>
+      <input type="submit" value="Delete"/>
+    </form>
+
+    <form method="post" action="` + LogoutUrl + `">
+      <input type="hidden" name="csrf" value="{{.CSRF}}"/>
+      <button type="submit">Log out</button>
+      <button type="submit" name="everywhere" value="1">Log out everywhere</button>
+    </form>
+  </body>
+</html>
+`))
@@ -0,0 +1,184 @@
+package activitypub
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Account management on behalf of an authenticated owner.
+
+func (p *activitypub) Followers(name string) []string {
+	user, ok := p.getUser(name)
+	if !ok {
+		return nil
+	}
+	var followers []string
+	user.forEachFollower(func(f string) error {
+		followers = append(followers, f)
+		return nil
+	})
+	return followers
+}
+
+func (p *activitypub) Settings(name string) (Settings, error) {
+	user, ok := p.getUser(name)
+	if !ok {
+		return Settings{}, fmt.Errorf("No user %v", name)
+	}
+	user.Lock()
+	defer user.Unlock()
+	return user.Settings, nil
+}
+
+func (p *activitypub) UpdateSettings(name string, settings Settings) error {
+	if settings.Interval != "" {
+		if _, err := time.ParseDuration(settings.Interval); err != nil {
+			return fmt.Errorf("Invalid interval %v: %v", settings.Interval, err)
+		}
+	}
+	user, _ := p.getOrAddUser(name)
+	user.Lock()
+	old := user.Settings
+	user.Settings = settings
+	user.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	log.Info("Updated settings", "user", name, "settings", settings)
+	if old.Locked != settings.Locked {
+		go p.sendActorUpdate(user)
+	}
+	if old.Locked && !settings.Locked {
+		// Unlocking approves everyone who was waiting.
+		for _, actor := range p.PendingFollows(name) {
+			p.AnswerFollow(name, actor, true)
+		}
+	}
+	return nil
+}
+
+func (p *activitypub) PendingFollows(name string) []string {
+	user, ok := p.getUser(name)
+	if !ok {
+		return nil
+	}
+	user.Lock()
+	defer user.Unlock()
+	var actors []string
+	for _, pending := range user.Pending {
+		actors = append(actors, pending.Actor)
+	}
+	return actors
+}
+
+// AnswerFollow accepts or rejects a pending follow request.
+func (p *activitypub) AnswerFollow(name, actor string, accept bool) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	follow := user.delPending(actor)
+	if follow == nil {
+		return fmt.Errorf("No follow request from %v", actor)
+	}
+	if accept {
+		go p.acceptFollow(context.Background(), user, follow)
+		return nil
+	}
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	go p.answerFollow(context.Background(), user, follow, "Reject")
+	log.Info("Rejected follower", "user", name, "actor", actor)
+	return nil
+}
+
+func (p *activitypub) Profile(name string) (Profile, error) {
+	user, ok := p.getUser(name)
+	if !ok {
+		return Profile{}, fmt.Errorf("No user %v", name)
+	}
+	user.Lock()
+	defer user.Unlock()
+	return user.Profile, nil
+}
+
+// UpdateProfile replaces the user's profile and tells followers about the
+// change. Media no longer referenced by the profile is removed.
+func (p *activitypub) UpdateProfile(name string, profile Profile) error {
+	if len(profile.Fields) > MaxProfileFields {
+		return fmt.Errorf("At most %v profile fields are allowed", MaxProfileFields)
+	}
+	user, _ := p.getOrAddUser(name)
+	user.Lock()
+	old := user.Profile
+	user.Profile = profile
+	user.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	if old.Avatar != profile.Avatar {
+		p.DeleteMedia(old.Avatar)
+	}
+	if old.Header != profile.Header {
+		p.DeleteMedia(old.Header)
+	}
+	log.Info("Updated profile", "user", name)
+	go p.sendActorUpdate(user)
+	return nil
+}
+
+// sendActorUpdate delivers an Update of the user's actor to followers.
+func (p *activitypub) sendActorUpdate(user *User) {
+	id := p.userBaseUrl(user.Name)
+	update := Activity{
+		Context: ProfileContext(),
+		ID:      id + "#updates/" + uuid.NewString(),
+		Type:    "Update",
+		Actor:   IRI(id),
+		Object:  Embed(p.actorForUser(user)),
+		To:      IRIs{ToAll},
+	}
+	if err := p.broadcast(context.Background(), user, update); err != nil {
+		log.Warn("Error sending profile update", "user", user.Name, "error", err)
+	}
+}
+
+// DeleteUser queues telling followers the actor is gone, then forgets
+// everything held for the user: keys, followers and the linked pocket token.
+func (p *activitypub) DeleteUser(name string) error {
+	// Unlinked first, so that nothing recreates the user once it is gone.
+	p.Pocket.Unlink(name)
+	if user, ok := p.getUser(name); ok {
+		user.Lock()
+		profile := user.Profile
+		user.Unlock()
+		p.DeleteMedia(profile.Avatar)
+		p.DeleteMedia(profile.Header)
+		id := p.userBaseUrl(name)
+		del := Activity{
+			Context: SecurityContext(),
+			ID:      id + "#delete",
+			Type:    "Delete",
+			Actor:   IRI(id),
+			Object:  Ref(id),
+			To:      IRIs{ToAll},
+		}
+		// Nothing else is sent for the user once it is deleted.
+		p.Deliveries.dropUser(name)
+		if err := p.broadcastFinal(context.Background(), user, del); err != nil {
+			log.Warn("Error announcing deletion", "user", name, "error", err)
+		}
+		p.Lock()
+		delete(p.Users, name)
+		p.Persist()
+		p.Unlock()
+	}
+	p.Moderation.DeleteUser(name)
+	p.Notifier.DeleteUser(name)
+	log.Info("Deleted user", "user", name)
+	return nil
+}
@@ -1,32 +1,83 @@
 package activitypub
 
 import (
+	"crypto/rsa"
 	"net/http"
 	"sync"
 	"time"
 
-	"github.com/golang/glog"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/notify"
 	"github.com/ml8/ap-bot/pocket"
 	"github.com/ml8/ap-bot/util"
 )
 
+var log = util.Logger("activitypub")
+
 const (
 	WebFingerUrl               = "/.well-known/webfinger"
 	ActorUrlPrefix             = "/user"
 	ActorUrlTemplate           = ActorUrlPrefix + "/{account}"      // /user/{account}
 	ActorCollectionUrlTemplate = ActorUrlTemplate + "/{collection}" // /user/{account}/{collection}
+	PostUrlPrefix              = "/posts"
+	PostUrlTemplate            = ActorUrlTemplate + PostUrlPrefix + "/{post}" // /user/{account}/posts/{post}
+	PostCollectionUrlTemplate  = PostUrlTemplate + "/{collection}"            // /user/{account}/posts/{post}/{collection}
 )
 
 type ActivityPub interface {
 	WebFingerHandler(w http.ResponseWriter, r *http.Request)
 	ActorHandler(w http.ResponseWriter, r *http.Request)
 	CollectionHandler(w http.ResponseWriter, r *http.Request)
+	PostHandler(w http.ResponseWriter, r *http.Request)
+	PostCollectionHandler(w http.ResponseWriter, r *http.Request)
+	InstanceActorHandler(w http.ResponseWriter, r *http.Request)
+	InstanceInboxHandler(w http.ResponseWriter, r *http.Request)
+	RelayAnnounceHandler(w http.ResponseWriter, r *http.Request)
+	RequireSignedFetch(required bool)
+	Relays() []Relay
+	NodeInfoWellKnownHandler(w http.ResponseWriter, r *http.Request)
+	NodeInfoHandler(w http.ResponseWriter, r *http.Request)
+	HostMetaHandler(w http.ResponseWriter, r *http.Request)
+	HostMetaJsonHandler(w http.ResponseWriter, r *http.Request)
+	Subscribe(relayUrl string) error
+	Unsubscribe(relayUrl string) error
 	Start()
+
+	Followers(name string) []string
+	Settings(name string) (Settings, error)
+	UpdateSettings(name string, settings Settings) error
+	DeleteUser(name string) error
+	Profile(name string) (Profile, error)
+	UpdateProfile(name string, profile Profile) error
+	SaveMedia(data []byte) (string, error)
+	DeleteMedia(file string)
+	PendingFollows(name string) []string
+	AnswerFollow(name, actor string, accept bool) error
+	Migration(name string) (Migration, error)
+	SetAliases(name string, aliases []string) error
+	Move(name, target string) error
+	RotateKey(name string, withEd25519 bool) error
+	ListUsers() []UserInfo
+	UserInfo(name string) (UserInfo, error)
+	RemoveFollower(name, actor string) error
+	PostNow(name string) error
+	Queue() (queued, dead []Delivery)
+	RetryDeliveries(id string) int
+	PurgeDeliveries(id string) int
+	Suspend(name string, suspended bool) error
+	FollowerDomains() map[string]int
+	RecentInbox() []InboxEvent
+	DeliveryWorkerAlive() error
+	Posts(name string) []PostRecord
+	MediaHandler(w http.ResponseWriter, r *http.Request)
 }
 
 type ResourceMap struct {
-	BaseUrl string
-	Host    string
+	BaseUrl     string
+	Host        string
+	SiteUrl     string // scheme and host the server is reached at
+	MediaDir    string // local storage for uploaded images
+	InstanceKey string // file holding the instance actor's key
 }
 
 type CollectionHandler func(u *User, w http.ResponseWriter, r *http.Request)
@@ -39,9 +90,19 @@ type activitypub struct {
 	Handlers       map[string]CollectionHandler
 	StateInterface util.Persister
 	Interval       time.Duration
+	Cookies        *util.CookieSigner
+	Moderation     moderation.Moderation
+	Notifier       notify.Notifier
+	Deliveries     *deliveries
+	Relay          *relays
+	Remote         *remoteCache
+	RemoteFollows  *util.RateLimiter // lookups for remote follows, by client
+	InstanceKey    *rsa.PrivateKey
+	SignedFetch    bool         // protected by mutex
+	Received       []InboxEvent // protected by mutex; most recent last
 }
 
-func Init(p pocket.Pocket, resources ResourceMap, statefile string, postInterval time.Duration) ActivityPub {
+func Init(p pocket.Pocket, resources ResourceMap, statefile, deliveryfile, relayfile string, postInterval time.Duration, cookies *util.CookieSigner, mod moderation.Moderation, notifier notify.Notifier) ActivityPub {
 	pub := &activitypub{
 		Pocket:         p,
 		Resources:      resources,
@@ -49,32 +110,62 @@ func Init(p pocket.Pocket, resources ResourceMap, statefile string, postInterval
 		Handlers:       make(map[string]CollectionHandler),
 		StateInterface: util.NewPersister(statefile),
 		Interval:       postInterval,
+		Cookies:        cookies,
+		Moderation:     mod,
+		Notifier:       notifier,
+		Deliveries:     newDeliveries(deliveryfile),
+		Relay:          newRelays(relayfile),
+		Remote:         newRemoteCache(),
+		RemoteFollows:  util.NewRateLimiter(RemoteFollowLimit, RemoteFollowWindow),
+		InstanceKey:    loadOrCreateInstanceKey(resources.InstanceKey),
 	}
 	pub.Handlers["followers"] = pub.FollowersHandler
 	pub.Handlers["inbox"] = pub.InboxHandler
+	pub.Handlers["follow_requests"] = pub.FollowRequestsHandler
+	pub.Handlers["follow"] = pub.RemoteFollowHandler
+	pub.Handlers["rss"] = pub.RSSHandler
 	pub.Recover()
+	if util.SecretsEncrypted() {
+		// Seal keys stored before encryption was enabled, or with a master
+		// key that has since been rotated.
+		pub.Lock()
+		pub.Persist()
+		pub.Unlock()
+	}
+	mod.OnBlock(pub.purgeDomain)
+	notifier.OnDirect(pub.sendDirect)
 	return pub
 }
 
 func (p *activitypub) Start() {
+	p.registerQueueMetrics()
 	go p.PeriodicPoster()
+	go p.DeliveryWorker()
 }
 
 func (p *activitypub) userBaseUrl(name string) string {
 	return p.Resources.BaseUrl + ActorUrlPrefix + "/" + name
 }
 
+func (p *activitypub) postUrl(name, id string) string {
+	return p.userBaseUrl(name) + PostUrlPrefix + "/" + id
+}
+
 func (p *activitypub) userFeatureUrl(feature, name string) string {
 	return p.userBaseUrl(name) + "/" + feature
 }
 
 func (p *activitypub) Recover() {
 	// Requires mutex
-	p.StateInterface.Read(&p.Users)
-	glog.Infof("Recovered %+v", p.Users)
+	if err := p.StateInterface.Read(&p.Users); err != nil {
+		util.Fatal(log, "Could not recover users", "error", err)
+	}
+	log.Info("Recovered users", "users", len(p.Users))
 }
 
 func (p *activitypub) Persist() {
 	// Requires mutex
-	p.StateInterface.Write(p.Users)
+	if err := p.StateInterface.Write(p.Users); err != nil {
+		log.Error("Error persisting users", "error", err)
+	}
 }
@@ -1,20 +1,21 @@
 package activitypub
 
 import (
-	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
-	"time"
 
-	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/ml8/ap-bot/moderation"
 	"github.com/ml8/ap-bot/util"
+	"golang.org/x/exp/slices"
 )
 
 func (p *activitypub) getOrAddUser(name string) (user *User, exists bool) {
@@ -22,7 +23,7 @@ func (p *activitypub) getOrAddUser(name string) (user *User, exists bool) {
 	defer p.Unlock()
 	user, exists = p.Users[name]
 	if !exists {
-		key, _ := rsa.GenerateKey(rand.Reader, 2048)
+		key, _ := rsa.GenerateKey(rand.Reader, keyBits)
 		user = &User{
 			Name:       name,
 			Followers:  nil,
@@ -34,90 +35,213 @@ func (p *activitypub) getOrAddUser(name string) (user *User, exists bool) {
 	return
 }
 
+func (p *activitypub) getUser(name string) (user *User, exists bool) {
+	p.Lock()
+	defer p.Unlock()
+	user, exists = p.Users[name]
+	return
+}
+
 func (p *activitypub) publicKeyForUser(u *User) *PublicKey {
+	key, id := u.signingKey()
 	return &PublicKey{
-		KeyId: p.userBaseUrl(u.Name) + "#main-key",
+		KeyId: p.userBaseUrl(u.Name) + "#" + id,
 		Owner: p.userBaseUrl(u.Name),
-		Key:   u.encodePublicKey(),
+		Key:   encodePublicKey(&key.PublicKey),
 	}
 }
 
 func (p *activitypub) actorForUser(user *User) (a *Actor) {
 	name := user.Name
+	user.Lock()
+	profile := user.Profile
+	locked := user.Settings.Locked
+	migration := user.Migration
+	user.Unlock()
 	a = &Actor{
 		ID:            p.userBaseUrl(name),
 		Type:          "Person",
 		Inbox:         p.userFeatureUrl("inbox", name),
 		Outbox:        p.userFeatureUrl("outbox", name),
-		Approves:      false,
+		Approves:      locked,
 		PreferredName: name,
 		Summary:       fmt.Sprintf("Pocket user %v", name),
 		Discoverable:  true,
 		Name:          name,
 		Followers:     p.userFeatureUrl("followers", name),
 		PublicKey:     *p.publicKeyForUser(user),
+		Assertion:     p.assertionMethods(user),
+		Icon:          p.mediaImage(profile.Avatar),
+		Image:         p.mediaImage(profile.Header),
+		AlsoKnownAs:   IRIs(migration.AlsoKnownAs),
+		MovedTo:       IRI(migration.MovedTo),
+	}
+	if profile.DisplayName != "" {
+		a.Name = profile.DisplayName
+	}
+	if profile.Summary != "" {
+		a.Summary = renderText(profile.Summary)
+	}
+	for _, f := range profile.Fields {
+		a.Attachment = append(a.Attachment, Embed(PropertyValue{
+			Type:  "PropertyValue",
+			Name:  f.Name,
+			Value: renderValue(f.Value),
+		}))
 	}
 	return
 }
 
 func (p *activitypub) WebFingerHandler(w http.ResponseWriter, r *http.Request) {
+	// Browser clients look up accounts too.
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == "OPTIONS" {
+		w.Header().Set("Access-Control-Allow-Methods", "GET")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != "GET" && r.Method != "HEAD" {
+		util.ErrorResponse(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v not supported", r.Method))
+		return
+	}
 	query := r.URL.Query().Get("resource")
-	glog.Infof("Got query %v", query)
-	name, resType, _ := parseResourceString(query)
-	if name == "" {
-		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("No name found in query %v", query))
+	log.InfoContext(r.Context(), "WebFinger query", "resource", query)
+	if query == "" {
+		util.ErrorResponse(w, http.StatusBadRequest, "Missing resource")
 		return
 	}
-	if resType != "acct" {
-		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Unknown resource type %v", resType))
+	name, host, err := parseResource(query)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
+	if !strings.EqualFold(host, p.Resources.Host) {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("%v is not on this server", query))
+		return
+	}
+	if strings.HasPrefix(query, "http") {
+		// Actor urls name the user by path.
+		name, err = p.actorName(query)
+		if err != nil {
+			util.ErrorResponse(w, http.StatusNotFound, err.Error())
+			return
+		}
+	}
 
-	// Is user valid?
-	if !p.Pocket.IsLoggedIn(name) {
-		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("User %v not logged in", name))
-		return
-	}
-
-	// Provide response
-	resp := &WebFingerNode{}
-	resp.Subject = query
-	resp.Aliases = nil
-	// Using that WebFinger response, Mastodon will check the following:
-	//   - The subject is present
-	//   - The links array contains a link with rel of self and type of either:
-	//        application/ld+json; profile="https://www.w3.org/ns/activitystreams", or
-	//        application/activity+json
-	//       - The href for this link resolves to an ActivityPub actor
-	//
-	// Using that ActivityPub actor representation (which may be provided directly, without
-	// the initial WebFinger request), Mastodon will do the following:
-	//   - Take preferredUsername and the hostname of the actor’s server
-	//   - Construct an acct: URI using that username and domain
-	//   - Make a Webfinger request for that resource
-	resp.Links = append(resp.Links, WebFingerLink{
-		Rel:  "self",
-		Type: "application/activity+json",
-		Href: p.Resources.BaseUrl + ActorUrlPrefix + "/" + name,
-	})
-	util.JsonResponse(w, http.StatusOK, resp)
-	return
+	var resp *WebFingerNode
+	if name == p.Resources.Host {
+		resp = &WebFingerNode{
+			Subject: "acct:" + name + "@" + p.Resources.Host,
+			Aliases: []string{p.instanceActorUrl()},
+			Links: []WebFingerLink{{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: p.instanceActorUrl(),
+			}},
+		}
+	} else if !p.Pocket.IsLoggedIn(name) {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("User %v not found", name))
+		return
+	} else {
+		// Using that WebFinger response, Mastodon will check the following:
+		//   - The subject is present
+		//   - The links array contains a link with rel of self and type of either:
+		//        application/ld+json; profile="https://www.w3.org/ns/activitystreams", or
+		//        application/activity+json
+		//       - The href for this link resolves to an ActivityPub actor
+		//
+		// Using that ActivityPub actor representation (which may be provided directly, without
+		// the initial WebFinger request), Mastodon will do the following:
+		//   - Take preferredUsername and the hostname of the actor’s server
+		//   - Construct an acct: URI using that username and domain
+		//   - Make a Webfinger request for that resource
+		actor := p.userBaseUrl(name)
+		resp = &WebFingerNode{
+			Subject: "acct:" + name + "@" + p.Resources.Host,
+			Aliases: []string{actor},
+			Links: []WebFingerLink{{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: actor,
+			}, {
+				Rel:  "http://webfinger.net/rel/profile-page",
+				Type: "text/html",
+				Href: actor,
+			}},
+		}
+	}
+
+	// Clients may ask for only some relations.
+	if rels := r.URL.Query()["rel"]; len(rels) > 0 {
+		var links []WebFingerLink
+		for _, link := range resp.Links {
+			if slices.Contains(rels, link.Rel) {
+				links = append(links, link)
+			}
+		}
+		resp.Links = links
+	}
+	util.TypedResponse(w, http.StatusOK, "application/jrd+json", resp, json.Marshal)
+}
+
+// actorName returns the user (or, for the instance actor, the host) named by
+// one of our actor urls.
+func (p *activitypub) actorName(iri string) (string, error) {
+	if iri == p.instanceActorUrl() {
+		return p.Resources.Host, nil
+	}
+	name, ok := strings.CutPrefix(iri, p.userBaseUrl(""))
+	if !ok || name == "" || strings.ContainsAny(name, "/?#") {
+		return "", fmt.Errorf("%v is not an actor", iri)
+	}
+	return name, nil
 }
 
 func (p *activitypub) ActorHandler(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["account"]
-	glog.Infof("Actor for %v", name)
+	log.InfoContext(r.Context(), "Actor requested", "user", name)
 	if !p.Pocket.IsLoggedIn(name) {
 		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("User %v is not logged in", name))
 		return
 	}
 	user, _ := p.getOrAddUser(name)
+	if p.suspended(w, user) {
+		return
+	}
+	if wantsHTML(r) {
+		p.renderProfile(w, r, http.StatusOK, user, "")
+		return
+	}
+	w.Header().Set("Vary", "Accept")
 	actor := p.actorForUser(user)
-	wrapped := ActorContext{Actor: *actor, Context: SecurityContext()}
-	glog.Infof("ActorResponse: %v", wrapped)
-	util.JsonResponse(w, http.StatusOK, wrapped)
+	actor.Context = ProfileContext()
+	if status, err := p.checkFetch(r); err != nil {
+		if status == http.StatusForbidden {
+			util.ErrorResponse(w, status, err.Error())
+			return
+		}
+		// Unsigned fetches get just enough to verify the user's signatures
+		// and find their inbox.
+		actor = &Actor{
+			Context:       actor.Context,
+			ID:            actor.ID,
+			Type:          actor.Type,
+			Inbox:         actor.Inbox,
+			Outbox:        actor.Outbox,
+			PreferredName: actor.PreferredName,
+			PublicKey:     actor.PublicKey,
+			Assertion:     actor.Assertion,
+		}
+	}
+	log.DebugContext(r.Context(), "Actor response", "actor", actor)
+	util.JsonResponse(w, http.StatusOK, actor)
 }
 
+// Some collections are for browsers, which can't sign. The feed is not: it
+// shows what unsigned fetches of the actor do not, so it is not served when
+// signed fetches are required.
+var browserCollections = map[string]bool{"follow_requests": true, "follow": true}
+
 func (p *activitypub) CollectionHandler(w http.ResponseWriter, r *http.Request) {
 	name := mux.Vars(r)["account"]
 	collection := mux.Vars(r)["collection"]
@@ -126,11 +250,17 @@ func (p *activitypub) CollectionHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 	user, _ := p.getOrAddUser(name)
+	if p.suspended(w, user) {
+		return
+	}
 	handler, ok := p.Handlers[collection]
 	if !ok {
 		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Collection %v not found for user %v", collection, user))
 		return
 	}
+	if !browserCollections[collection] && !p.authorizeFetch(w, r) {
+		return
+	}
 	handler(user, w, r)
 }
 
@@ -141,12 +271,90 @@ func (p *activitypub) FollowersHandler(user *User, w http.ResponseWriter, r *htt
 		return nil
 	}
 	user.forEachFollower(f)
-	resp := CollectionContext{Collection: *followers, Context: DefaultContext()}
-	util.JsonResponse(w, http.StatusOK, resp)
+	followers.Context = DefaultContext()
+	util.JsonResponse(w, http.StatusOK, followers)
+}
+
+func (p *activitypub) FollowRequestsHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	if name, generation := p.Cookies.SessionUser(r); name != user.Name || !p.Pocket.ValidSession(name, generation) {
+		util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Follow requests of %v are private", user.Name))
+		return
+	}
+	requests := NewCollection(p.userFeatureUrl("follow_requests", user.Name), false)
+	user.Lock()
+	for _, pending := range user.Pending {
+		requests.AddItem(pending.Actor)
+	}
+	user.Unlock()
+	requests.Context = DefaultContext()
+	util.JsonResponse(w, http.StatusOK, requests)
 }
 
-func (p *activitypub) UnfollowActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
-	user.delFollower(string(activity.Actor))
+// UndoActivityHandler dispatches on the type of the activity being undone.
+func (p *activitypub) UndoActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
+	actor := activity.Actor.String()
+	iri := activity.Object.ID()
+	inner := &Activity{}
+	if err := activity.Object.Decode(inner); err == ErrNotEmbedded {
+		// Only the IRI is given; it can only be recognized as a follow, like or
+		// share we recorded.
+		inner = &Activity{ID: iri, Type: "Follow", Actor: activity.Actor, Object: Ref(p.userBaseUrl(user.Name))}
+		if iri == "" || !p.isRecordedFollow(user, actor, iri) {
+			p.forgetInteraction(user, "likes", iri, actor)
+			p.forgetInteraction(user, "shares", iri, actor)
+			util.JsonResponse(w, http.StatusOK, "")
+			return
+		}
+	} else if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Error decoding undone object: %v", err))
+		return
+	}
+	if inner.Actor != "" && inner.Actor != activity.Actor {
+		util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("%v cannot undo activity of %v", activity.Actor, inner.Actor))
+		return
+	}
+	switch strings.ToLower(inner.Type) {
+	case "follow":
+		p.UnfollowActivityHandler(user, actor, inner, w, r)
+	case "like":
+		p.forgetInteraction(user, "likes", inner.ID, actor)
+		util.JsonResponse(w, http.StatusOK, "")
+	case "announce":
+		p.forgetInteraction(user, "shares", inner.ID, actor)
+		util.JsonResponse(w, http.StatusOK, "")
+	default:
+		log.DebugContext(r.Context(), "Ignoring undo", "type", inner.Type, "object", iri)
+		util.JsonResponse(w, http.StatusOK, "")
+	}
+}
+
+// isRecordedFollow reports whether id names a follow of user by actor that is
+// pending or was accepted.
+func (p *activitypub) isRecordedFollow(user *User, actor, id string) bool {
+	user.Lock()
+	defer user.Unlock()
+	for _, pending := range user.Pending {
+		if pending.Actor == actor && pending.Follow.ID == id {
+			return true
+		}
+	}
+	recorded, ok := user.Follows[actor]
+	return ok && recorded == id
+}
+
+func (p *activitypub) UnfollowActivityHandler(user *User, actor string, follow *Activity, w http.ResponseWriter, r *http.Request) {
+	if target := follow.Object.ID(); target != "" && target != p.userBaseUrl(user.Name) {
+		log.WarnContext(r.Context(), "Ignoring undo of follow sent to another user", "target", target, "user", user.Name)
+		util.JsonResponse(w, http.StatusOK, "")
+		return
+	}
+	if !p.isRecordedFollow(user, actor, follow.ID) && !user.followMatches(actor, follow.ID) {
+		log.WarnContext(r.Context(), "Ignoring undo of unrecorded follow", "follow", follow.ID, "actor", actor)
+		util.JsonResponse(w, http.StatusOK, "")
+		return
+	}
+	user.delPending(actor)
+	user.delFollower(actor)
 	p.Lock()
 	p.Persist()
 	p.Unlock()
@@ -154,51 +362,61 @@ func (p *activitypub) UnfollowActivityHandler(user *User, activity *Activity, w
 }
 
 func (p *activitypub) FollowActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
-	user.addFollower(string(activity.Actor))
+	if target := activity.Object.ID(); target != p.userBaseUrl(user.Name) {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Follow of %v sent to %v", target, user.Name))
+		return
+	}
+	user.Lock()
+	locked := user.Settings.Locked
+	user.Unlock()
+	if locked || p.Moderation.Check(user.Name, activity.Actor.String()) == moderation.Silenced {
+		// Held until the owner answers from the account page.
+		user.addPending(activity)
+		p.Lock()
+		p.Persist()
+		p.Unlock()
+		util.JsonResponse(w, http.StatusAccepted, "")
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, "")
+	p.acceptFollow(context.WithoutCancel(r.Context()), user, activity)
+}
+
+// acceptFollow adds the follower, answers their Follow and sends them a post.
+func (p *activitypub) acceptFollow(ctx context.Context, user *User, follow *Activity) {
+	user.addFollower(follow.Actor.String())
+	user.recordFollow(follow.Actor.String(), follow.ID)
 	p.Lock()
 	p.Persist()
 	p.Unlock()
 	// new follower -- send a post
-	go p.postArticle(user)
-	util.JsonResponse(w, http.StatusOK, "")
+	go p.postArticle(ctx, user)
+	p.answerFollow(ctx, user, follow, "Accept")
+}
 
-	// Send a follow response to the follower's inbox.
-	accept := ActivityContext{Activity: Activity{
-		ID:     p.userBaseUrl(user.Name) + "&id=" + uuid.NewString(),
-		Actor:  p.userBaseUrl(user.Name),
-		Type:   "Accept",
-		Object: ActivityContext{Activity: *activity, Context: DefaultContext()},
-		To:     []string{activity.Actor},
-	},
+// answerFollow sends an Accept or Reject of follow to the follower's inbox.
+// Rejections are sent even to blocked domains.
+func (p *activitypub) answerFollow(ctx context.Context, user *User, follow *Activity, answer string) {
+	response := Activity{
 		Context: SecurityContext(),
+		ID:      p.userBaseUrl(user.Name) + "&id=" + uuid.NewString(),
+		Actor:   IRI(p.userBaseUrl(user.Name)),
+		Type:    answer,
+		Object:  Embed(follow.withoutContext()),
+		To:      IRIs{follow.Actor.String()},
 	}
-	destActorInbox := activity.Actor + "/inbox"
-	jsonData, err := json.Marshal(accept)
+	body, err := json.Marshal(response)
 	if err != nil {
-		glog.Errorf("Error marshalling %v: %v", accept, err)
+		log.Error("Error encoding follow answer", "answer", answer, "actor", follow.Actor, "error", err)
 		return
 	}
-	glog.V(1).Infof("%v", string(jsonData))
-	req, err := http.NewRequest("POST", destActorInbox, bytes.NewBuffer(jsonData))
-	if err != nil {
-		glog.Errorf("Error creating request: %v", err)
+	if answer != "Reject" {
+		p.deliver(ctx, user, follow.Actor.String(), body)
 		return
 	}
-	req.Header.Set("Content-Type", "application/activity+json")
-	req.Header.Set("Host", req.URL.Host)
-	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-	p.sign(user, req, jsonData)
-	glog.Infof("Sending %+v", req)
-	client := &http.Client{}
-
-	resp, err := client.Do(req)
-	if err != nil {
-		glog.Errorf("Error sending %v: %v", req, err)
-		return
+	if _, err := p.send(ctx, user, p.inboxFor(follow.Actor.String()), body); err != nil {
+		log.Error("Error answering follow", "answer", answer, "actor", follow.Actor, "error", err)
 	}
-	body, _ := ioutil.ReadAll(resp.Body)
-	glog.Infof("Got response %+v - %v", resp, string(body))
-	resp.Body.Close()
 }
 
 func (p *activitypub) InboxHandler(user *User, w http.ResponseWriter, r *http.Request) {
@@ -206,21 +424,94 @@ func (p *activitypub) InboxHandler(user *User, w http.ResponseWriter, r *http.Re
 		util.ErrorResponse(w, http.StatusServiceUnavailable, "GET not supported for inbox")
 		return
 	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxFetchSize))
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Error reading body: %v", err))
+		return
+	}
 	activity := &Activity{}
-	body, _ := ioutil.ReadAll(r.Body)
 	if err := json.Unmarshal(body, activity); err != nil {
-		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error unmarshalling %v: %v", string(body), err))
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Error parsing activity: %v", err))
 		return
 	}
-	glog.Infof("Parsed: %v", activity)
+	log.InfoContext(r.Context(), "Received activity", "user", user.Name, "type", activity.Type, "actor", activity.Actor.String(), "id", activity.ID)
+	if p.Moderation.Blocked(user.Name, activity.Actor.String()) {
+		p.recordInbox(user.Name, activity, "blocked")
+		util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("Actor %v is blocked", activity.Actor))
+		return
+	}
+	signer, err := p.verifyRequest(r, body)
+	if err == nil && signer != activity.Actor.String() {
+		err = fmt.Errorf("Activity of %v signed by %v", activity.Actor, signer)
+	}
+	if err != nil {
+		// A deleted actor's key can no longer be fetched; its deletion is
+		// confirmed by the actor being gone instead.
+		if !isSelfDelete(activity) || !p.actorGone(activity.Actor.String()) {
+			p.recordInbox(user.Name, activity, "unverified: "+err.Error())
+			util.ErrorResponse(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+	p.recordInbox(user.Name, activity, "accepted")
 	if strings.ToLower(activity.Type) == "follow" {
 		p.FollowActivityHandler(user, activity, w, r)
 		return
 	} else if strings.ToLower(activity.Type) == "undo" {
-		p.UnfollowActivityHandler(user, activity, w, r)
+		p.UndoActivityHandler(user, activity, w, r)
+		return
+	} else if strings.ToLower(activity.Type) == "delete" {
+		p.DeleteActivityHandler(user, activity, w, r)
+		return
+	} else if strings.ToLower(activity.Type) == "move" {
+		p.MoveActivityHandler(user, activity, w, r)
+		return
+	} else if t := strings.ToLower(activity.Type); t == "like" || t == "announce" || t == "create" {
+		p.InteractionActivityHandler(user, activity, w, r)
 		return
 	}
-	glog.V(1).Infof("Unsupported activity type %v: %v", activity.Type, activity)
-	// Just say OK to things like undo...
+	log.DebugContext(r.Context(), "Unsupported activity type", "type", activity.Type, "id", activity.ID)
 	util.ErrorResponse(w, http.StatusOK, "")
 }
+
+func isSelfDelete(activity *Activity) bool {
+	return strings.ToLower(activity.Type) == "delete" && activity.Object.ID() == activity.Actor.String()
+}
+
+// DeleteActivityHandler handles deletion of remote accounts, which stop
+// following every local user.
+func (p *activitypub) DeleteActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
+	if !isSelfDelete(activity) {
+		// Deleted replies are dropped from the post they replied to.
+		p.forgetInteraction(user, "replies", activity.Object.ID(), activity.Actor.String())
+		util.JsonResponse(w, http.StatusOK, "")
+		return
+	}
+	p.removeActor(activity.Actor.String())
+	util.JsonResponse(w, http.StatusOK, "")
+}
+
+// removeActor forgets a remote actor that no longer exists.
+func (p *activitypub) removeActor(actor string) {
+	p.Lock()
+	var users []*User
+	for _, u := range p.Users {
+		users = append(users, u)
+	}
+	p.Unlock()
+	for _, u := range users {
+		u.delPending(actor)
+		u.Lock()
+		following := slices.Contains(u.Followers, actor)
+		u.Unlock()
+		if following {
+			u.delFollower(actor)
+		}
+	}
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	p.Deliveries.dropActor(actor)
+	p.Remote.evict(actor)
+	log.Info("Removed deleted actor", "actor", actor)
+}
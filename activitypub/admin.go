@@ -0,0 +1,279 @@
+package activitypub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+	"golang.org/x/exp/slices"
+)
+
+// Operations on behalf of the operator of the bridge, rather than a user.
+
+// UserInfo summarizes a user for the operator.
+type UserInfo struct {
+	Name      string    `json:"name"`
+	Linked    bool      `json:"linked"` // has a pocket token
+	Followers int       `json:"followers"`
+	Pending   int       `json:"pending"`
+	Posted    int       `json:"posted"`
+	LastPost  time.Time `json:"lastpost,omitempty"`
+	Settings  Settings  `json:"settings"`
+	KeyId     string    `json:"keyid"`
+	MovedTo   string    `json:"movedto,omitempty"`
+	Suspended bool      `json:"suspended,omitempty"`
+}
+
+// InboxEvent is an activity received by an inbox, kept for the operator.
+type InboxEvent struct {
+	Received time.Time `json:"received"`
+	User     string    `json:"user,omitempty"` // empty for the instance actor
+	Actor    string    `json:"actor"`
+	Type     string    `json:"type"`
+	Object   string    `json:"object,omitempty"`
+	Result   string    `json:"result"`
+}
+
+// MaxInboxEvents is how many received activities are kept in memory.
+const MaxInboxEvents = 100
+
+func (p *activitypub) userInfo(u *User) UserInfo {
+	_, keyId := u.signingKey()
+	u.Lock()
+	info := UserInfo{
+		Name:      u.Name,
+		Followers: len(u.Followers),
+		Pending:   len(u.Pending),
+		Posted:    u.Posted,
+		LastPost:  u.LastPost,
+		Settings:  u.Settings,
+		KeyId:     keyId,
+		MovedTo:   u.Migration.MovedTo,
+		Suspended: u.Suspended,
+	}
+	u.Unlock()
+	info.Linked = p.Pocket.IsLoggedIn(info.Name)
+	return info
+}
+
+// ListUsers summarizes every user, by name.
+func (p *activitypub) ListUsers() []UserInfo {
+	p.Lock()
+	users := make([]*User, 0, len(p.Users))
+	for _, u := range p.Users {
+		users = append(users, u)
+	}
+	p.Unlock()
+	infos := make([]UserInfo, 0, len(users))
+	for _, u := range users {
+		infos = append(infos, p.userInfo(u))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (p *activitypub) UserInfo(name string) (UserInfo, error) {
+	user, ok := p.getUser(name)
+	if !ok {
+		return UserInfo{}, fmt.Errorf("No user %v", name)
+	}
+	return p.userInfo(user), nil
+}
+
+// RemoveFollower drops actor from the followers of a user, rejecting their
+// follow so that their server stops showing them as following.
+func (p *activitypub) RemoveFollower(name, actor string) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	user.Lock()
+	following := slices.Contains(user.Followers, actor)
+	id := user.Follows[actor]
+	user.Unlock()
+	if !following {
+		return fmt.Errorf("%v does not follow %v", actor, name)
+	}
+	user.delFollower(actor)
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	p.answerFollow(context.Background(), user, &Activity{
+		ID:     id,
+		Type:   "Follow",
+		Actor:  IRI(actor),
+		Object: Ref(p.userBaseUrl(name)),
+	}, "Reject")
+	return nil
+}
+
+// PostNow posts an article for a user straight away, even if they paused
+// posting.
+func (p *activitypub) PostNow(name string) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	return p.publish(context.Background(), user)
+}
+
+// Queue returns copies of the queued and dead deliveries, without the keys
+// of deleted senders.
+func (p *activitypub) Queue() (queued, dead []Delivery) {
+	d := p.Deliveries
+	d.Lock()
+	defer d.Unlock()
+	for _, dl := range d.State.Queue {
+		c := *dl
+		c.Key = nil
+		queued = append(queued, c)
+	}
+	for _, dl := range d.State.Dead {
+		c := *dl
+		c.Key = nil
+		dead = append(dead, c)
+	}
+	return
+}
+
+// RetryDeliveries makes the delivery with the given id due now, moving it back
+// from the dead letters if need be. An empty id retries every dead letter. It
+// returns the number of deliveries rescheduled.
+func (p *activitypub) RetryDeliveries(id string) int {
+	d := p.Deliveries
+	d.Lock()
+	defer d.Unlock()
+	now := time.Now()
+	n := 0
+	for _, dl := range d.State.Queue {
+		if dl.ID == id {
+			dl.NextTry = now
+			n++
+		}
+	}
+	var dead []*Delivery
+	for _, dl := range d.State.Dead {
+		if id != "" && dl.ID != id {
+			dead = append(dead, dl)
+			continue
+		}
+		dl.Attempts = 0
+		dl.NextTry = now
+		d.State.Queue = append(d.State.Queue, dl)
+		n++
+	}
+	d.State.Dead = dead
+	d.Persist()
+	log.Info("Rescheduled deliveries", "count", n)
+	return n
+}
+
+// PurgeDeliveries discards the delivery with the given id, queued or dead. An
+// empty id discards every dead letter. It returns the number discarded.
+func (p *activitypub) PurgeDeliveries(id string) int {
+	d := p.Deliveries
+	d.Lock()
+	defer d.Unlock()
+	n := 0
+	keep := func(list []*Delivery) []*Delivery {
+		var kept []*Delivery
+		for _, dl := range list {
+			if dl.ID == id && !d.InFlight[dl.ID] {
+				n++
+				continue
+			}
+			kept = append(kept, dl)
+		}
+		return kept
+	}
+	if id != "" {
+		d.State.Queue = keep(d.State.Queue)
+		d.State.Dead = keep(d.State.Dead)
+	} else {
+		n = len(d.State.Dead)
+		d.State.Dead = nil
+	}
+	d.Persist()
+	log.Info("Purged deliveries", "count", n)
+	return n
+}
+
+// Suspend stops or restarts posting for a user, and hides their actor from
+// other servers, regardless of their own settings.
+func (p *activitypub) Suspend(name string, suspended bool) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	user.Lock()
+	user.Suspended = suspended
+	user.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	log.Info("Set suspension", "user", name, "suspended", suspended)
+	return nil
+}
+
+// suspended answers requests for a suspended user's objects.
+func (p *activitypub) suspended(w http.ResponseWriter, u *User) bool {
+	u.Lock()
+	suspended := u.Suspended
+	u.Unlock()
+	if suspended {
+		util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("User %v is suspended", u.Name))
+	}
+	return suspended
+}
+
+// FollowerDomains counts the followers of every user by domain.
+func (p *activitypub) FollowerDomains() map[string]int {
+	p.Lock()
+	users := make([]*User, 0, len(p.Users))
+	for _, u := range p.Users {
+		users = append(users, u)
+	}
+	p.Unlock()
+	counts := make(map[string]int)
+	for _, u := range users {
+		u.forEachFollower(func(f string) error {
+			if parsed, err := url.Parse(f); err == nil && parsed.Host != "" {
+				counts[parsed.Host]++
+			}
+			return nil
+		})
+	}
+	return counts
+}
+
+func (p *activitypub) recordInbox(user string, activity *Activity, result string) {
+	inboxActivities.WithLabelValues(activityType(activity.Type), inboxResult(result)).Inc()
+	p.Lock()
+	defer p.Unlock()
+	p.Received = append(p.Received, InboxEvent{
+		Received: time.Now(),
+		User:     user,
+		Actor:    activity.Actor.String(),
+		Type:     activity.Type,
+		Object:   activity.Object.ID(),
+		Result:   result,
+	})
+	if len(p.Received) > MaxInboxEvents {
+		p.Received = slices.Delete(p.Received, 0, len(p.Received)-MaxInboxEvents)
+	}
+}
+
+// RecentInbox returns the activities received lately, most recent first.
+func (p *activitypub) RecentInbox() []InboxEvent {
+	p.Lock()
+	defer p.Unlock()
+	events := make([]InboxEvent, len(p.Received))
+	for i, ev := range p.Received {
+		events[len(events)-1-i] = ev
+	}
+	return events
+}
@@ -0,0 +1,433 @@
+package activitypub
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ml8/ap-bot/util"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	DeliveryTick        = time.Second
+	DeliveryConcurrency = 4
+	MaxAttempts         = 10
+	MaxBackoff          = 12 * time.Hour
+	// Followers whose inbox has answered 410 Gone for this long are removed.
+	GoneTTL = 7 * 24 * time.Hour
+	// Failed deliveries are kept for inspection for DeadTTL, and at most
+	// MaxDead of them.
+	DeadTTL = 30 * 24 * time.Hour
+	MaxDead = 1000
+	// The status of an actor nothing is queued for is forgotten after it has
+	// not changed for ActorStatusTTL.
+	ActorStatusTTL = 30 * 24 * time.Hour
+)
+
+// Delivery is an activity queued for a follower's (or relay's) inbox.
+type Delivery struct {
+	ID        string      `json:"id"`
+	User      string      `json:"user"`               // sender
+	Actor     string      `json:"actor"`              // recipient
+	Inbox     string      `json:"inbox,omitempty"`    // if not the actor's own, e.g. a relay's
+	Instance  bool        `json:"instance,omitempty"` // signed by the instance actor
+	Key       *RetiredKey `json:"key,omitempty"`      // of a sender since deleted
+	Body      string      `json:"body"`
+	Attempts  int         `json:"attempts,omitempty"`
+	NextTry   time.Time   `json:"nexttry"`
+	LastError string      `json:"lasterror,omitempty"`
+	Created   time.Time   `json:"created"`
+	Trace     string      `json:"trace,omitempty"` // W3C traceparent of the activity
+}
+
+// ActorStatus tracks delivery health of a remote actor's inbox.
+type ActorStatus struct {
+	GoneSince   time.Time `json:"gonesince,omitempty"`
+	LastSuccess time.Time `json:"lastsuccess,omitempty"`
+	Failures    int       `json:"failures,omitempty"` // consecutive
+	Updated     time.Time `json:"updated,omitempty"`
+}
+
+type deliveryState struct {
+	Queue  []*Delivery             `json:"queue,omitempty"`
+	Dead   []*Delivery             `json:"dead,omitempty"` // gave up after MaxAttempts
+	Actors map[string]*ActorStatus `json:"actors,omitempty"`
+}
+
+type deliveries struct {
+	sync.Mutex
+	State          deliveryState   // protected by mutex
+	InFlight       map[string]bool // protected by mutex
+	Heartbeat      time.Time       // protected by mutex; when the worker last ran
+	Dirty          bool            // protected by mutex; attempts not yet persisted
+	StateInterface util.Persister
+}
+
+func newDeliveries(statefile string) *deliveries {
+	d := &deliveries{
+		State:          deliveryState{Actors: make(map[string]*ActorStatus)},
+		InFlight:       make(map[string]bool),
+		StateInterface: util.NewPersister(statefile),
+	}
+	if err := d.StateInterface.Read(&d.State); err != nil {
+		util.Fatal(log, "Could not recover deliveries", "error", err)
+	}
+	if d.State.Actors == nil {
+		d.State.Actors = make(map[string]*ActorStatus)
+	}
+	log.Info("Recovered deliveries", "queued", len(d.State.Queue))
+	return d
+}
+
+func (d *deliveries) Persist() {
+	// Requires mutex
+	if err := d.StateInterface.Write(d.State); err != nil {
+		log.Error("Error persisting deliveries", "error", err)
+		return
+	}
+	d.Dirty = false
+}
+
+// flush prunes old failures and actor statuses and persists attempts made
+// since the last flush, so that the state is written at most once a tick.
+func (d *deliveries) flush() {
+	d.Lock()
+	defer d.Unlock()
+	if !d.Dirty {
+		return
+	}
+	d.prune()
+	d.Persist()
+}
+
+func (d *deliveries) prune() {
+	// Requires mutex
+	var dead []*Delivery
+	for _, dl := range d.State.Dead {
+		if time.Since(dl.Created) < DeadTTL {
+			dead = append(dead, dl)
+		}
+	}
+	if len(dead) > MaxDead {
+		dead = dead[len(dead)-MaxDead:]
+	}
+	d.State.Dead = dead
+
+	queued := make(map[string]bool)
+	for _, dl := range d.State.Queue {
+		queued[dl.Actor] = true
+	}
+	for actor, s := range d.State.Actors {
+		if !queued[actor] && time.Since(s.Updated) > ActorStatusTTL {
+			delete(d.State.Actors, actor)
+		}
+	}
+}
+
+func (d *deliveries) status(actor string) *ActorStatus {
+	// Requires mutex
+	s, ok := d.State.Actors[actor]
+	if !ok {
+		s = &ActorStatus{}
+		d.State.Actors[actor] = s
+	}
+	return s
+}
+
+// due claims the deliveries that should be attempted now.
+func (d *deliveries) due(max int) []*Delivery {
+	d.Lock()
+	defer d.Unlock()
+	var due []*Delivery
+	now := time.Now()
+	for _, dl := range d.State.Queue {
+		if len(due) >= max {
+			break
+		}
+		if !d.InFlight[dl.ID] && !dl.NextTry.After(now) {
+			d.InFlight[dl.ID] = true
+			due = append(due, dl)
+		}
+	}
+	return due
+}
+
+func (d *deliveries) remove(id string) {
+	// Requires mutex
+	for i, dl := range d.State.Queue {
+		if dl.ID == id {
+			d.State.Queue = append(d.State.Queue[:i], d.State.Queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// dropActor discards everything queued for actor.
+func (d *deliveries) dropActor(actor string) {
+	d.Lock()
+	defer d.Unlock()
+	queue := d.State.Queue[:0]
+	for _, dl := range d.State.Queue {
+		if dl.Actor != actor {
+			queue = append(queue, dl)
+		}
+	}
+	d.State.Queue = queue
+	delete(d.State.Actors, actor)
+	d.Persist()
+}
+
+// dropUser discards everything queued or failed on behalf of user.
+func (d *deliveries) dropUser(user string) {
+	d.Lock()
+	defer d.Unlock()
+	keep := func(list []*Delivery) []*Delivery {
+		var kept []*Delivery
+		for _, dl := range list {
+			if dl.User != user {
+				kept = append(kept, dl)
+			}
+		}
+		return kept
+	}
+	d.State.Queue = keep(d.State.Queue)
+	d.State.Dead = keep(d.State.Dead)
+	d.Persist()
+}
+
+func backoff(attempts int) time.Duration {
+	b := time.Minute << (attempts - 1)
+	if b > MaxBackoff || b <= 0 {
+		return MaxBackoff
+	}
+	return b
+}
+
+// deliver queues an activity for actor's inbox, signed on behalf of u, unless
+// the actor's domain is blocked.
+func (p *activitypub) deliver(ctx context.Context, u *User, actor string, body []byte) {
+	p.deliverAll(ctx, u, []string{actor}, body)
+}
+
+// deliverAll queues an activity for the inboxes of actors, persisting the
+// queue once.
+func (p *activitypub) deliverAll(ctx context.Context, u *User, actors []string, body []byte) {
+	var dls []*Delivery
+	for _, actor := range actors {
+		dls = append(dls, &Delivery{User: u.Name, Actor: actor, Body: string(body)})
+	}
+	p.enqueue(ctx, dls)
+}
+
+// enqueue adds deliveries to the queue, as part of the trace in ctx, dropping
+// those to blocked actors.
+func (p *activitypub) enqueue(ctx context.Context, dls []*Delivery) {
+	now := time.Now()
+	tp := traceParent(ctx)
+	var queued []*Delivery
+	for _, dl := range dls {
+		if p.Moderation.Blocked(dl.User, dl.Actor) {
+			log.Info("Not delivering to blocked actor", "user", dl.User, "actor", dl.Actor)
+			continue
+		}
+		dl.ID = uuid.NewString()
+		dl.NextTry = now
+		dl.Created = now
+		dl.Trace = tp
+		queued = append(queued, dl)
+	}
+	if len(queued) == 0 {
+		return
+	}
+	p.Deliveries.Lock()
+	p.Deliveries.State.Queue = append(p.Deliveries.State.Queue, queued...)
+	p.Deliveries.Persist()
+	p.Deliveries.Unlock()
+}
+
+// broadcast queues activity for every follower of u, as part of the trace in
+// ctx.
+func (p *activitypub) broadcast(ctx context.Context, u *User, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return fmt.Errorf("Error marshaling %v: %v", activity, err)
+	}
+	log.Debug("Broadcasting", "user", u.Name, "activity", string(body))
+	var followers []string
+	err = u.forEachFollower(func(follower string) error {
+		followers = append(followers, follower)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.deliverAll(ctx, u, followers, body)
+	return nil
+}
+
+// broadcastFinal queues activity for every follower of u signed with u's
+// current key, which is kept with the deliveries, for activities that must
+// go out after u is deleted.
+func (p *activitypub) broadcastFinal(ctx context.Context, u *User, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return fmt.Errorf("Error marshaling %v: %v", activity, err)
+	}
+	key, id := u.signingKey()
+	signer := &RetiredKey{Id: id, Key: key, Retired: time.Now()}
+	var dls []*Delivery
+	err = u.forEachFollower(func(follower string) error {
+		dls = append(dls, &Delivery{User: u.Name, Actor: follower, Body: string(body), Key: signer})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	p.enqueue(ctx, dls)
+	return nil
+}
+
+// send POSTs an activity to inbox, signed on behalf of u.
+func (p *activitypub) send(ctx context.Context, u *User, inbox string, body []byte) (int, error) {
+	key, id := u.signingKey()
+	return sendAs(ctx, key, p.userBaseUrl(u.Name)+"#"+id, inbox, body)
+}
+
+// sendAs POSTs an activity to inbox, signed with key.
+func sendAs(ctx context.Context, key *rsa.PrivateKey, keyId, inbox string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", inbox, bytes.NewBuffer(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/activity+json")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	signWith(key, keyId, req, body)
+	log.Debug("Sending activity", "inbox", inbox, "key_id", keyId, "activity", string(body))
+	resp, err := deliveryClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	respBody, _ := ioutil.ReadAll(resp.Body)
+	log.Debug("Inbox answered", "inbox", inbox, "status", resp.StatusCode, "body", string(respBody))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Delivery to %v failed: %v", inbox, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a delivery that got status may succeed later.
+func retryable(status int) bool {
+	return status == 0 || status >= 500 || status == http.StatusTooManyRequests || status == http.StatusRequestTimeout
+}
+
+func (p *activitypub) attempt(dl *Delivery) {
+	var status int
+	var err error
+	var elapsed time.Duration
+	ctx, span := tracer.Start(tracedContext(dl.Trace), "deliver", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(
+		attribute.String("delivery.id", dl.ID),
+		attribute.String("delivery.user", dl.User),
+		attribute.String("delivery.actor", dl.Actor),
+		attribute.String("server.address", hostOf(dl.Actor)),
+		attribute.Int("delivery.attempt", dl.Attempts+1),
+	))
+	user, ok := p.getUser(dl.User)
+	ok = ok || dl.Key != nil
+	if !ok {
+		err = fmt.Errorf("No user %v", dl.User)
+	} else {
+		inbox := dl.Inbox
+		if inbox == "" {
+			inbox = p.inboxFor(dl.Actor)
+		}
+		start := time.Now()
+		switch {
+		case dl.Instance:
+			status, err = sendAs(ctx, p.InstanceKey, p.instanceKeyId(), inbox, []byte(dl.Body))
+		case dl.Key != nil:
+			status, err = sendAs(ctx, dl.Key.Key, p.userBaseUrl(dl.User)+"#"+dl.Key.Id, inbox, []byte(dl.Body))
+		default:
+			status, err = p.send(ctx, user, inbox, []byte(dl.Body))
+		}
+		elapsed = time.Since(start)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", status))
+	endSpan(span, err)
+	result := "delivered"
+
+	var gone bool
+	var goneSince time.Time
+	d := p.Deliveries
+	d.Lock()
+	delete(d.InFlight, dl.ID)
+	s := d.status(dl.Actor)
+	s.Updated = time.Now()
+	switch {
+	case err == nil:
+		d.remove(dl.ID)
+		s.GoneSince = time.Time{}
+		s.LastSuccess = time.Now()
+		s.Failures = 0
+	case status == http.StatusGone:
+		d.remove(dl.ID)
+		if s.GoneSince.IsZero() {
+			s.GoneSince = time.Now()
+		}
+		goneSince = s.GoneSince
+		gone = time.Since(goneSince) > GoneTTL
+		result = "gone"
+	default:
+		log.Warn("Delivery failed", "id", dl.ID, "actor", dl.Actor, "attempt", dl.Attempts+1, "status", status, "error", err)
+		s.Failures += 1
+		dl.Attempts += 1
+		dl.LastError = err.Error()
+		dl.NextTry = time.Now().Add(backoff(dl.Attempts))
+		result = "retrying"
+		if !ok || !retryable(status) || dl.Attempts >= MaxAttempts {
+			d.remove(dl.ID)
+			d.State.Dead = append(d.State.Dead, dl)
+			result = "failed"
+		}
+	}
+	d.Dirty = true
+	d.Unlock()
+	deliveryResults.WithLabelValues(result, hostOf(dl.Actor)).Inc()
+	if ok {
+		deliveryDuration.WithLabelValues(result).Observe(elapsed.Seconds())
+	}
+
+	if gone {
+		log.Info("Inbox gone; removing actor", "actor", dl.Actor, "since", goneSince)
+		p.removeActor(dl.Actor)
+	}
+}
+
+// DeliveryWorker attempts queued deliveries as they come due.
+func (p *activitypub) DeliveryWorker() {
+	slots := make(chan struct{}, DeliveryConcurrency)
+	for {
+		p.Deliveries.Lock()
+		p.Deliveries.Heartbeat = time.Now()
+		p.Deliveries.Unlock()
+		p.Deliveries.flush()
+		for _, dl := range p.Deliveries.due(DeliveryConcurrency) {
+			slots <- struct{}{}
+			go func(dl *Delivery) {
+				defer func() { <-slots }()
+				p.attempt(dl)
+			}(dl)
+		}
+		time.Sleep(DeliveryTick)
+	}
+}
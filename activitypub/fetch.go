@@ -0,0 +1,191 @@
+package activitypub
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+const (
+	ActorCacheTTL = 24 * time.Hour
+	MaxFetchSize  = 1 << 20
+)
+
+// Remote actors, cached so that keys and inboxes needn't be fetched for
+// every activity.
+type remoteCache struct {
+	sync.Mutex
+	Actors map[string]remoteActor // protected by mutex
+}
+
+type remoteActor struct {
+	Actor   *Actor
+	Fetched time.Time
+}
+
+func newRemoteCache() *remoteCache {
+	return &remoteCache{Actors: make(map[string]remoteActor)}
+}
+
+func (c *remoteCache) get(iri string) (*Actor, bool) {
+	c.Lock()
+	defer c.Unlock()
+	cached, ok := c.Actors[iri]
+	if !ok || time.Since(cached.Fetched) > ActorCacheTTL {
+		return nil, false
+	}
+	return cached.Actor, true
+}
+
+func (c *remoteCache) put(iri string, actor *Actor) {
+	c.Lock()
+	defer c.Unlock()
+	c.Actors[iri] = remoteActor{Actor: actor, Fetched: time.Now()}
+}
+
+func (c *remoteCache) evict(iri string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.Actors, iri)
+}
+
+// Remote documents and inboxes are named by other servers and by users, so
+// requests to them only go to public addresses.
+var (
+	fetchClient    = util.PublicClient(30 * time.Second)
+	deliveryClient = util.PublicClient(time.Minute)
+)
+
+// fetch GETs an ActivityPub document into v, returning the response status.
+// Fetches are signed by the instance actor.
+func (p *activitypub) fetch(iri string, v interface{}) (int, error) {
+	req, err := http.NewRequest("GET", iri, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/activity+json, application/ld+json; profile=\"https://www.w3.org/ns/activitystreams\"")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	signWith(p.InstanceKey, p.instanceKeyId(), req, nil)
+	resp, err := fetchClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("Fetching %v: %v", iri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, MaxFetchSize))
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return resp.StatusCode, fmt.Errorf("Error decoding %v: %v", iri, err)
+	}
+	return resp.StatusCode, nil
+}
+
+// fetchActor returns the remote actor at iri, from the cache unless refresh
+// is set. The status of the fetch is returned if one was made.
+func (p *activitypub) fetchActor(iri string, refresh bool) (*Actor, int, error) {
+	if !refresh {
+		if actor, ok := p.Remote.get(iri); ok {
+			return actor, http.StatusOK, nil
+		}
+	}
+	actor := &Actor{}
+	status, err := p.fetch(iri, actor)
+	if err != nil {
+		if status == http.StatusGone || status == http.StatusNotFound {
+			p.Remote.evict(iri)
+		}
+		return nil, status, err
+	}
+	if actor.ID != iri {
+		return nil, status, fmt.Errorf("Actor fetched from %v has id %v", iri, actor.ID)
+	}
+	p.Remote.put(iri, actor)
+	return actor, status, nil
+}
+
+// actorGone reports whether a fresh fetch of actor says it has been deleted.
+func (p *activitypub) actorGone(actor string) bool {
+	_, status, _ := p.fetchActor(actor, true)
+	return status == http.StatusGone
+}
+
+// inboxFor returns the inbox of a remote actor.
+func (p *activitypub) inboxFor(actor string) string {
+	if a, _, err := p.fetchActor(actor, false); err == nil && a.Inbox != "" {
+		return a.Inbox
+	}
+	return actor + "/inbox"
+}
+
+// publicKey returns the key named by keyId and the actor that owns it.
+func (p *activitypub) publicKey(keyId string, refresh bool) (*rsa.PublicKey, string, error) {
+	owner, _, _ := strings.Cut(keyId, "#")
+	actor, _, err := p.fetchActor(owner, refresh)
+	if err != nil {
+		return nil, "", err
+	}
+	if actor.PublicKey.KeyId != keyId || actor.PublicKey.Owner != actor.ID {
+		return nil, "", fmt.Errorf("Actor %v does not own key %v", actor.ID, keyId)
+	}
+	key, err := parsePublicKey(actor.PublicKey.Key)
+	return key, actor.ID, err
+}
+
+func parsePublicKey(s string) (*rsa.PublicKey, error) {
+	blk, _ := pem.Decode([]byte(s))
+	if blk == nil {
+		return nil, fmt.Errorf("No PEM data in public key")
+	}
+	if key, err := x509.ParsePKCS1PublicKey(blk.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(blk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported public key type %T", key)
+	}
+	return rsaKey, nil
+}
+
+// resolveActor turns a handle (@user@domain) into an actor IRI via WebFinger.
+// IRIs are returned as they are.
+func (p *activitypub) resolveActor(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "https://") || strings.HasPrefix(s, "http://") {
+		return s, nil
+	}
+	user, domain, ok := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(s, "acct:"), "@"), "@")
+	if !ok || user == "" || domain == "" {
+		return "", fmt.Errorf("%q is neither an actor url nor a handle", s)
+	}
+	resource := url.QueryEscape("acct:" + user + "@" + domain)
+	node := &WebFingerNode{}
+	if _, err := p.fetch("https://"+domain+WebFingerUrl+"?resource="+resource, node); err != nil {
+		return "", err
+	}
+	for _, link := range node.Links {
+		if link.Rel == "self" && (link.Type == "application/activity+json" || strings.HasPrefix(link.Type, "application/ld+json")) {
+			return link.Href, nil
+		}
+	}
+	return "", fmt.Errorf("No actor found for %v", s)
+}
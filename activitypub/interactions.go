@@ -0,0 +1,279 @@
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ml8/ap-bot/notify"
+	"github.com/ml8/ap-bot/util"
+)
+
+func (u *User) addPost(rec *PostRecord) {
+	u.Lock()
+	defer u.Unlock()
+	u.Posts = append(u.Posts, rec)
+	u.Posted++
+	if len(u.Posts) > MaxPostHistory {
+		u.Posts = u.Posts[len(u.Posts)-MaxPostHistory:]
+	}
+}
+
+// post returns the user's post with the given IRI.
+func (p *activitypub) post(u *User, iri string) (*PostRecord, bool) {
+	id, ok := strings.CutPrefix(iri, p.postUrl(u.Name, ""))
+	if !ok {
+		return nil, false
+	}
+	u.Lock()
+	defer u.Unlock()
+	for _, rec := range u.Posts {
+		if rec.ID == id {
+			return rec, true
+		}
+	}
+	return nil, false
+}
+
+// interactions returns the list of interactions of kind on rec.
+func (rec *PostRecord) interactions(kind string) *[]Interaction {
+	switch kind {
+	case "likes":
+		return &rec.Likes
+	case "shares":
+		return &rec.Shares
+	case "replies":
+		return &rec.Replies
+	}
+	return nil
+}
+
+// recordInteraction adds an interaction to the post with IRI object,
+// reporting whether it is new. An actor likes or shares a post only once.
+func (p *activitypub) recordInteraction(u *User, object, kind string, i Interaction) bool {
+	rec, ok := p.post(u, object)
+	if !ok {
+		return false
+	}
+	if r := []rune(i.Content); len(r) > MaxReplyContent {
+		i.Content = string(r[:MaxReplyContent]) + "…"
+	}
+	u.Lock()
+	list := rec.interactions(kind)
+	for _, existing := range *list {
+		if existing.ID == i.ID || (kind != "replies" && existing.Actor == i.Actor) {
+			u.Unlock()
+			return false
+		}
+	}
+	i.Received = time.Now()
+	*list = append(*list, i)
+	if len(*list) > MaxInteractions {
+		*list = (*list)[len(*list)-MaxInteractions:]
+	}
+	u.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	log.Info("Recorded interaction", "kind", kind, "object", object, "actor", i.Actor)
+	return true
+}
+
+// forgetInteraction removes interaction id of kind by actor from any post.
+func (p *activitypub) forgetInteraction(u *User, kind, id, actor string) {
+	u.Lock()
+	found := false
+	for _, rec := range u.Posts {
+		list := rec.interactions(kind)
+		for i, existing := range *list {
+			if existing.ID == id && existing.Actor == actor {
+				*list = append((*list)[:i], (*list)[i+1:]...)
+				found = true
+				break
+			}
+		}
+	}
+	u.Unlock()
+	if found {
+		p.Lock()
+		p.Persist()
+		p.Unlock()
+		log.Info("Removed interaction", "kind", kind, "id", id, "actor", actor)
+	}
+}
+
+// InteractionActivityHandler records Likes, Announces and replies to posts.
+func (p *activitypub) InteractionActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
+	actor := activity.Actor.String()
+	switch strings.ToLower(activity.Type) {
+	case "like":
+		p.recordInteraction(user, activity.Object.ID(), "likes", Interaction{ID: activity.ID, Actor: actor})
+	case "announce":
+		p.recordInteraction(user, activity.Object.ID(), "shares", Interaction{ID: activity.ID, Actor: actor})
+	case "create":
+		note := &Note{}
+		if err := activity.Object.Decode(note); err != nil {
+			log.DebugContext(r.Context(), "Ignoring create", "object", activity.Object.ID(), "error", err)
+			break
+		}
+		if note.AttributedTo.String() != actor {
+			util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("%v cannot create note of %v", actor, note.AttributedTo))
+			return
+		}
+		notification := notify.Notification{Actor: actor, Content: note.Content, Url: note.Url.String()}
+		if notification.Url == "" {
+			notification.Url = note.ID
+		}
+		if rec, ok := p.post(user, note.InReplyTo.String()); ok {
+			if p.recordInteraction(user, note.InReplyTo.String(), "replies", Interaction{ID: note.ID, Actor: actor, Content: note.Content}) {
+				notification.Kind = notify.Reply
+				notification.Post = rec.Title
+			}
+		} else if p.mentions(user, note) {
+			notification.Kind = notify.Mention
+		}
+		if notification.Kind != "" {
+			p.Notifier.Notify(user.Name, notification)
+		}
+	}
+	util.JsonResponse(w, http.StatusOK, "")
+}
+
+// mentions reports whether note mentions or is addressed to user.
+func (p *activitypub) mentions(user *User, note *Note) bool {
+	id := p.userBaseUrl(user.Name)
+	if note.To.Contains(id) || note.Cc.Contains(id) {
+		return true
+	}
+	for _, tag := range note.Tag {
+		if !strings.EqualFold(tag.Type(), "Mention") {
+			continue
+		}
+		m := &Mention{}
+		if tag.Decode(m) == nil && m.Href.String() == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sendDirect sends text to the fediverse account to as a direct message from
+// user's actor.
+func (p *activitypub) sendDirect(name, to, text string) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("User %v not found", name)
+	}
+	target, err := p.resolveActor(to)
+	if err != nil {
+		return err
+	}
+	handle := to
+	if !strings.HasPrefix(handle, "@") {
+		handle = target
+	}
+	content := fmt.Sprintf(`<p><span class="h-card"><a href="%v" class="u-url mention">%v</a></span></p><p>%v</p>`,
+		html.EscapeString(target), html.EscapeString(handle),
+		strings.ReplaceAll(html.EscapeString(text), "\n", "<br/>"))
+	id := p.userFeatureUrl("notifications", name) + "/" + uuid.NewString()
+	note := &Note{
+		ID:           id,
+		Type:         "Note",
+		AttributedTo: IRI(p.userBaseUrl(name)),
+		To:           IRIs{target},
+		Content:      content,
+		Published:    time.Now().UTC().Format(time.RFC3339),
+		Tag:          ObjectRefs{Embed(&Mention{Type: "Mention", Href: IRI(target), Name: handle})},
+	}
+	activity := Activity{
+		Context: SecurityContext(),
+		ID:      id + "/activity",
+		Type:    "Create",
+		Actor:   IRI(p.userBaseUrl(name)),
+		To:      note.To,
+		Object:  Embed(note),
+	}
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+	p.deliver(context.Background(), user, target, body)
+	return nil
+}
+
+// PostHandler serves a posted Note.
+func (p *activitypub) PostHandler(w http.ResponseWriter, r *http.Request) {
+	user, rec := p.postForRequest(w, r)
+	if rec == nil {
+		return
+	}
+	user.Lock()
+	note := p.Note(user, rec)
+	user.Unlock()
+	note.Context = DefaultContext()
+	util.JsonResponse(w, http.StatusOK, note)
+}
+
+// PostCollectionHandler serves the likes, shares or replies of a post.
+func (p *activitypub) PostCollectionHandler(w http.ResponseWriter, r *http.Request) {
+	user, rec := p.postForRequest(w, r)
+	if rec == nil {
+		return
+	}
+	kind := mux.Vars(r)["collection"]
+	list := rec.interactions(kind)
+	if list == nil {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Collection %v not found", kind))
+		return
+	}
+	c := NewCollection(p.postUrl(user.Name, rec.ID)+"/"+kind, false)
+	user.Lock()
+	for _, i := range *list {
+		c.AddItem(i.ID)
+	}
+	user.Unlock()
+	c.Context = DefaultContext()
+	util.JsonResponse(w, http.StatusOK, c)
+}
+
+func (p *activitypub) postForRequest(w http.ResponseWriter, r *http.Request) (*User, *PostRecord) {
+	if !p.authorizeFetch(w, r) {
+		return nil, nil
+	}
+	name := mux.Vars(r)["account"]
+	user, ok := p.getUser(name)
+	if !ok || !p.Pocket.IsLoggedIn(name) {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("User %v not found", name))
+		return nil, nil
+	}
+	if p.suspended(w, user) {
+		return nil, nil
+	}
+	rec, ok := p.post(user, p.postUrl(name, mux.Vars(r)["post"]))
+	if !ok {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Post %v not found", mux.Vars(r)["post"]))
+		return nil, nil
+	}
+	return user, rec
+}
+
+// Posts returns the user's post history, most recent first.
+func (p *activitypub) Posts(name string) []PostRecord {
+	user, ok := p.getUser(name)
+	if !ok {
+		return nil
+	}
+	user.Lock()
+	defer user.Unlock()
+	var posts []PostRecord
+	for i := len(user.Posts) - 1; i >= 0; i-- {
+		posts = append(posts, *user.Posts[i])
+	}
+	return posts
+}
@@ -0,0 +1,277 @@
+package activitypub
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+const (
+	MainKeyId    = "main-key"    // fragment of a user's first key
+	Ed25519KeyId = "ed25519-key" // fragment of a user's FEP-521a key
+	// KeyGracePeriod is how long a replaced key is kept after a rotation.
+	// Nothing is signed with it: servers that still hold the old key fetch
+	// the actor again when a signature does not verify.
+	KeyGracePeriod = 7 * 24 * time.Hour
+	keyBits        = 2048
+)
+
+// RetiredKey is a key replaced by a rotation, kept until KeyGracePeriod has
+// passed.
+type RetiredKey struct {
+	Id      string          `json:"id"` // fragment of the key's id
+	Key     *rsa.PrivateKey `json:"-"`
+	Retired time.Time       `json:"retired"`
+}
+
+func (k *RetiredKey) MarshalJSON() ([]byte, error) {
+	type plain RetiredKey
+	key, err := encodePrivateKey(k.Key)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(&struct {
+		*plain
+		Key util.Secret `json:"key"`
+	}{(*plain)(k), key})
+}
+
+func (k *RetiredKey) UnmarshalJSON(data []byte) error {
+	type plain RetiredKey
+	aux := &struct {
+		*plain
+		Key json.RawMessage `json:"key"`
+	}{plain: (*plain)(k)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	key, err := decodePrivateKey(aux.Key)
+	if err != nil {
+		return fmt.Errorf("Error reading retired key %v: %v", k.Id, err)
+	}
+	k.Key = key
+	return nil
+}
+
+// Multikey is a public key published in an actor's assertionMethod (FEP-521a).
+type Multikey struct {
+	Id                 string `json:"id"`
+	Type               string `json:"type"`
+	Controller         string `json:"controller"`
+	PublicKeyMultibase string `json:"publicKeyMultibase"`
+}
+
+// encodePrivateKey returns key as a PKCS#8 PEM block, sealed when a master key
+// is configured.
+func encodePrivateKey(key crypto.PrivateKey) (util.Secret, error) {
+	if key == nil {
+		return "", nil
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return util.Secret(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// parsePrivateKey reads a PKCS#8 or, as written before, PKCS#1 PEM block.
+func parsePrivateKey(data []byte) (crypto.PrivateKey, error) {
+	blk, _ := pem.Decode(data)
+	if blk == nil {
+		return nil, fmt.Errorf("No PEM data in private key")
+	}
+	switch blk.Type {
+	case "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(blk.Bytes)
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(blk.Bytes)
+	}
+	return nil, fmt.Errorf("Unsupported PEM block %q", blk.Type)
+}
+
+// decodePrivateKey reads an RSA key stored as PEM in a util.Secret, or in the
+// JSON encoding of rsa.PrivateKey used before that.
+func decodePrivateKey(raw json.RawMessage) (*rsa.PrivateKey, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	var s util.Secret
+	if err := json.Unmarshal(raw, &s); errors.Is(err, util.ErrNotSealed) {
+		key := &rsa.PrivateKey{}
+		if err := json.Unmarshal(raw, key); err != nil {
+			return nil, err
+		}
+		key.Precompute()
+		util.MarkPlaintext()
+		return key, key.Validate()
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey([]byte(s.Reveal()))
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Expected an RSA key, got %T", key)
+	}
+	return rsaKey, nil
+}
+
+func decodeEd25519Key(raw json.RawMessage) (ed25519.PrivateKey, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	var s util.Secret
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	key, err := parsePrivateKey([]byte(s.Reveal()))
+	if err != nil {
+		return nil, err
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("Expected an Ed25519 key, got %T", key)
+	}
+	return edKey, nil
+}
+
+// encodePublicKey returns pub as a PKIX ("PUBLIC KEY") PEM block.
+func encodePublicKey(pub crypto.PublicKey) string {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Error("Error encoding public key", "error", err)
+		return ""
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// multibaseEd25519 encodes pub as a base58btc multibase string with the
+// ed25519-pub multicodec prefix, as Multikey requires.
+func multibaseEd25519(pub ed25519.PublicKey) string {
+	data := append([]byte{0xed, 0x01}, pub...)
+	n := new(big.Int).SetBytes(data)
+	base, mod := big.NewInt(58), new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		out = append(out, base58Alphabet[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return "z" + string(out)
+}
+
+// signingKey returns u's current key and the fragment identifying it.
+func (u *User) signingKey() (*rsa.PrivateKey, string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.KeyId == "" {
+		return u.PrivateKey, MainKeyId
+	}
+	return u.PrivateKey, u.KeyId
+}
+
+// pruneRetiredKeys forgets the keys u replaced before KeyGracePeriod.
+func (u *User) pruneRetiredKeys() {
+	// Requires mutex
+	var keys []RetiredKey
+	for _, k := range u.RetiredKeys {
+		if time.Since(k.Retired) < KeyGracePeriod {
+			keys = append(keys, k)
+		}
+	}
+	u.RetiredKeys = keys
+}
+
+// assertionMethods lists u's Ed25519 key, if it has one.
+func (p *activitypub) assertionMethods(u *User) []Multikey {
+	u.Lock()
+	key := u.Ed25519Key
+	u.Unlock()
+	if key == nil {
+		return nil
+	}
+	id := p.userBaseUrl(u.Name)
+	return []Multikey{{
+		Id:                 id + "#" + Ed25519KeyId,
+		Type:               "Multikey",
+		Controller:         id,
+		PublicKeyMultibase: multibaseEd25519(key.Public().(ed25519.PublicKey)),
+	}}
+}
+
+// nextKeyId returns the fragment for the key replacing one identified by id:
+// main-key is followed by key-2, key-3 and so on.
+func nextKeyId(id string) string {
+	n, err := strconv.Atoi(strings.TrimPrefix(id, "key-"))
+	if err != nil {
+		n = 1
+	}
+	return fmt.Sprintf("key-%d", n+1)
+}
+
+// RotateKey replaces the signing key of a user and tells followers about it
+// with an Update of the actor. The old key is kept for KeyGracePeriod. With
+// withEd25519 a new Ed25519 key is published in the actor's assertionMethod
+// as well.
+func (p *activitypub) RotateKey(name string, withEd25519 bool) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, keyBits)
+	if err != nil {
+		return fmt.Errorf("Error generating key: %v", err)
+	}
+	var edKey ed25519.PrivateKey
+	if withEd25519 {
+		if _, edKey, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return fmt.Errorf("Error generating Ed25519 key: %v", err)
+		}
+	}
+	user.Lock()
+	user.pruneRetiredKeys()
+	oldId := user.KeyId
+	if oldId == "" {
+		oldId = MainKeyId
+	}
+	user.RetiredKeys = append(user.RetiredKeys, RetiredKey{Id: oldId, Key: user.PrivateKey, Retired: time.Now()})
+	user.PrivateKey = key
+	user.KeyId = nextKeyId(oldId)
+	if edKey != nil {
+		user.Ed25519Key = edKey
+	}
+	newId := user.KeyId
+	user.Unlock()
+
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	log.Info("Rotated key", "user", name, "from", oldId, "to", newId)
+	p.sendActorUpdate(user)
+	return nil
+}
@@ -0,0 +1,87 @@
+package activitypub
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ml8/ap-bot/util"
+)
+
+const (
+	MediaUrlPrefix   = "/media"
+	MediaUrlTemplate = MediaUrlPrefix + "/{file}"
+	MaxMediaSize     = 4 << 20
+)
+
+var (
+	mediaTypes = map[string]string{
+		"image/png":  ".png",
+		"image/jpeg": ".jpg",
+		"image/gif":  ".gif",
+		"image/webp": ".webp",
+	}
+	mediaName = regexp.MustCompile(`^[0-9a-f-]+\.(png|jpg|gif|webp)$`)
+)
+
+func (p *activitypub) mediaUrl(file string) string {
+	return p.Resources.BaseUrl + MediaUrlPrefix + "/" + file
+}
+
+// SaveMedia stores an uploaded image and returns its file name.
+func (p *activitypub) SaveMedia(data []byte) (string, error) {
+	if len(data) > MaxMediaSize {
+		return "", fmt.Errorf("Image is larger than %v bytes", MaxMediaSize)
+	}
+	ext, ok := mediaTypes[http.DetectContentType(data)]
+	if !ok {
+		return "", fmt.Errorf("Unsupported image type %v", http.DetectContentType(data))
+	}
+	if err := os.MkdirAll(p.Resources.MediaDir, 0755); err != nil {
+		return "", err
+	}
+	file := uuid.NewString() + ext
+	if err := os.WriteFile(filepath.Join(p.Resources.MediaDir, file), data, 0644); err != nil {
+		return "", err
+	}
+	log.Info("Saved media", "file", file)
+	return file, nil
+}
+
+// DeleteMedia removes a stored image.
+func (p *activitypub) DeleteMedia(file string) {
+	if file == "" || !mediaName.MatchString(file) {
+		return
+	}
+	if err := os.Remove(filepath.Join(p.Resources.MediaDir, file)); err != nil {
+		log.Warn("Error removing media", "file", file, "error", err)
+	}
+}
+
+func (p *activitypub) MediaHandler(w http.ResponseWriter, r *http.Request) {
+	file := mux.Vars(r)["file"]
+	if !mediaName.MatchString(file) {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("No media %v", file))
+		return
+	}
+	w.Header().Set("Cache-Control", "public, max-age=604800")
+	http.ServeFile(w, r, filepath.Join(p.Resources.MediaDir, file))
+}
+
+// mediaImage describes a stored image for an actor document.
+func (p *activitypub) mediaImage(file string) *Image {
+	if file == "" {
+		return nil
+	}
+	var mediaType string
+	for t, ext := range mediaTypes {
+		if filepath.Ext(file) == ext {
+			mediaType = t
+		}
+	}
+	return &Image{Type: "Image", MediaType: mediaType, Url: IRI(p.mediaUrl(file))}
+}
@@ -0,0 +1,114 @@
+package activitypub
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// DeliveryStall is how long the delivery worker may go without looking at
+// the queue before it is considered dead. A full set of slow sends can hold
+// it up for their timeout.
+const DeliveryStall = 5 * time.Minute
+
+var (
+	inboxActivities = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "inbox_activities_total",
+		Help:      "Activities received in inboxes, by type and result (accepted, blocked or unverified).",
+	}, []string{"type", "result"})
+	deliveryResults = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "deliveries_total",
+		Help:      "Outbound delivery attempts, by status (delivered, retrying, failed or gone) and remote host.",
+	}, []string{"status", "host"})
+	deliveryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Time taken to deliver to a remote inbox, by status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"status"})
+	postingTicks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "posting_ticks_total",
+		Help:      "Runs of the periodic poster.",
+	})
+	posts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "posts_total",
+		Help:      "Articles posted, or skipped, for users.",
+	}, []string{"result"})
+)
+
+// registerQueueMetrics exports the size of the delivery queue as it stands
+// when scraped.
+func (p *activitypub) registerQueueMetrics() {
+	size := func(dead bool) func() float64 {
+		return func() float64 {
+			p.Deliveries.Lock()
+			defer p.Deliveries.Unlock()
+			if dead {
+				return float64(len(p.Deliveries.State.Dead))
+			}
+			return float64(len(p.Deliveries.State.Queue))
+		}
+	}
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "delivery_queue_depth",
+		Help:      "Deliveries waiting to be sent or retried.",
+	}, size(false))
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "delivery_dead_letters",
+		Help:      "Deliveries that failed for good and await an operator.",
+	}, size(true))
+}
+
+// metricTypes are the activity types counted by name; others are counted as
+// "other", so that senders cannot invent labels.
+var metricTypes = map[string]bool{
+	"accept": true, "announce": true, "create": true, "delete": true, "follow": true,
+	"like": true, "move": true, "reject": true, "undo": true, "update": true,
+}
+
+func activityType(t string) string {
+	if t = strings.ToLower(t); metricTypes[t] {
+		return t
+	}
+	return "other"
+}
+
+// inboxResult is result without its detail, e.g. the reason an activity
+// could not be verified.
+func inboxResult(result string) string {
+	kind, _, _ := strings.Cut(result, ":")
+	return kind
+}
+
+func hostOf(actor string) string {
+	if u, err := url.Parse(actor); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "unknown"
+}
+
+// DeliveryWorkerAlive reports an error unless the delivery worker has looked
+// at the queue lately.
+func (p *activitypub) DeliveryWorkerAlive() error {
+	p.Deliveries.Lock()
+	last := p.Deliveries.Heartbeat
+	p.Deliveries.Unlock()
+	if last.IsZero() {
+		return fmt.Errorf("Delivery worker not started")
+	}
+	if since := time.Since(last); since > DeliveryStall {
+		return fmt.Errorf("Delivery worker last ran %v ago", since.Round(time.Second))
+	}
+	return nil
+}
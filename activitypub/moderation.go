@@ -0,0 +1,56 @@
+package activitypub
+
+import (
+	"context"
+
+	"github.com/ml8/ap-bot/moderation"
+)
+
+// purgeDomain removes followers and follow requests from a newly blocked
+// domain, rejecting their follows. An empty user applies to every user.
+func (p *activitypub) purgeDomain(name, domain string) {
+	p.Lock()
+	var users []*User
+	for _, u := range p.Users {
+		if name == "" || u.Name == name {
+			users = append(users, u)
+		}
+	}
+	p.Unlock()
+
+	for _, u := range users {
+		var removed []*Activity
+		u.forEachFollower(func(f string) error {
+			if moderation.InDomain(f, domain) {
+				// The id is forgotten with the follower, and is what the
+				// follower's server matches the Reject by.
+				id := u.followId(f)
+				u.delFollower(f)
+				removed = append(removed, &Activity{
+					ID:     id,
+					Type:   "Follow",
+					Actor:  IRI(f),
+					Object: Ref(p.userBaseUrl(u.Name)),
+				})
+			}
+			return nil
+		})
+		for _, actor := range p.PendingFollows(u.Name) {
+			if moderation.InDomain(actor, domain) {
+				if follow := u.delPending(actor); follow != nil {
+					removed = append(removed, follow)
+				}
+			}
+		}
+		if len(removed) == 0 {
+			continue
+		}
+		p.Lock()
+		p.Persist()
+		p.Unlock()
+		log.Info("Removed followers from blocked domain", "count", len(removed), "user", u.Name, "domain", domain)
+		for _, follow := range removed {
+			p.answerFollow(context.Background(), u, follow, "Reject")
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package activitypub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/ml8/ap-bot/util"
+	"golang.org/x/exp/slices"
+)
+
+// MoveActivityHandler moves a follower to their new account, provided the
+// new account claims the old one as an alias.
+func (p *activitypub) MoveActivityHandler(user *User, activity *Activity, w http.ResponseWriter, r *http.Request) {
+	origin := activity.Actor.String()
+	target := activity.Target.ID()
+	if activity.Object.ID() != origin || target == "" {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Move of %v by %v is not an account move", activity.Object.ID(), origin))
+		return
+	}
+	moved, _, err := p.fetchActor(target, true)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, fmt.Sprintf("Error fetching move target %v: %v", target, err))
+		return
+	}
+	if !moved.AlsoKnownAs.Contains(origin) {
+		util.ErrorResponse(w, http.StatusForbidden, fmt.Sprintf("%v does not list %v as an alias", target, origin))
+		return
+	}
+	if p.Moderation.Blocked(user.Name, target) {
+		log.Info("Not moving follower to blocked actor", "origin", origin, "target", target)
+		p.removeActor(origin)
+		util.JsonResponse(w, http.StatusOK, "")
+		return
+	}
+	p.moveFollower(origin, target)
+	util.JsonResponse(w, http.StatusOK, "")
+}
+
+// moveFollower replaces origin with target in every user's followers.
+func (p *activitypub) moveFollower(origin, target string) {
+	p.Lock()
+	var users []*User
+	for _, u := range p.Users {
+		users = append(users, u)
+	}
+	p.Unlock()
+	for _, u := range users {
+		u.Lock()
+		following := slices.Contains(u.Followers, origin)
+		u.Unlock()
+		if following {
+			u.delFollower(origin)
+			u.addFollower(target)
+			log.Info("Moved follower", "user", u.Name, "origin", origin, "target", target)
+		}
+	}
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	p.Deliveries.dropActor(origin)
+	p.Remote.evict(origin)
+}
+
+func (p *activitypub) Migration(name string) (Migration, error) {
+	user, ok := p.getUser(name)
+	if !ok {
+		return Migration{}, fmt.Errorf("No user %v", name)
+	}
+	user.Lock()
+	defer user.Unlock()
+	return user.Migration, nil
+}
+
+// SetAliases sets the accounts (urls or handles) that may move to name.
+func (p *activitypub) SetAliases(name string, aliases []string) error {
+	var resolved []string
+	for _, alias := range aliases {
+		if strings.TrimSpace(alias) == "" {
+			continue
+		}
+		iri, err := p.resolveActor(alias)
+		if err != nil {
+			return err
+		}
+		resolved = append(resolved, iri)
+	}
+	user, _ := p.getOrAddUser(name)
+	user.Lock()
+	user.Migration.AlsoKnownAs = resolved
+	user.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	go p.sendActorUpdate(user)
+	return nil
+}
+
+// aliasesOf returns the aliases of an actor, which may be a local user.
+func (p *activitypub) aliasesOf(iri string) (IRIs, error) {
+	if name, ok := strings.CutPrefix(iri, p.userBaseUrl("")); ok {
+		user, exists := p.getUser(name)
+		if !exists {
+			return nil, fmt.Errorf("No user %v", name)
+		}
+		user.Lock()
+		defer user.Unlock()
+		return IRIs(user.Migration.AlsoKnownAs), nil
+	}
+	actor, _, err := p.fetchActor(iri, true)
+	if err != nil {
+		return nil, err
+	}
+	return actor.AlsoKnownAs, nil
+}
+
+// Move redirects name's followers to target, which must already list name as
+// an alias. Posting stops once moved. An empty target cancels a move.
+func (p *activitypub) Move(name, target string) error {
+	user, ok := p.getUser(name)
+	if !ok {
+		return fmt.Errorf("No user %v", name)
+	}
+	origin := p.userBaseUrl(name)
+	if target == "" {
+		user.Lock()
+		user.Migration.MovedTo = ""
+		user.Unlock()
+		p.Lock()
+		p.Persist()
+		p.Unlock()
+		go p.sendActorUpdate(user)
+		return nil
+	}
+	iri, err := p.resolveActor(target)
+	if err != nil {
+		return err
+	}
+	if iri == origin {
+		return fmt.Errorf("Cannot move %v to itself", name)
+	}
+	aliases, err := p.aliasesOf(iri)
+	if err != nil {
+		return fmt.Errorf("Error checking aliases of %v: %v", iri, err)
+	}
+	if !aliases.Contains(origin) {
+		return fmt.Errorf("%v must list %v as an alias before moving", iri, origin)
+	}
+
+	user.Lock()
+	user.Migration.MovedTo = iri
+	user.Settings.Paused = true
+	user.Unlock()
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	log.Info("Moving user", "user", name, "target", iri)
+
+	p.sendActorUpdate(user)
+	move := Activity{
+		Context: SecurityContext(),
+		ID:      origin + "#moves/" + uuid.NewString(),
+		Type:    "Move",
+		Actor:   IRI(origin),
+		Object:  Ref(origin),
+		Target:  Ref(iri),
+		To:      IRIs{p.userFeatureUrl("followers", name)},
+	}
+	return p.broadcast(context.Background(), user, move)
+}
@@ -0,0 +1,176 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ml8/ap-bot/util"
+)
+
+// Server discovery: NodeInfo for directories and crawlers, and host-meta for
+// clients that look up the WebFinger endpoint.
+const (
+	NodeInfoWellKnownUrl = "/.well-known/nodeinfo"
+	NodeInfoUrlTemplate  = "/nodeinfo/{version}"
+	HostMetaUrl          = "/.well-known/host-meta"
+	HostMetaJsonUrl      = HostMetaUrl + ".json"
+
+	SoftwareName = "ap-bot"
+)
+
+// Version is the software version reported in NodeInfo, set at build time
+// with -ldflags "-X github.com/ml8/ap-bot/activitypub.Version=...".
+var Version = "dev"
+
+var nodeInfoVersions = []string{"2.0", "2.1"}
+
+type NodeInfoLinks struct {
+	Links []WebFingerLink `json:"links"`
+}
+
+type NodeInfo struct {
+	Version           string           `json:"version"`
+	Software          NodeInfoSoftware `json:"software"`
+	Protocols         []string         `json:"protocols"`
+	Services          NodeInfoServices `json:"services"`
+	OpenRegistrations bool             `json:"openRegistrations"`
+	Usage             NodeInfoUsage    `json:"usage"`
+	Metadata          map[string]any   `json:"metadata"`
+}
+
+type NodeInfoSoftware struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository,omitempty"` // 2.1 only
+}
+
+type NodeInfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type NodeInfoUsage struct {
+	Users      NodeInfoUsers `json:"users"`
+	LocalPosts int           `json:"localPosts"`
+}
+
+type NodeInfoUsers struct {
+	Total          int `json:"total"`
+	ActiveMonth    int `json:"activeMonth"`
+	ActiveHalfyear int `json:"activeHalfyear"`
+}
+
+func nodeInfoSchema(version string) string {
+	return "http://nodeinfo.diaspora.software/ns/schema/" + version
+}
+
+// NodeInfoWellKnownHandler lists the supported NodeInfo documents.
+func (p *activitypub) NodeInfoWellKnownHandler(w http.ResponseWriter, r *http.Request) {
+	links := NodeInfoLinks{}
+	for _, v := range nodeInfoVersions {
+		links.Links = append(links.Links, WebFingerLink{
+			Rel:  nodeInfoSchema(v),
+			Href: p.Resources.SiteUrl + "/nodeinfo/" + v,
+		})
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	util.JsonResponse(w, http.StatusOK, links)
+}
+
+func (p *activitypub) NodeInfoHandler(w http.ResponseWriter, r *http.Request) {
+	version := mux.Vars(r)["version"]
+	known := false
+	for _, v := range nodeInfoVersions {
+		known = known || v == version
+	}
+	if !known {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("NodeInfo version %v not supported", version))
+		return
+	}
+	info := NodeInfo{
+		Version:           version,
+		Software:          NodeInfoSoftware{Name: SoftwareName, Version: Version},
+		Protocols:         []string{"activitypub"},
+		Services:          NodeInfoServices{Inbound: []string{}, Outbound: []string{}},
+		OpenRegistrations: true,
+		Usage:             p.usage(),
+		Metadata:          map[string]any{"nodeName": p.Resources.Host},
+	}
+	if version == "2.1" {
+		info.Software.Repository = "https://github.com/ml8/ap-bot"
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	contentType := fmt.Sprintf("application/json; profile=%q", nodeInfoSchema(version)+"#")
+	util.TypedResponse(w, http.StatusOK, contentType, info, json.Marshal)
+}
+
+// usage counts linked users, those who posted recently, and posts.
+func (p *activitypub) usage() NodeInfoUsage {
+	p.Lock()
+	var users []*User
+	for _, u := range p.Users {
+		users = append(users, u)
+	}
+	p.Unlock()
+	usage := NodeInfoUsage{}
+	for _, u := range users {
+		if !p.Pocket.IsLoggedIn(u.Name) {
+			continue
+		}
+		u.Lock()
+		since := time.Since(u.LastPost)
+		usage.LocalPosts += u.Posted
+		u.Unlock()
+		usage.Users.Total++
+		if since < 30*24*time.Hour {
+			usage.Users.ActiveMonth++
+		}
+		if since < 180*24*time.Hour {
+			usage.Users.ActiveHalfyear++
+		}
+	}
+	return usage
+}
+
+type xrdLink struct {
+	Rel      string `xml:"rel,attr" json:"rel"`
+	Type     string `xml:"type,attr,omitempty" json:"type,omitempty"`
+	Template string `xml:"template,attr" json:"template"`
+}
+
+type xrd struct {
+	XMLName xml.Name  `xml:"http://docs.oasis-open.org/ns/xri/xrd-1.0 XRD" json:"-"`
+	Links   []xrdLink `xml:"Link" json:"links"`
+}
+
+func (p *activitypub) hostMeta() xrd {
+	return xrd{Links: []xrdLink{{
+		Rel:      "lrdd",
+		Type:     "application/jrd+json",
+		Template: p.Resources.SiteUrl + WebFingerUrl + "?resource={uri}",
+	}}}
+}
+
+// HostMetaHandler serves the XRD pointing at WebFinger.
+func (p *activitypub) HostMetaHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := xml.MarshalIndent(p.hostMeta(), "", "  ")
+	if err != nil {
+		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error rendering host-meta: %v", err))
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/xrd+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+// HostMetaJsonHandler serves host-meta as JRD.
+func (p *activitypub) HostMetaJsonHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	util.TypedResponse(w, http.StatusOK, "application/jrd+json", p.hostMeta(), json.Marshal)
+}
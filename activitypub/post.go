@@ -1,100 +1,121 @@
 package activitypub
 
 import (
-	"bytes"
-	"encoding/json"
-	"io/ioutil"
-	"net/http"
+	"context"
+	"fmt"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/google/uuid"
+	"github.com/ml8/ap-bot/pocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (p *activitypub) Note(user *User, post *Post) *Activity {
-	a := &Activity{
-		ID:           p.userBaseUrl(user.Name) + "&post=" + uuid.NewString(),
+func (p *activitypub) Note(user *User, rec *PostRecord) *Note {
+	post := &Post{&pocket.Article{Title: rec.Title, Excerpt: rec.Excerpt, Url: rec.Url}}
+	id := p.postUrl(user.Name, rec.ID)
+	n := &Note{
+		ID:           id,
 		Type:         "Note",
-		To:           []string{ToAll},
-		Published:    time.Now().Format(http.TimeFormat),
-		AttributedTo: p.userBaseUrl(user.Name),
+		To:           IRIs{ToAll},
+		Cc:           IRIs{p.userFeatureUrl("followers", user.Name)},
+		Published:    rec.Published.UTC().Format(time.RFC3339),
+		AttributedTo: IRI(p.userBaseUrl(user.Name)),
 		Content:      post.Content(),
+		Url:          IRI(id),
+		Replies:      Ref(id + "/replies"),
+		Likes:        Embed(&Collection{collection: collection{ID: id + "/likes", Type: "Collection", TotalItems: len(rec.Likes)}}),
+		Shares:       Embed(&Collection{collection: collection{ID: id + "/shares", Type: "Collection", TotalItems: len(rec.Shares)}}),
 	}
-	return a
+	return n
 }
 
 func (p *activitypub) PeriodicPoster() {
 	for {
+		postingTicks.Inc()
+		ctx, span := tracer.Start(context.Background(), "PeriodicPoster.tick")
 		p.Lock()
 		for _, user := range p.Users {
-			go p.postArticle(user)
+			if user.duePost(p.Interval) {
+				go p.postArticle(ctx, user)
+			}
 		}
 		p.Unlock()
-		glog.Infof("Sleeping for %v...", p.Interval)
+		span.End()
+		log.Info("Sleeping", "interval", p.Interval)
 		time.Sleep(p.Interval)
 	}
 }
 
-func (p *activitypub) postArticle(u *User) {
-	if !p.Pocket.IsLoggedIn(u.Name) {
-		glog.Warningf("User %v not logged in", u.Name)
+func (p *activitypub) postArticle(ctx context.Context, u *User) {
+	u.Lock()
+	paused := u.Settings.Paused
+	u.Unlock()
+	if paused {
+		log.Info("User has paused posting", "user", u.Name)
 		return
 	}
-	u.Lock()
-	if len(u.Followers) == 0 {
-		glog.Infof("User %v has no followers", u.Name)
-		u.Unlock()
+	if err := p.publish(ctx, u); err != nil {
+		log.Warn("Not posting", "user", u.Name, "error", err)
+		posts.WithLabelValues("skipped").Inc()
 		return
 	}
+	posts.WithLabelValues("published").Inc()
+}
+
+// publish posts a random article saved by u to their followers and relays.
+// Each post is traced on its own, linked to what triggered it in ctx.
+func (p *activitypub) publish(ctx context.Context, u *User) (err error) {
+	ctx, span := tracer.Start(ctx, "publish", trace.WithNewRoot(),
+		trace.WithLinks(trace.LinkFromContext(ctx)),
+		trace.WithAttributes(attribute.String("user", u.Name)))
+	defer func() { endSpan(span, err) }()
+	if !p.Pocket.IsLoggedIn(u.Name) {
+		return fmt.Errorf("User %v not logged in", u.Name)
+	}
+	u.Lock()
+	followers := len(u.Followers)
+	suspended := u.Suspended
 	u.Unlock()
-	art, err := p.Pocket.RandArticleForUser(u.Name)
-	if err != nil {
-		glog.Errorf("Error retrieving article for %v: %v", u.Name, err)
-		return
+	if suspended {
+		return fmt.Errorf("User %v is suspended", u.Name)
 	}
-	glog.Infof("Posting %v", art)
-	note := ActivityContext{Activity: *p.Note(u, &Post{&art}), Context: DefaultContext()}
-	activity := ActivityContext{
-		Activity: Activity{
-			ID:     note.ID,
-			Type:   "Create",
-			Actor:  p.userBaseUrl(u.Name),
-			To:     []string{ToAll},
-			Object: note,
-		},
-		Context: SecurityContext(),
+	if followers == 0 && len(p.relaysFor(u)) == 0 {
+		return fmt.Errorf("User %v has no followers or relays", u.Name)
 	}
-	body, err := json.Marshal(activity)
+	art, err := p.Pocket.RandArticleForUser(ctx, u.Name)
 	if err != nil {
-		glog.Errorf("Error marshaling %v: %v", activity, err)
-		return
+		return fmt.Errorf("Error retrieving article for %v: %v", u.Name, err)
 	}
-	glog.V(1).Infof("%v", string(body))
-	postFunc := func(follower string) error {
-		destActorInbox := follower + "/inbox"
-		req, err := http.NewRequest("POST", destActorInbox, bytes.NewBuffer(body))
-		if err != nil {
-			return err
-		}
-		req.Header.Set("Content-Type", "application/activity+json")
-		req.Header.Set("Host", req.URL.Host)
-		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
-		p.sign(u, req, body)
-		glog.V(1).Infof("Sending %+v", req)
-		client := &http.Client{}
-
-		resp, err := client.Do(req)
-		if err != nil {
-			return err
-		}
-		body, _ := ioutil.ReadAll(resp.Body)
-		glog.V(1).Infof("Got headers %+v", resp)
-		glog.V(1).Infof("Got body %v", string(body))
-		resp.Body.Close()
-		return nil
+	log.Info("Posting article", "user", u.Name, "url", art.Url)
+	rec := &PostRecord{
+		ID:        uuid.NewString(),
+		Title:     art.Title,
+		Url:       art.Url,
+		Excerpt:   art.Excerpt,
+		Published: time.Now(),
 	}
-	err = u.forEachFollower(postFunc)
-	if err != nil {
-		glog.Errorf("Error posting article for %v: %v", u.Name, err)
+	span.SetAttributes(attribute.String("post.id", rec.ID), attribute.String("post.url", rec.Url))
+	u.addPost(rec)
+	p.Lock()
+	p.Persist()
+	p.Unlock()
+	note := p.Note(u, rec)
+	activity := Activity{
+		Context: SecurityContext(),
+		ID:      note.ID + "/activity",
+		Type:    "Create",
+		Actor:   IRI(p.userBaseUrl(u.Name)),
+		To:      note.To,
+		Cc:      note.Cc,
+		Object:  Embed(note),
+	}
+	if err := p.broadcast(ctx, u, activity); err != nil {
+		log.ErrorContext(ctx, "Error posting article", "user", u.Name, "error", err)
 	}
+	p.forwardToRelays(ctx, u, rec, activity)
+	u.Lock()
+	u.LastPost = time.Now()
+	u.Unlock()
+	return nil
 }
@@ -0,0 +1,305 @@
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+// Browsers following a link to an actor get a profile page rather than its
+// JSON-LD.
+
+const (
+	MaxProfilePosts    = 20
+	RemoteFollowLimit  = 10 // lookups per client per window
+	RemoteFollowWindow = time.Minute
+	subscribeRel       = "http://ostatus.org/schema/1.0/subscribe"
+)
+
+// webFingerClient looks up visitors' accounts. The hosts come from visitors,
+// so only public addresses are reached, and requests are not signed.
+var webFingerClient = util.PublicClient(30 * time.Second)
+
+// wantsHTML reports whether the Accept header prefers a page to an
+// ActivityStreams document. Clients that don't say get the document.
+func wantsHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, "application/activity+json") || strings.Contains(accept, "application/ld+json") {
+		return false
+	}
+	return strings.Contains(accept, "text/html")
+}
+
+type profilePost struct {
+	Title     string
+	Url       string
+	Excerpt   string
+	Published time.Time
+	Likes     int
+	Shares    int
+	Replies   int
+}
+
+type profileField struct {
+	Name  string
+	Value template.HTML
+}
+
+type profilePage struct {
+	Name         string
+	Handle       string
+	DisplayName  string
+	Summary      template.HTML
+	Avatar       string
+	Header       string
+	Fields       []profileField
+	Followers    int
+	Posts        []profilePost
+	Actor        string
+	FollowersUrl string
+	Feed         string
+	FollowUrl    string
+	MovedTo      string
+	Message      string
+	Limited      bool // only what an unsigned fetch of the actor shows
+}
+
+// profilePage describes user's profile. Unless full, it is limited to what
+// unsigned fetches of the actor get, for servers requiring signed fetches.
+func (p *activitypub) profilePage(user *User, full bool) profilePage {
+	user.Lock()
+	defer user.Unlock()
+	page := profilePage{
+		Name:         user.Name,
+		Handle:       "@" + user.Name + "@" + p.Resources.Host,
+		DisplayName:  user.Name,
+		Actor:        p.userBaseUrl(user.Name),
+		FollowersUrl: p.userFeatureUrl("followers", user.Name),
+		Feed:         p.userFeatureUrl("rss", user.Name),
+		FollowUrl:    p.userFeatureUrl("follow", user.Name),
+		MovedTo:      user.Migration.MovedTo,
+	}
+	if !full {
+		page.Limited = true
+		return page
+	}
+	page.Summary = template.HTML(renderText(user.Profile.Summary))
+	page.Followers = len(user.Followers)
+	if user.Profile.DisplayName != "" {
+		page.DisplayName = user.Profile.DisplayName
+	}
+	if user.Profile.Avatar != "" {
+		page.Avatar = p.mediaUrl(user.Profile.Avatar)
+	}
+	if user.Profile.Header != "" {
+		page.Header = p.mediaUrl(user.Profile.Header)
+	}
+	for _, f := range user.Profile.Fields {
+		page.Fields = append(page.Fields, profileField{Name: f.Name, Value: template.HTML(renderValue(f.Value))})
+	}
+	for i := len(user.Posts) - 1; i >= 0 && len(page.Posts) < MaxProfilePosts; i-- {
+		rec := user.Posts[i]
+		page.Posts = append(page.Posts, profilePost{
+			Title:     rec.Title,
+			Url:       rec.Url,
+			Excerpt:   rec.Excerpt,
+			Published: rec.Published,
+			Likes:     len(rec.Likes),
+			Shares:    len(rec.Shares),
+			Replies:   len(rec.Replies),
+		})
+	}
+	return page
+}
+
+// renderProfile renders user's profile page, in full unless signed fetches
+// are required: browsers cannot sign.
+func (p *activitypub) renderProfile(w http.ResponseWriter, r *http.Request, status int, user *User, message string) {
+	_, err := p.checkFetch(r)
+	page := p.profilePage(user, err == nil)
+	page.Message = message
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(status)
+	if err := profileTemplate.Execute(w, page); err != nil {
+		log.Error("Error rendering profile", "user", user.Name, "error", err)
+	}
+}
+
+// RemoteFollowHandler sends a visitor to their own server to follow user,
+// using the subscribe template from the WebFinger of their account.
+func (p *activitypub) RemoteFollowHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	handle := strings.TrimSpace(r.FormValue("account"))
+	if handle == "" {
+		p.renderProfile(w, r, http.StatusOK, user, "")
+		return
+	}
+	name, host, err := parseResource("acct:" + strings.TrimPrefix(handle, "@"))
+	if err != nil || !validDomain(host) {
+		p.renderProfile(w, r, http.StatusOK, user, fmt.Sprintf("%q is not an account like @you@example.social", handle))
+		return
+	}
+	client, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !p.RemoteFollows.Allow(client) {
+		p.renderProfile(w, r, http.StatusTooManyRequests, user, "Too many lookups; please try again in a minute.")
+		return
+	}
+	node, err := lookupWebFinger(r.Context(), host, "acct:"+name+"@"+host)
+	if err != nil {
+		log.WarnContext(r.Context(), "Error looking up remote follower", "handle", handle, "error", err)
+		p.renderProfile(w, r, http.StatusOK, user, fmt.Sprintf("Could not find %v.", handle))
+		return
+	}
+	for _, link := range node.Links {
+		if link.Rel == subscribeRel && link.Template != "" {
+			target := "acct:" + user.Name + "@" + p.Resources.Host
+			http.Redirect(w, r, strings.ReplaceAll(link.Template, "{uri}", url.QueryEscape(target)), http.StatusFound)
+			return
+		}
+	}
+	p.renderProfile(w, r, http.StatusOK, user, fmt.Sprintf("Your server doesn't support remote follows; search for %v there instead.", "@"+user.Name+"@"+p.Resources.Host))
+}
+
+// lookupWebFinger fetches the WebFinger of resource from host, which must be
+// public.
+func lookupWebFinger(ctx context.Context, host, resource string) (*WebFingerNode, error) {
+	if err := util.CheckPublicHost(ctx, host); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", "https://"+host+WebFingerUrl+"?resource="+url.QueryEscape(resource), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/jrd+json, application/json")
+	resp, err := webFingerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %v: %v", req.URL, resp.Status)
+	}
+	node := &WebFingerNode{}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, MaxFetchSize)).Decode(node); err != nil {
+		return nil, fmt.Errorf("Error decoding %v: %v", req.URL, err)
+	}
+	return node, nil
+}
+
+type rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string `xml:"title"`
+	Link        string `xml:"link"`
+	Description string `xml:"description,omitempty"`
+	Guid        string `xml:"guid"`
+	PubDate     string `xml:"pubDate"`
+}
+
+// RSSHandler serves the user's posted articles as an RSS feed. Like the
+// followers collection, it needs a signed fetch if those are required.
+func (p *activitypub) RSSHandler(user *User, w http.ResponseWriter, r *http.Request) {
+	page := p.profilePage(user, true)
+	feed := rss{Version: "2.0", Channel: rssChannel{
+		Title:       page.DisplayName + " (" + page.Handle + ")",
+		Link:        page.Actor,
+		Description: "Articles saved by " + page.Handle,
+	}}
+	for _, post := range page.Posts {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       post.Title,
+			Link:        post.Url,
+			Description: post.Excerpt,
+			Guid:        post.Url,
+			PubDate:     post.Published.Format(time.RFC1123Z),
+		})
+	}
+	body, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error rendering feed: %v", err))
+		return
+	}
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(xml.Header))
+	w.Write(body)
+}
+
+var profileTemplate = template.Must(template.New("profile").Parse(`<!DOCTYPE html>
+<html>
+  <head>
+    <meta charset="utf-8"/>
+    <meta name="viewport" content="width=device-width, initial-scale=1"/>
+    <title>{{.DisplayName}} ({{.Handle}})</title>
+    <link rel="alternate" type="application/activity+json" href="{{.Actor}}"/>
+    <link rel="alternate" type="application/rss+xml" title="{{.DisplayName}}" href="{{.Feed}}"/>
+  </head>
+  <body>
+    {{if .Header}}<img src="{{.Header}}" alt="" style="max-width:100%"/>{{end}}
+    <h1>
+      {{if .Avatar}}<img src="{{.Avatar}}" alt="" width="64" height="64"/>{{end}}
+      {{.DisplayName}}
+    </h1>
+    <p>{{.Handle}}{{if not .Limited}} &middot; {{.Followers}} followers{{end}}</p>
+    {{if .MovedTo}}<p>This account has moved to <a href="{{.MovedTo}}">{{.MovedTo}}</a>.</p>{{end}}
+    {{.Summary}}
+    {{if .Fields}}
+    <dl>
+      {{range .Fields}}<dt>{{.Name}}</dt><dd>{{.Value}}</dd>{{end}}
+    </dl>
+    {{end}}
+
+    <h2>Follow</h2>
+    {{if .Message}}<p><em>{{.Message}}</em></p>{{end}}
+    <form method="get" action="{{.FollowUrl}}">
+      <label for="account">Your account:</label>
+      <input type="text" id="account" name="account" placeholder="@you@example.social"/>
+      <button type="submit">Follow</button>
+    </form>
+
+    {{if not .Limited}}
+    <h2>Recently shared</h2>
+    {{if .Posts}}
+    <ul>
+      {{range .Posts}}
+      <li>
+        <a href="{{.Url}}" rel="nofollow noopener noreferrer">{{if .Title}}{{.Title}}{{else}}{{.Url}}{{end}}</a>
+        <small>{{.Published.Format "2006-01-02"}} &middot; {{.Likes}} likes, {{.Shares}} boosts, {{.Replies}} replies</small>
+        {{if .Excerpt}}<p>{{.Excerpt}}</p>{{end}}
+      </li>
+      {{end}}
+    </ul>
+    {{else}}
+    <p>Nothing shared yet.</p>
+    {{end}}
+    {{end}}
+
+    <p>
+      {{if not .Limited}}<a href="{{.Feed}}">RSS</a> &middot;{{end}}
+      <a href="{{.Actor}}" type="application/activity+json">ActivityPub</a> &middot;
+      <a href="{{.FollowersUrl}}" type="application/activity+json">Followers</a>
+    </p>
+  </body>
+</html>
+`))
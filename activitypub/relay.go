@@ -0,0 +1,367 @@
+package activitypub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/util"
+)
+
+// Relays are subscribed to by the instance actor. Public posts of users who
+// opt in are forwarded to them to reach the relays' other subscribers.
+//
+// Mastodon-style relays are subscribed to by following the public collection
+// at their inbox, and are sent posts as they are. LitePub relays are actors:
+// the instance actor follows the relay, the relay follows it back, and posts
+// are announced to the relay by the instance actor.
+
+// RelayAnnounceUrlTemplate serves the Announce of a post sent to LitePub
+// relays, which may fetch it.
+const RelayAnnounceUrlTemplate = InstanceActorUrl + "/announces/{account}/{post}"
+
+type RelayKind string
+
+const (
+	MastodonRelay RelayKind = "mastodon"
+	LitePubRelay  RelayKind = "litepub"
+)
+
+type RelayState string
+
+const (
+	RelayPending  RelayState = "pending"
+	RelayAccepted RelayState = "accepted"
+	RelayRejected RelayState = "rejected"
+)
+
+type Relay struct {
+	Url         string     `json:"url"` // as subscribed: an inbox (mastodon) or actor (litepub)
+	Kind        RelayKind  `json:"kind"`
+	Actor       string     `json:"actor,omitempty"`
+	Inbox       string     `json:"inbox"`
+	Follow      string     `json:"follow"` // id of the instance actor's Follow
+	State       RelayState `json:"state"`
+	FollowsBack bool       `json:"follows_back,omitempty"` // litepub relay follows the instance actor
+	Updated     time.Time  `json:"updated"`
+}
+
+type relays struct {
+	sync.Mutex
+	Relays         map[string]*Relay // by url; protected by mutex
+	StateInterface util.Persister
+}
+
+func newRelays(statefile string) *relays {
+	r := &relays{
+		Relays:         make(map[string]*Relay),
+		StateInterface: util.NewPersister(statefile),
+	}
+	if err := r.StateInterface.Read(&r.Relays); err != nil {
+		util.Fatal(log, "Could not recover relays", "error", err)
+	}
+	if r.Relays == nil {
+		r.Relays = make(map[string]*Relay)
+	}
+	log.Info("Recovered relays", "relays", len(r.Relays))
+	return r
+}
+
+func (r *relays) Persist() {
+	// Requires mutex
+	if err := r.StateInterface.Write(r.Relays); err != nil {
+		log.Error("Error persisting relays", "error", err)
+	}
+}
+
+// find returns the relay matching pred.
+func (r *relays) find(pred func(*Relay) bool) *Relay {
+	// Requires mutex
+	for _, relay := range r.Relays {
+		if pred(relay) {
+			return relay
+		}
+	}
+	return nil
+}
+
+func (p *activitypub) Relays() []Relay {
+	p.Relay.Lock()
+	defer p.Relay.Unlock()
+	var list []Relay
+	for _, relay := range p.Relay.Relays {
+		list = append(list, *relay)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Url < list[j].Url })
+	return list
+}
+
+// Subscribe follows the relay at relayUrl with the instance actor. Urls whose
+// path ends in /inbox are taken to be Mastodon-style relays, anything else a
+// LitePub relay actor.
+func (p *activitypub) Subscribe(relayUrl string) error {
+	u, err := url.Parse(strings.TrimSpace(relayUrl))
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Invalid relay url %q", relayUrl)
+	}
+	relayUrl = u.String()
+	if p.Moderation.Blocked("", relayUrl) {
+		return fmt.Errorf("Relay %v is blocked", relayUrl)
+	}
+	p.Relay.Lock()
+	_, exists := p.Relay.Relays[relayUrl]
+	p.Relay.Unlock()
+	if exists {
+		return fmt.Errorf("Already subscribed to %v", relayUrl)
+	}
+
+	relay := &Relay{
+		Url:     relayUrl,
+		Follow:  p.instanceActorUrl() + "/follows/" + uuid.NewString(),
+		State:   RelayPending,
+		Updated: time.Now(),
+	}
+	follow := Activity{
+		Context: SecurityContext(),
+		ID:      relay.Follow,
+		Type:    "Follow",
+		Actor:   IRI(p.instanceActorUrl()),
+	}
+	if strings.HasSuffix(u.Path, "/inbox") {
+		relay.Kind = MastodonRelay
+		relay.Inbox = relayUrl
+		follow.Object = Ref(ToAll)
+	} else {
+		actor, _, err := p.fetchActor(relayUrl, true)
+		if err != nil {
+			return fmt.Errorf("Error fetching relay %v: %v", relayUrl, err)
+		}
+		relay.Kind = LitePubRelay
+		relay.Actor = actor.ID
+		relay.Inbox = actor.Inbox
+		follow.Object = Ref(actor.ID)
+		follow.To = IRIs{actor.ID}
+	}
+	if err := p.sendInstance(context.Background(), relay.Inbox, follow); err != nil {
+		return fmt.Errorf("Error subscribing to %v: %v", relayUrl, err)
+	}
+	p.Relay.Lock()
+	p.Relay.Relays[relayUrl] = relay
+	p.Relay.Persist()
+	p.Relay.Unlock()
+	log.Info("Subscribed to relay", "kind", relay.Kind, "relay", relayUrl)
+	return nil
+}
+
+// Unsubscribe undoes the instance actor's follow of a relay and forgets it.
+func (p *activitypub) Unsubscribe(relayUrl string) error {
+	p.Relay.Lock()
+	relay, ok := p.Relay.Relays[relayUrl]
+	if ok {
+		delete(p.Relay.Relays, relayUrl)
+		p.Relay.Persist()
+	}
+	p.Relay.Unlock()
+	if !ok {
+		return fmt.Errorf("Not subscribed to %v", relayUrl)
+	}
+	follow := Activity{ID: relay.Follow, Type: "Follow", Actor: IRI(p.instanceActorUrl()), Object: Ref(ToAll)}
+	if relay.Kind == LitePubRelay {
+		follow.Object = Ref(relay.Actor)
+	}
+	undo := Activity{
+		Context: SecurityContext(),
+		ID:      relay.Follow + "/undo",
+		Type:    "Undo",
+		Actor:   IRI(p.instanceActorUrl()),
+		Object:  Embed(follow.withoutContext()),
+	}
+	if err := p.sendInstance(context.Background(), relay.Inbox, undo); err != nil {
+		log.Warn("Error unsubscribing from relay", "relay", relayUrl, "error", err)
+	}
+	log.Info("Unsubscribed from relay", "relay", relayUrl)
+	return nil
+}
+
+// sendInstance POSTs an activity to inbox as the instance actor.
+func (p *activitypub) sendInstance(ctx context.Context, inbox string, activity interface{}) error {
+	body, err := json.Marshal(activity)
+	if err != nil {
+		return fmt.Errorf("Error marshaling %v: %v", activity, err)
+	}
+	_, err = sendAs(ctx, p.InstanceKey, p.instanceKeyId(), inbox, body)
+	return err
+}
+
+// relayActivityHandler handles the relay handshake in the instance inbox,
+// reporting whether the activity was part of it.
+func (p *activitypub) relayActivityHandler(activity *Activity, w http.ResponseWriter, r *http.Request) bool {
+	actor := activity.Actor.String()
+	switch strings.ToLower(activity.Type) {
+	case "accept", "reject":
+		state := RelayAccepted
+		if strings.ToLower(activity.Type) == "reject" {
+			state = RelayRejected
+		}
+		p.Relay.Lock()
+		// Some relays answer without the id of the follow.
+		relay := p.Relay.find(func(relay *Relay) bool { return relay.Follow == activity.Object.ID() })
+		if relay == nil {
+			relay = p.Relay.find(func(relay *Relay) bool {
+				return relay.State == RelayPending && moderation.InDomain(actor, moderation.Domain(relay.Inbox))
+			})
+		}
+		if relay != nil {
+			relay.State = state
+			relay.Updated = time.Now()
+			if relay.Actor == "" {
+				relay.Actor = actor
+			}
+			p.Relay.Persist()
+		}
+		p.Relay.Unlock()
+		if relay == nil {
+			return false
+		}
+		log.InfoContext(r.Context(), "Relay state changed", "relay", relay.Url, "state", state)
+		util.JsonResponse(w, http.StatusOK, "")
+		return true
+	case "follow":
+		if activity.Object.ID() != p.instanceActorUrl() {
+			return false
+		}
+		p.Relay.Lock()
+		relay := p.Relay.find(func(relay *Relay) bool { return relay.Actor == actor })
+		if relay != nil {
+			relay.FollowsBack = true
+			relay.Updated = time.Now()
+			p.Relay.Persist()
+		}
+		p.Relay.Unlock()
+		answer := "Accept"
+		if relay == nil {
+			// The instance actor only follows back relays it subscribed to.
+			answer = "Reject"
+		}
+		response := Activity{
+			Context: SecurityContext(),
+			ID:      p.instanceActorUrl() + "/follows/" + uuid.NewString(),
+			Type:    answer,
+			Actor:   IRI(p.instanceActorUrl()),
+			Object:  Embed(activity.withoutContext()),
+		}
+		go func() {
+			if err := p.sendInstance(context.Background(), p.inboxFor(actor), response); err != nil {
+				log.ErrorContext(r.Context(), "Error answering follow of instance actor", "actor", actor, "error", err)
+			}
+		}()
+		log.InfoContext(r.Context(), "Answered follow of instance actor", "answer", answer, "actor", actor)
+		util.JsonResponse(w, http.StatusAccepted, "")
+		return true
+	case "undo":
+		// Only the relay's own follow of the instance actor is undone here.
+		follow := &Activity{}
+		if !strings.EqualFold(activity.Object.Type(), "Follow") || activity.Object.Decode(follow) != nil ||
+			follow.Actor.String() != actor || follow.Object.ID() != p.instanceActorUrl() {
+			return false
+		}
+		p.Relay.Lock()
+		relay := p.Relay.find(func(relay *Relay) bool { return relay.Actor == actor })
+		if relay != nil {
+			relay.FollowsBack = false
+			relay.Updated = time.Now()
+			p.Relay.Persist()
+		}
+		p.Relay.Unlock()
+		if relay == nil {
+			return false
+		}
+		util.JsonResponse(w, http.StatusOK, "")
+		return true
+	}
+	return false
+}
+
+// relaysFor returns the relays that public posts of u are forwarded to: those
+// that accepted the instance actor, if u opted in.
+func (p *activitypub) relaysFor(u *User) []Relay {
+	u.Lock()
+	optedIn := u.Settings.Relay
+	u.Unlock()
+	if !optedIn {
+		return nil
+	}
+	var accepted []Relay
+	for _, relay := range p.Relays() {
+		if relay.State == RelayAccepted {
+			accepted = append(accepted, relay)
+		}
+	}
+	return accepted
+}
+
+// relayAnnounce is the Announce by the instance actor of post rec of the user
+// name.
+func (p *activitypub) relayAnnounce(name string, rec *PostRecord) Activity {
+	return Activity{
+		Context: SecurityContext(),
+		ID:      p.instanceActorUrl() + "/announces/" + name + "/" + rec.ID,
+		Type:    "Announce",
+		Actor:   IRI(p.instanceActorUrl()),
+		Object:  Ref(p.postUrl(name, rec.ID)),
+		To:      IRIs{ToAll},
+	}
+}
+
+// RelayAnnounceHandler serves the Announce of a post forwarded to relays.
+func (p *activitypub) RelayAnnounceHandler(w http.ResponseWriter, r *http.Request) {
+	user, rec := p.postForRequest(w, r)
+	if rec == nil {
+		return
+	}
+	if len(p.relaysFor(user)) == 0 {
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Post %v was not forwarded to relays", rec.ID))
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, p.relayAnnounce(user.Name, rec))
+}
+
+// forwardToRelays queues a public Create of post rec of u for every relay in
+// relaysFor.
+func (p *activitypub) forwardToRelays(ctx context.Context, u *User, rec *PostRecord, create Activity) {
+	if !create.To.Contains(ToAll) {
+		return
+	}
+	relays := p.relaysFor(u)
+	if len(relays) == 0 {
+		return
+	}
+	body, err := json.Marshal(create)
+	if err != nil {
+		log.Error("Error encoding activity for relays", "id", create.ID, "error", err)
+		return
+	}
+	announce, err := json.Marshal(p.relayAnnounce(u.Name, rec))
+	if err != nil {
+		log.Error("Error encoding announce for relays", "id", create.ID, "error", err)
+		return
+	}
+	var dls []*Delivery
+	for _, relay := range relays {
+		switch relay.Kind {
+		case MastodonRelay:
+			dls = append(dls, &Delivery{User: u.Name, Actor: relay.Url, Inbox: relay.Inbox, Body: string(body)})
+		case LitePubRelay:
+			dls = append(dls, &Delivery{User: u.Name, Actor: relay.Actor, Inbox: relay.Inbox, Instance: true, Body: string(announce)})
+		}
+	}
+	p.enqueue(ctx, dls)
+}
@@ -1,23 +1,32 @@
 package activitypub
 
 import (
+	"crypto/rsa"
 	"net/http"
 	"regexp"
 
 	sig "github.com/go-fed/httpsig"
-	"github.com/golang/glog"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func (p *activitypub) sign(u *User, r *http.Request, body []byte) {
+// signWith signs r with key. Requests without a body, i.e. GETs, are signed
+// without a digest.
+func signWith(key *rsa.PrivateKey, keyId string, r *http.Request, body []byte) {
+	_, span := tracer.Start(r.Context(), "sign", trace.WithAttributes(attribute.String("key.id", keyId)))
+	defer span.End()
 	prefs := []sig.Algorithm{sig.RSA_SHA256}
 	headers := []string{sig.RequestTarget, "host", "date", "digest"}
+	if body == nil {
+		headers = headers[:3]
+	}
 	signer, _, err := sig.NewSigner(prefs, sig.DigestSha256, headers, sig.Signature, 60)
 	if err != nil {
-		glog.Errorf("Error creating signer: %v", err)
+		log.Error("Error creating signer", "error", err)
 		return
 	}
-	if err := signer.SignRequest(u.PrivateKey, p.userBaseUrl(u.Name)+"#main-key", r, body); err != nil {
-		glog.Errorf("Error appending signature: %v", err)
+	if err := signer.SignRequest(key, keyId, r, body); err != nil {
+		log.Error("Error signing request", "key_id", keyId, "error", err)
 	}
 	sigStr := r.Header.Get("Signature")
 	re := regexp.MustCompile("algorithm=\"hs2019\"")
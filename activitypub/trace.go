@@ -0,0 +1,45 @@
+package activitypub
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// A post is traced from the article being chosen to its delivery to every
+// follower. Deliveries run later, from the queue, so each carries the trace
+// context of the activity it sends.
+
+var (
+	tracer     = otel.Tracer("github.com/ml8/ap-bot/activitypub")
+	propagator = propagation.TraceContext{}
+)
+
+const traceParentKey = "traceparent"
+
+// traceParent is the W3C trace context of ctx, or "" if it is not traced.
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier[traceParentKey]
+}
+
+// tracedContext is a context continuing the trace in parent.
+func tracedContext(parent string) context.Context {
+	if parent == "" {
+		return context.Background()
+	}
+	return propagator.Extract(context.Background(), propagation.MapCarrier{traceParentKey: parent})
+}
+
+// endSpan ends span, marking it failed if err is set.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
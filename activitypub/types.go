@@ -1,14 +1,16 @@
 package activitypub
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/rsa"
-	"crypto/x509"
-	"encoding/pem"
+	"encoding/json"
 	"fmt"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/ml8/ap-bot/pocket"
+	"github.com/ml8/ap-bot/util"
 	"golang.org/x/exp/slices"
 )
 
@@ -32,36 +34,247 @@ type WebFingerNode struct {
 }
 
 type Actor struct {
-	ID            string    `json:"id,omitempty"`
-	Type          string    `json:"type,omitempty"`
-	Inbox         string    `json:"inbox,omitempty"`
-	Outbox        string    `json:"outbox,omitempty"`
-	Approves      bool      `json:"manuallyApprovesFollwers,omitempty"`
-	PreferredName string    `json:"preferredUsername,omitempty"`
-	Summary       string    `json:"summary,omitempty"`
-	Discoverable  bool      `json:"discoverable,omitempty"`
-	Name          string    `json:"name,omitempty"`
-	Followers     string    `json:"followers,omitempty"`
-	PublicKey     PublicKey `json:"publicKey,omitempty"`
+	Context
+	ID            string     `json:"id,omitempty"`
+	Type          string     `json:"type,omitempty"`
+	Inbox         string     `json:"inbox,omitempty"`
+	Outbox        string     `json:"outbox,omitempty"`
+	Following     string     `json:"following,omitempty"`
+	Followers     string     `json:"followers,omitempty"`
+	Approves      bool       `json:"manuallyApprovesFollowers,omitempty"`
+	PreferredName string     `json:"preferredUsername,omitempty"`
+	Name          string     `json:"name,omitempty"`
+	Summary       string     `json:"summary,omitempty"`
+	Url           IRI        `json:"url,omitempty"`
+	Discoverable  bool       `json:"discoverable,omitempty"`
+	Published     string     `json:"published,omitempty"`
+	PublicKey     PublicKey  `json:"publicKey,omitempty"`
+	Assertion     []Multikey `json:"assertionMethod,omitempty"`
+	Endpoints     *Endpoints `json:"endpoints,omitempty"`
+	Icon          *Image     `json:"icon,omitempty"`
+	Image         *Image     `json:"image,omitempty"`
+	Attachment    ObjectRefs `json:"attachment,omitempty"`
+	AlsoKnownAs   IRIs       `json:"alsoKnownAs,omitempty"`
+	MovedTo       IRI        `json:"movedTo,omitempty"`
+	Extra         Extra      `json:"-"`
+}
+
+type Endpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
 }
 
 type Activity struct {
-	ID           string      `json:"id,omitempty"`
-	Actor        string      `json:"actor,omitempty"`
-	Type         string      `json:"type,omitempty"`
-	Object       interface{} `json:"object,omitempty"`
-	To           []string    `json:"to,omitempty"`
-	Cc           []string    `json:"cc,omitempty"`
-	Content      string      `json:"content,omitempty"`
-	Published    string      `json:"published,omitempty"`
-	AttributedTo string      `json:"attributedTo,omitempty"`
+	Context
+	ID        string    `json:"id,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	Actor     IRI       `json:"actor,omitempty"`
+	Object    ObjectRef `json:"object,omitzero"`
+	Target    ObjectRef `json:"target,omitzero"`
+	To        IRIs      `json:"to,omitempty"`
+	Cc        IRIs      `json:"cc,omitempty"`
+	Published string    `json:"published,omitempty"`
+	Extra     Extra     `json:"-"`
+}
+
+type Note struct {
+	Context
+	ID           string     `json:"id,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	AttributedTo IRI        `json:"attributedTo,omitempty"`
+	InReplyTo    IRI        `json:"inReplyTo,omitempty"`
+	Summary      string     `json:"summary,omitempty"`
+	Content      string     `json:"content,omitempty"`
+	Url          IRI        `json:"url,omitempty"`
+	To           IRIs       `json:"to,omitempty"`
+	Cc           IRIs       `json:"cc,omitempty"`
+	Published    string     `json:"published,omitempty"`
+	Sensitive    bool       `json:"sensitive,omitempty"`
+	Tag          ObjectRefs `json:"tag,omitempty"`
+	Attachment   ObjectRefs `json:"attachment,omitempty"`
+	Replies      ObjectRef  `json:"replies,omitzero"`
+	Likes        ObjectRef  `json:"likes,omitzero"`
+	Shares       ObjectRef  `json:"shares,omitzero"`
+	Extra        Extra      `json:"-"`
+}
+
+// Tombstone stands in for a deleted object.
+type Tombstone struct {
+	Context
+	ID         string `json:"id,omitempty"`
+	Type       string `json:"type,omitempty"`
+	FormerType string `json:"formerType,omitempty"`
+	Deleted    string `json:"deleted,omitempty"`
+	Extra      Extra  `json:"-"`
+}
+
+type collection struct {
+	Context
+	ID           string     `json:"id,omitempty"`
+	Type         string     `json:"type,omitempty"`
+	TotalItems   int        `json:"totalItems"`
+	First        ObjectRef  `json:"first,omitzero"`
+	Last         ObjectRef  `json:"last,omitzero"`
+	Items        ObjectRefs `json:"items,omitempty"`
+	OrderedItems ObjectRefs `json:"orderedItems,omitempty"`
 }
 
 type Collection struct {
-	ID         string        `json:"id,omitempty"`
-	Type       string        `json:"type,omitempty"`
-	TotalItems int           `json:"totalItems,omitempty"`
-	Items      []interface{} `json:"items,omitempty"`
+	collection
+	Extra Extra `json:"-"`
+}
+
+type CollectionPage struct {
+	collection
+	PartOf IRI       `json:"partOf,omitempty"`
+	Next   ObjectRef `json:"next,omitzero"`
+	Prev   ObjectRef `json:"prev,omitzero"`
+	Extra  Extra     `json:"-"`
+}
+
+type Hashtag struct {
+	Type  string `json:"type,omitempty"`
+	Href  IRI    `json:"href,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Extra Extra  `json:"-"`
+}
+
+type Mention struct {
+	Type  string `json:"type,omitempty"`
+	Href  IRI    `json:"href,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Extra Extra  `json:"-"`
+}
+
+type Image struct {
+	Type      string `json:"type,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+	Url       IRI    `json:"url,omitempty"`
+	Name      string `json:"name,omitempty"`
+	Extra     Extra  `json:"-"`
+}
+
+// Profile metadata field, as rendered by mastodon.
+type PropertyValue struct {
+	Type  string `json:"type,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// withoutContext returns a copy of a for embedding in another activity.
+func (a *Activity) withoutContext() Activity {
+	c := *a
+	c.Context = Context{}
+	return c
+}
+
+// Round-tripping of unmodeled properties.
+
+func (a *Actor) UnmarshalJSON(data []byte) error {
+	type plain Actor
+	return unmarshalWithExtra(data, (*plain)(a), &a.Extra)
+}
+
+func (a Actor) MarshalJSON() ([]byte, error) {
+	type plain Actor
+	return marshalWithExtra((*plain)(&a), a.Extra)
+}
+
+func (a *Activity) UnmarshalJSON(data []byte) error {
+	type plain Activity
+	return unmarshalWithExtra(data, (*plain)(a), &a.Extra)
+}
+
+func (a Activity) MarshalJSON() ([]byte, error) {
+	type plain Activity
+	return marshalWithExtra((*plain)(&a), a.Extra)
+}
+
+func (n *Note) UnmarshalJSON(data []byte) error {
+	type plain Note
+	return unmarshalWithExtra(data, (*plain)(n), &n.Extra)
+}
+
+func (n Note) MarshalJSON() ([]byte, error) {
+	type plain Note
+	return marshalWithExtra((*plain)(&n), n.Extra)
+}
+
+func (t *Tombstone) UnmarshalJSON(data []byte) error {
+	type plain Tombstone
+	return unmarshalWithExtra(data, (*plain)(t), &t.Extra)
+}
+
+func (t Tombstone) MarshalJSON() ([]byte, error) {
+	type plain Tombstone
+	return marshalWithExtra((*plain)(&t), t.Extra)
+}
+
+func (c *Collection) UnmarshalJSON(data []byte) error {
+	type plain Collection
+	return unmarshalWithExtra(data, (*plain)(c), &c.Extra)
+}
+
+func (c Collection) MarshalJSON() ([]byte, error) {
+	type plain Collection
+	return marshalWithExtra((*plain)(&c), c.Extra)
+}
+
+func (c *CollectionPage) UnmarshalJSON(data []byte) error {
+	type plain CollectionPage
+	return unmarshalWithExtra(data, (*plain)(c), &c.Extra)
+}
+
+func (c CollectionPage) MarshalJSON() ([]byte, error) {
+	type plain CollectionPage
+	return marshalWithExtra((*plain)(&c), c.Extra)
+}
+
+func (h *Hashtag) UnmarshalJSON(data []byte) error {
+	type plain Hashtag
+	return unmarshalWithExtra(data, (*plain)(h), &h.Extra)
+}
+
+func (h Hashtag) MarshalJSON() ([]byte, error) {
+	type plain Hashtag
+	return marshalWithExtra((*plain)(&h), h.Extra)
+}
+
+func (m *Mention) UnmarshalJSON(data []byte) error {
+	type plain Mention
+	return unmarshalWithExtra(data, (*plain)(m), &m.Extra)
+}
+
+func (m Mention) MarshalJSON() ([]byte, error) {
+	type plain Mention
+	return marshalWithExtra((*plain)(&m), m.Extra)
+}
+
+// Images are also given as a bare url or as an array of candidates, of which
+// the first is used.
+func (i *Image) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		*i = Image{Type: "Image"}
+		return json.Unmarshal(data, &i.Url)
+	}
+	if len(data) > 0 && data[0] == '[' {
+		var list []Image
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*i = Image{}
+		if len(list) > 0 {
+			*i = list[0]
+		}
+		return nil
+	}
+	type plain Image
+	return unmarshalWithExtra(data, (*plain)(i), &i.Extra)
+}
+
+func (i Image) MarshalJSON() ([]byte, error) {
+	type plain Image
+	return marshalWithExtra((*plain)(&i), i.Extra)
 }
 
 // Internal types
@@ -72,19 +285,175 @@ type PublicKey struct {
 	Key   string `json:"publicKeyPem"`
 }
 
+// Settings are the owner-editable posting preferences of a user.
+type Settings struct {
+	Paused   bool   `json:"paused,omitempty"`
+	Locked   bool   `json:"locked,omitempty"`   // follows require the owner's approval
+	Interval string `json:"interval,omitempty"` // minimum time between posts; defaults to the global interval
+	Relay    bool   `json:"relay,omitempty"`    // forward posts to the instance's relays
+}
+
+// Profile is the owner-editable presentation of a user's actor.
+type Profile struct {
+	DisplayName string  `json:"displayname,omitempty"`
+	Summary     string  `json:"summary,omitempty"` // plain text
+	Avatar      string  `json:"avatar,omitempty"`  // media file
+	Header      string  `json:"header,omitempty"`  // media file
+	Fields      []Field `json:"fields,omitempty"`
+}
+
+type Field struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+const MaxProfileFields = 4
+
+const MaxPostHistory = 200
+
+const (
+	// Only the most recent interactions of each kind are kept for a post.
+	MaxInteractions = 500
+	// Replies are kept to show on the account page, shortened to this many
+	// characters.
+	MaxReplyContent = 1000
+)
+
+// PostRecord is a posted article and the interactions it received.
+type PostRecord struct {
+	ID        string        `json:"id"`
+	Title     string        `json:"title,omitempty"`
+	Url       string        `json:"url,omitempty"`
+	Excerpt   string        `json:"excerpt,omitempty"`
+	Published time.Time     `json:"published"`
+	Likes     []Interaction `json:"likes,omitempty"`
+	Shares    []Interaction `json:"shares,omitempty"`
+	Replies   []Interaction `json:"replies,omitempty"`
+}
+
+// Interaction is a Like, Announce or reply received for a post.
+type Interaction struct {
+	ID       string    `json:"id"` // the Like or Announce, or the reply Note
+	Actor    string    `json:"actor"`
+	Content  string    `json:"content,omitempty"` // replies only
+	Received time.Time `json:"received"`
+}
+
+// Migration links a user's actor to its other identities.
+type Migration struct {
+	AlsoKnownAs []string `json:"alsoknownas,omitempty"` // accounts allowed to move here
+	MovedTo     string   `json:"movedto,omitempty"`     // account this one moved to
+}
+
+type PendingFollow struct {
+	Actor    string    `json:"actor"`
+	Follow   Activity  `json:"follow"`
+	Received time.Time `json:"received"`
+}
+
 type User struct {
 	sync.Mutex
-	Name       string          `json:"name,omitempty"`
-	Followers  []string        `json:"followers,omitempty"` // followers: should be user@service.social
-	PrivateKey *rsa.PrivateKey `json:"privatekey,omitempty"`
+	Name        string             `json:"name,omitempty"`
+	Followers   []string           `json:"followers,omitempty"` // followers: should be user@service.social
+	PrivateKey  *rsa.PrivateKey    `json:"privatekey,omitempty"`
+	KeyId       string             `json:"keyid,omitempty"` // fragment identifying PrivateKey; MainKeyId when empty
+	RetiredKeys []RetiredKey       `json:"retiredkeys,omitempty"`
+	Ed25519Key  ed25519.PrivateKey `json:"ed25519key,omitempty"`
+	Settings    Settings           `json:"settings,omitempty"`
+	Profile     Profile            `json:"profile,omitempty"`
+	Pending     []PendingFollow    `json:"pending,omitempty"` // follow requests awaiting approval
+	Follows     map[string]string  `json:"follows,omitempty"` // follower -> id of their accepted Follow
+	Migration   Migration          `json:"migration,omitempty"`
+	Posts       []*PostRecord      `json:"posts,omitempty"`  // most recent last
+	Posted      int                `json:"posted,omitempty"` // posts ever made, including those no longer in Posts
+	LastPost    time.Time          `json:"lastpost,omitempty"`
+	Suspended   bool               `json:"suspended,omitempty"` // by the operator
+}
+
+// Private keys are stored as PKCS#8 PEM in a util.Secret, so that they are
+// sealed when a master key is configured. Keys stored as PKCS#1 PEM or in the
+// default JSON encoding of rsa.PrivateKey, before that, are still read.
+func (u *User) MarshalJSON() ([]byte, error) {
+	type plain User
+	key, err := encodePrivateKey(u.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	var edKey util.Secret
+	if u.Ed25519Key != nil {
+		if edKey, err = encodePrivateKey(u.Ed25519Key); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(&struct {
+		*plain
+		PrivateKey util.Secret `json:"privatekey,omitempty"`
+		Ed25519Key util.Secret `json:"ed25519key,omitempty"`
+	}{(*plain)(u), key, edKey})
+}
+
+func (u *User) UnmarshalJSON(data []byte) error {
+	type plain User
+	aux := &struct {
+		*plain
+		PrivateKey json.RawMessage `json:"privatekey,omitempty"`
+		Ed25519Key json.RawMessage `json:"ed25519key,omitempty"`
+	}{plain: (*plain)(u)}
+	if err := json.Unmarshal(data, aux); err != nil {
+		return err
+	}
+	key, err := decodePrivateKey(aux.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("Error reading key of %v: %v", u.Name, err)
+	}
+	u.PrivateKey = key
+	if u.Ed25519Key, err = decodeEd25519Key(aux.Ed25519Key); err != nil {
+		return fmt.Errorf("Error reading Ed25519 key of %v: %v", u.Name, err)
+	}
+	return nil
+}
+
+// duePost reports whether a periodic post should be made for u, given the
+// global posting interval.
+func (u *User) duePost(global time.Duration) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.Settings.Paused || u.Suspended {
+		return false
+	}
+	interval, err := time.ParseDuration(u.Settings.Interval)
+	if err != nil || interval <= global {
+		return true
+	}
+	return time.Since(u.LastPost) >= interval
+}
+
+// recordFollow remembers which Follow activity made follower a follower.
+func (u *User) recordFollow(follower, id string) {
+	u.Lock()
+	defer u.Unlock()
+	if u.Follows == nil {
+		u.Follows = make(map[string]string)
+	}
+	u.Follows[follower] = id
+}
+
+// followId returns the id of the Follow recorded for follower, if any.
+func (u *User) followId(follower string) string {
+	u.Lock()
+	defer u.Unlock()
+	return u.Follows[follower]
 }
 
-func (u *User) encodePublicKey() (s string) {
-	blk := &pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(&u.PrivateKey.PublicKey),
+// followMatches reports whether id names the Follow recorded for follower.
+// Followers from before follows were recorded match any id.
+func (u *User) followMatches(follower, id string) bool {
+	u.Lock()
+	defer u.Unlock()
+	if recorded, ok := u.Follows[follower]; ok {
+		return recorded == id
 	}
-	return string(pem.EncodeToMemory(blk))
+	return slices.Contains(u.Followers, follower)
 }
 
 func (u *User) addFollower(follower string) {
@@ -92,22 +461,49 @@ func (u *User) addFollower(follower string) {
 	defer u.Unlock()
 	if idx := slices.Index(u.Followers, follower); idx < 0 {
 		u.Followers = append(u.Followers, follower)
-		glog.Infof("Added follower of %v: %v", u.Name, follower)
+		log.Info("Added follower", "user", u.Name, "follower", follower)
 	} else {
-		glog.Warningf("Follower of %v already exists: %v", u.Name, follower)
+		log.Warn("Follower already exists", "user", u.Name, "follower", follower)
 	}
 }
 
 func (u *User) delFollower(follower string) {
 	u.Lock()
 	defer u.Unlock()
+	delete(u.Follows, follower)
 	if idx := slices.Index(u.Followers, follower); idx >= 0 {
 		u.Followers = slices.Delete(u.Followers, idx, idx+1)
-		glog.Infof("Removed follower of %v: %v", u.Name, follower)
-		glog.Infof("Followers: %v", u.Followers)
+		log.Info("Removed follower", "user", u.Name, "follower", follower, "followers", len(u.Followers))
 	} else {
-		glog.Warningf("Unknown follower of %v: %v", u.Name, follower)
+		log.Warn("Unknown follower", "user", u.Name, "follower", follower)
+	}
+}
+
+func (u *User) addPending(follow *Activity) {
+	u.Lock()
+	defer u.Unlock()
+	actor := follow.Actor.String()
+	for i, pending := range u.Pending {
+		if pending.Actor == actor {
+			u.Pending[i].Follow = follow.withoutContext()
+			return
+		}
 	}
+	u.Pending = append(u.Pending, PendingFollow{Actor: actor, Follow: follow.withoutContext(), Received: time.Now()})
+	log.Info("Pending follower", "user", u.Name, "actor", actor)
+}
+
+// delPending removes and returns the pending follow request from actor.
+func (u *User) delPending(actor string) (follow *Activity) {
+	u.Lock()
+	defer u.Unlock()
+	for i, pending := range u.Pending {
+		if pending.Actor == actor {
+			u.Pending = slices.Delete(u.Pending, i, i+1)
+			return &pending.Follow
+		}
+	}
+	return nil
 }
 
 func (u *User) forEachFollower(f func(f string) error) error {
@@ -118,7 +514,7 @@ func (u *User) forEachFollower(f func(f string) error) error {
 	for _, follower := range followers {
 		t := f(follower)
 		if t != nil {
-			glog.Errorf("Error for follower %v: %v", follower, t)
+			log.Error("Error for follower", "follower", follower, "error", t)
 			err = t
 		}
 	}
@@ -130,37 +526,36 @@ func NewCollection(id string, ordered bool) *Collection {
 	if ordered {
 		typ = "OrderedCollection"
 	}
-	return &Collection{
+	return &Collection{collection: collection{
 		ID:         id,
 		Type:       typ,
 		TotalItems: 0,
-	}
+	}}
 }
 
+// AddItem adds an IRI (given as a string) or an embedded object.
 func (c *Collection) AddItem(item interface{}) {
+	ref, ok := item.(ObjectRef)
+	if !ok {
+		if iri, isIRI := item.(string); isIRI {
+			ref = Ref(iri)
+		} else {
+			ref = Embed(item)
+		}
+	}
 	c.TotalItems += 1
-	c.Items = append(c.Items, item)
+	if c.Type == "OrderedCollection" {
+		c.OrderedItems = append(c.OrderedItems, ref)
+	} else {
+		c.Items = append(c.Items, ref)
+	}
 }
 
+// Context is a JSON-LD @context: an IRI, a map of terms, or an array of both.
 type Context struct {
 	Context interface{} `json:"@context,omitempty"`
 }
 
-type ActorContext struct {
-	Context
-	Actor
-}
-
-type ActivityContext struct {
-	Context
-	Activity
-}
-
-type CollectionContext struct {
-	Context
-	Collection
-}
-
 type Post struct {
 	*pocket.Article
 }
@@ -173,6 +568,23 @@ func DefaultContext() Context {
 	return Context{Context: []string{"https://www.w3.org/ns/activitystreams"}}
 }
 
+// ProfileContext additionally maps the schema.org terms used by profile fields,
+// the terms used for account migration and Multikey for assertionMethod.
+func ProfileContext() Context {
+	return Context{Context: []interface{}{
+		"https://www.w3.org/ns/activitystreams",
+		"https://w3id.org/security/v1",
+		"https://w3id.org/security/multikey/v1",
+		map[string]interface{}{
+			"schema":        "http://schema.org#",
+			"PropertyValue": "schema:PropertyValue",
+			"value":         "schema:value",
+			"alsoKnownAs":   map[string]string{"@id": "as:alsoKnownAs", "@type": "@id"},
+			"movedTo":       map[string]string{"@id": "as:movedTo", "@type": "@id"},
+		},
+	}}
+}
+
 func SecurityContext() Context {
 	return Context{Context: []string{"https://www.w3.org/ns/activitystreams", "https://w3id.org/security/v1"}}
 }
@@ -1,28 +1,75 @@
 package activitypub
 
-import "strings"
+import (
+	"fmt"
+	"html"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
 
-func parseResourceString(s string) (name string, resType string, url string) {
-	var delim string
-	if strings.Contains(s, "://") {
-		delim = "://"
-	} else if strings.Contains(s, ":") {
-		delim = ":"
-	} else {
-		return
+// domainName matches bare DNS names of at least two labels, whose last is
+// not numeric, so not IP addresses.
+var domainName = regexp.MustCompile(`^(?i)([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+// validDomain is whether host is a DNS name, without port, path or userinfo.
+func validDomain(host string) bool {
+	return len(host) <= 253 && domainName.MatchString(host)
+}
+
+// parseResource splits a WebFinger resource, either acct:user@host or an
+// http(s) url, into the user (empty for urls) and host.
+func parseResource(s string) (name, host string, err error) {
+	scheme, rest, ok := strings.Cut(s, ":")
+	if !ok {
+		return "", "", fmt.Errorf("Resource %q has no scheme", s)
 	}
-	splt := strings.Split(s, delim)
-	if len(splt) != 2 {
-		return
+	switch strings.ToLower(scheme) {
+	case "acct":
+		rest = strings.TrimPrefix(rest, "@")
+		name, host, ok = strings.Cut(rest, "@")
+		if !ok || name == "" || host == "" || strings.Contains(host, "@") {
+			return "", "", fmt.Errorf("Invalid account %q", s)
+		}
+	case "http", "https":
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return "", "", fmt.Errorf("Invalid url %q", s)
+		}
+		host = u.Host
+	default:
+		return "", "", fmt.Errorf("Unsupported resource type %v", scheme)
 	}
-	resType = splt[0]
-	name = splt[1]
-	name, _ = strings.CutPrefix(name, "@")
-	splt = strings.Split(name, "@")
-	if len(splt) != 2 {
-		return
+	// Ports are not part of an account's domain.
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return name, host, nil
+}
+
+// renderText converts owner-supplied plain text to the HTML used in actor
+// documents.
+func renderText(s string) string {
+	var paras []string
+	for _, para := range strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n\n") {
+		lines := strings.Split(strings.TrimSpace(para), "\n")
+		for i := range lines {
+			lines[i] = html.EscapeString(lines[i])
+		}
+		if len(lines) > 0 && lines[0] != "" {
+			paras = append(paras, "<p>"+strings.Join(lines, "<br>")+"</p>")
+		}
+	}
+	return strings.Join(paras, "")
+}
+
+// renderValue renders a profile field value, linking it if it is a URL.
+func renderValue(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return html.EscapeString(s)
 	}
-	name = splt[0]
-	url = splt[1]
-	return
+	return fmt.Sprintf("<a href=\"%v\" rel=\"me nofollow noopener noreferrer\" target=\"_blank\">%v</a>",
+		html.EscapeString(u.String()), html.EscapeString(strings.TrimPrefix(u.String(), u.Scheme+"://")))
 }
@@ -0,0 +1,317 @@
+package activitypub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// JSON-LD tolerant building blocks for the ActivityStreams vocabulary.
+//
+// Implementations disagree on the shape of most properties: a property may be
+// a single value or an array, and an object may be embedded or referenced by
+// IRI. The types here accept any of those forms, and vocabulary types keep
+// properties they don't model in Extra so that they survive a round trip.
+
+var ErrNotEmbedded = errors.New("Object is not embedded")
+
+// IRI is a reference to an object. An embedded object is reduced to its id
+// (or href, for links).
+type IRI string
+
+func (i IRI) String() string {
+	return string(i)
+}
+
+func (i *IRI) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	switch {
+	case bytes.Equal(data, []byte("null")):
+		*i = ""
+	case len(data) > 0 && data[0] == '"':
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*i = IRI(s)
+	case len(data) > 0 && data[0] == '[':
+		var list IRIs
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		*i = ""
+		if len(list) > 0 {
+			*i = IRI(list[0])
+		}
+	default:
+		*i = IRI(idOf(data))
+	}
+	return nil
+}
+
+// IRIs is a property holding one or more references, such as an audience.
+type IRIs []string
+
+func (l *IRIs) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) == 0 || data[0] != '[' {
+		var i IRI
+		if err := i.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		*l = nil
+		if i != "" {
+			*l = IRIs{string(i)}
+		}
+		return nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*l = nil
+	for _, r := range raw {
+		var i IRI
+		if err := i.UnmarshalJSON(r); err != nil {
+			return err
+		}
+		if i != "" {
+			*l = append(*l, string(i))
+		}
+	}
+	return nil
+}
+
+func (l IRIs) Contains(iri string) bool {
+	for _, i := range l {
+		if i == iri {
+			return true
+		}
+	}
+	return false
+}
+
+// ObjectRef is a property holding either an IRI or an embedded object.
+type ObjectRef struct {
+	IRI   string
+	Value interface{}     // embedded object to send
+	raw   json.RawMessage // embedded object as received
+}
+
+// Ref refers to an object by IRI.
+func Ref(iri string) ObjectRef {
+	return ObjectRef{IRI: iri}
+}
+
+// Embed embeds v, which should have an id.
+func Embed(v interface{}) ObjectRef {
+	return ObjectRef{Value: v}
+}
+
+func (o ObjectRef) IsZero() bool {
+	return o.IRI == "" && o.Value == nil && o.raw == nil
+}
+
+// Embedded reports whether the object itself, not just its IRI, is present.
+func (o ObjectRef) Embedded() bool {
+	return o.Value != nil || o.raw != nil
+}
+
+func (o ObjectRef) bytes() json.RawMessage {
+	if o.raw != nil {
+		return o.raw
+	}
+	if o.Value != nil {
+		b, _ := json.Marshal(o.Value)
+		return b
+	}
+	return nil
+}
+
+// ID returns the IRI of the object, embedded or not.
+func (o ObjectRef) ID() string {
+	if o.IRI != "" {
+		return o.IRI
+	}
+	return idOf(o.bytes())
+}
+
+// Type returns the type of an embedded object.
+func (o ObjectRef) Type() string {
+	b := o.bytes()
+	if b == nil {
+		return ""
+	}
+	var t struct {
+		Type json.RawMessage `json:"type"`
+	}
+	json.Unmarshal(b, &t)
+	var types IRIs
+	if json.Unmarshal(t.Type, &types) != nil || len(types) == 0 {
+		return ""
+	}
+	return types[0]
+}
+
+// Decode unmarshals the embedded object into v.
+func (o ObjectRef) Decode(v interface{}) error {
+	b := o.bytes()
+	if b == nil {
+		return ErrNotEmbedded
+	}
+	return json.Unmarshal(b, v)
+}
+
+func (o ObjectRef) MarshalJSON() ([]byte, error) {
+	if b := o.bytes(); b != nil {
+		return b, nil
+	}
+	if o.IRI == "" {
+		return []byte("null"), nil
+	}
+	return json.Marshal(o.IRI)
+}
+
+func (o *ObjectRef) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*o = ObjectRef{}
+	switch {
+	case bytes.Equal(data, []byte("null")):
+	case len(data) > 0 && data[0] == '"':
+		return json.Unmarshal(data, &o.IRI)
+	case len(data) > 0 && data[0] == '[':
+		var list ObjectRefs
+		if err := json.Unmarshal(data, &list); err != nil {
+			return err
+		}
+		if len(list) > 0 {
+			*o = list[0]
+		}
+	default:
+		o.raw = append(json.RawMessage(nil), data...)
+	}
+	return nil
+}
+
+// ObjectRefs is a property holding one or more IRIs or embedded objects.
+type ObjectRefs []ObjectRef
+
+func (l *ObjectRefs) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	*l = nil
+	if len(data) == 0 || data[0] != '[' {
+		var o ObjectRef
+		if err := o.UnmarshalJSON(data); err != nil {
+			return err
+		}
+		if !o.IsZero() {
+			*l = ObjectRefs{o}
+		}
+		return nil
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	for _, r := range raw {
+		var o ObjectRef
+		if err := o.UnmarshalJSON(r); err != nil {
+			return err
+		}
+		if !o.IsZero() {
+			*l = append(*l, o)
+		}
+	}
+	return nil
+}
+
+// idOf returns the id (or href) of a JSON object.
+func idOf(data []byte) string {
+	var obj struct {
+		ID   string `json:"id"`
+		Href string `json:"href"`
+	}
+	if json.Unmarshal(data, &obj) != nil {
+		return ""
+	}
+	if obj.ID != "" {
+		return obj.ID
+	}
+	return obj.Href
+}
+
+// Extra holds properties a vocabulary type doesn't model.
+type Extra map[string]json.RawMessage
+
+var knownKeys sync.Map // reflect.Type -> map[string]bool
+
+// jsonKeys returns the JSON names of the fields of struct type t, including
+// those of embedded structs.
+func jsonKeys(t reflect.Type) map[string]bool {
+	if keys, ok := knownKeys.Load(t); ok {
+		return keys.(map[string]bool)
+	}
+	keys := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			for k := range jsonKeys(f.Type) {
+				keys[k] = true
+			}
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		keys[name] = true
+	}
+	knownKeys.Store(t, keys)
+	return keys
+}
+
+// marshalWithExtra marshals v (a pointer to a struct without a MarshalJSON
+// method) along with extra properties.
+func marshalWithExtra(v interface{}, extra Extra) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(extra) == 0 {
+		return b, err
+	}
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	for k, e := range extra {
+		if _, ok := m[k]; !ok {
+			m[k] = e
+		}
+	}
+	return json.Marshal(m)
+}
+
+// unmarshalWithExtra unmarshals data into v (a pointer to a struct without an
+// UnmarshalJSON method), keeping unknown properties in extra.
+func unmarshalWithExtra(data []byte, v interface{}, extra *Extra) error {
+	if err := json.Unmarshal(data, v); err != nil {
+		return err
+	}
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	for k := range jsonKeys(reflect.TypeOf(v).Elem()) {
+		delete(m, k)
+	}
+	*extra = nil
+	if len(m) > 0 {
+		*extra = m
+	}
+	return nil
+}
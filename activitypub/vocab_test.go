@@ -0,0 +1,463 @@
+package activitypub
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The fixtures in testdata follow payloads sent by Mastodon, Pleroma and
+// Misskey, which disagree on whether properties are single values or arrays,
+// whether objects are embedded, and what @context looks like.
+
+// The fixtures address bob, a user of this server at bots.example.
+const (
+	botActor = "https://bots.example/activitypub/user/bob"
+	botPost  = botActor + "/posts/abc"
+)
+
+// TestFixtureUrls checks that the fixtures use the urls this server gives its
+// users and posts.
+func TestFixtureUrls(t *testing.T) {
+	p := &activitypub{Resources: ResourceMap{BaseUrl: "https://bots.example/activitypub"}}
+	if got := p.userBaseUrl("bob"); got != botActor {
+		t.Errorf("Actor url is %v, fixtures use %v", got, botActor)
+	}
+	if got := p.postUrl("bob", "abc"); got != botPost {
+		t.Errorf("Post url is %v, fixtures use %v", got, botPost)
+	}
+}
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Error reading fixture %v: %v", name, err)
+	}
+	return data
+}
+
+// generic decodes data into plain maps and slices, for comparing JSON
+// regardless of formatting and key order.
+func generic(t *testing.T, data []byte) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		t.Fatalf("Error decoding %s: %v", data, err)
+	}
+	return v
+}
+
+// empty is whether a JSON value carries no information, in which case it may
+// be dropped on a round trip.
+func empty(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func TestActivityFixtures(t *testing.T) {
+	tests := []struct {
+		fixture    string
+		id         string
+		typ        string
+		actor      string
+		objectId   string
+		objectType string
+		embedded   bool
+		to         IRIs
+		cc         IRIs
+		extra      []string
+	}{
+		{
+			fixture:    "mastodon_create.json",
+			id:         "https://mastodon.social/users/alice/statuses/111/activity",
+			typ:        "Create",
+			actor:      "https://mastodon.social/users/alice",
+			objectId:   "https://mastodon.social/users/alice/statuses/111",
+			objectType: "Note",
+			embedded:   true,
+			to:         IRIs{ToAll},
+			cc:         IRIs{"https://mastodon.social/users/alice/followers", botActor},
+			extra:      []string{"signature"},
+		},
+		{
+			fixture:    "mastodon_undo_follow.json",
+			id:         "https://mastodon.social/users/alice#follows/42/undo",
+			typ:        "Undo",
+			actor:      "https://mastodon.social/users/alice",
+			objectId:   "https://mastodon.social/ad1ee9a4-0d7c-4f6a-9b1e-5c3c0c3c0c3c",
+			objectType: "Follow",
+			embedded:   true,
+		},
+		{
+			// Pleroma sends a single cc as a string.
+			fixture:    "pleroma_create.json",
+			id:         "https://pleroma.example/activities/0d9f",
+			typ:        "Create",
+			actor:      "https://pleroma.example/users/carol",
+			objectId:   "https://pleroma.example/objects/7c2a",
+			objectType: "Note",
+			embedded:   true,
+			to:         IRIs{ToAll, botActor},
+			cc:         IRIs{"https://pleroma.example/users/carol/followers"},
+			extra:      []string{"context", "context_id", "directMessage"},
+		},
+		{
+			fixture:  "pleroma_emoji_react.json",
+			id:       "https://pleroma.example/activities/e3a1",
+			typ:      "EmojiReact",
+			actor:    "https://pleroma.example/users/carol",
+			objectId: botPost,
+			to:       IRIs{botActor},
+			cc:       IRIs{"https://pleroma.example/users/carol/followers"},
+			extra:    []string{"content", "context", "tag"},
+		},
+		{
+			fixture:    "misskey_create.json",
+			id:         "https://misskey.example/notes/9xyz/activity",
+			typ:        "Create",
+			actor:      "https://misskey.example/users/9abc",
+			objectId:   "https://misskey.example/notes/9xyz",
+			objectType: "Note",
+			embedded:   true,
+			to:         IRIs{ToAll},
+			cc:         IRIs{"https://misskey.example/users/9abc/followers", botActor},
+		},
+		{
+			fixture:  "misskey_like.json",
+			id:       "https://misskey.example/likes/9r01",
+			typ:      "Like",
+			actor:    "https://misskey.example/users/9abc",
+			objectId: botPost,
+			extra:    []string{"content", "_misskey_reaction"},
+		},
+		{
+			fixture:  "misskey_announce.json",
+			id:       "https://misskey.example/notes/9rn1/activity",
+			typ:      "Announce",
+			actor:    "https://misskey.example/users/9abc",
+			objectId: botPost,
+			to:       IRIs{ToAll},
+			cc:       IRIs{botActor, "https://misskey.example/users/9abc/followers"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			var a Activity
+			if err := json.Unmarshal(readFixture(t, test.fixture), &a); err != nil {
+				t.Fatalf("Error decoding: %v", err)
+			}
+			if a.ID != test.id || a.Type != test.typ || a.Actor.String() != test.actor {
+				t.Errorf("Got id %q, type %q, actor %q; want %q, %q, %q", a.ID, a.Type, a.Actor, test.id, test.typ, test.actor)
+			}
+			if a.Object.ID() != test.objectId || a.Object.Type() != test.objectType || a.Object.Embedded() != test.embedded {
+				t.Errorf("Got object %q of type %q (embedded %v); want %q of type %q (embedded %v)",
+					a.Object.ID(), a.Object.Type(), a.Object.Embedded(), test.objectId, test.objectType, test.embedded)
+			}
+			if !reflect.DeepEqual(a.To, test.to) || !reflect.DeepEqual(a.Cc, test.cc) {
+				t.Errorf("Got to %v, cc %v; want %v, %v", a.To, a.Cc, test.to, test.cc)
+			}
+			for _, key := range test.extra {
+				if _, ok := a.Extra[key]; !ok {
+					t.Errorf("Property %q not kept; have %v", key, a.Extra)
+				}
+			}
+		})
+	}
+}
+
+func TestNoteFixtures(t *testing.T) {
+	tests := []struct {
+		fixture   string
+		inReplyTo string
+		to        IRIs
+		mentions  []string
+		hashtags  []string
+		likes     int
+		extra     []string
+	}{
+		{
+			fixture:   "mastodon_create.json",
+			inReplyTo: botPost,
+			to:        IRIs{ToAll},
+			mentions:  []string{botActor},
+			hashtags:  []string{"https://mastodon.social/tags/go"},
+			likes:     3,
+			extra:     []string{"atomUri", "conversation", "contentMap"},
+		},
+		{
+			// Pleroma embeds the replied-to object, and sends a single
+			// tag and audience without arrays.
+			fixture:   "pleroma_create.json",
+			inReplyTo: botPost,
+			to:        IRIs{ToAll},
+			mentions:  []string{botActor},
+			extra:     []string{"actor", "context", "source"},
+		},
+		{
+			fixture:  "misskey_create.json",
+			to:       IRIs{ToAll},
+			mentions: []string{botActor},
+			extra:    []string{"_misskey_content", "_misskey_quote", "quoteUrl", "source"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			var a Activity
+			if err := json.Unmarshal(readFixture(t, test.fixture), &a); err != nil {
+				t.Fatalf("Error decoding: %v", err)
+			}
+			var n Note
+			if err := a.Object.Decode(&n); err != nil {
+				t.Fatalf("Error decoding note: %v", err)
+			}
+			if n.InReplyTo.String() != test.inReplyTo || !reflect.DeepEqual(n.To, test.to) {
+				t.Errorf("Got inReplyTo %q, to %v; want %q, %v", n.InReplyTo, n.To, test.inReplyTo, test.to)
+			}
+			var mentions, hashtags []string
+			for _, tag := range n.Tag {
+				switch tag.Type() {
+				case "Mention":
+					mentions = append(mentions, tag.ID())
+				case "Hashtag":
+					hashtags = append(hashtags, tag.ID())
+				}
+			}
+			if !reflect.DeepEqual(mentions, test.mentions) || !reflect.DeepEqual(hashtags, test.hashtags) {
+				t.Errorf("Got mentions %v, hashtags %v; want %v, %v", mentions, hashtags, test.mentions, test.hashtags)
+			}
+			if test.likes != 0 {
+				var likes Collection
+				if err := n.Likes.Decode(&likes); err != nil || likes.TotalItems != test.likes {
+					t.Errorf("Got %v likes (%v); want %v", likes.TotalItems, err, test.likes)
+				}
+			}
+			for _, key := range test.extra {
+				if _, ok := n.Extra[key]; !ok {
+					t.Errorf("Property %q not kept; have %v", key, n.Extra)
+				}
+			}
+		})
+	}
+}
+
+func TestActorFixtures(t *testing.T) {
+	tests := []struct {
+		fixture     string
+		id          string
+		inbox       string
+		sharedInbox string
+		keyId       string
+		icon        string
+		alsoKnownAs IRIs
+		approves    bool
+		extra       []string
+	}{
+		{
+			fixture:     "mastodon_actor.json",
+			id:          "https://mastodon.social/users/alice",
+			inbox:       "https://mastodon.social/users/alice/inbox",
+			sharedInbox: "https://mastodon.social/inbox",
+			keyId:       "https://mastodon.social/users/alice#main-key",
+			icon:        "https://files.mastodon.social/accounts/avatars/000/000/001/original/avatar.png",
+			alsoKnownAs: IRIs{"https://fosstodon.org/users/alice"},
+			extra:       []string{"featured", "featuredTags", "indexable", "devices", "tag"},
+		},
+		{
+			fixture:     "pleroma_actor.json",
+			id:          "https://pleroma.example/users/carol",
+			inbox:       "https://pleroma.example/users/carol/inbox",
+			sharedInbox: "https://pleroma.example/inbox",
+			keyId:       "https://pleroma.example/users/carol#main-key",
+			icon:        "https://pleroma.example/media/avatar.png",
+			approves:    true,
+			extra:       []string{"capabilities", "invisible", "vcard:bday", "tag"},
+		},
+		{
+			fixture:     "misskey_actor.json",
+			id:          "https://misskey.example/users/9abc",
+			inbox:       "https://misskey.example/users/9abc/inbox",
+			sharedInbox: "https://misskey.example/inbox",
+			keyId:       "https://misskey.example/users/9abc#main-key",
+			icon:        "https://misskey.example/files/avatar.webp",
+			extra:       []string{"_misskey_summary", "isCat", "sharedInbox", "vcard:Address"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.fixture, func(t *testing.T) {
+			var a Actor
+			if err := json.Unmarshal(readFixture(t, test.fixture), &a); err != nil {
+				t.Fatalf("Error decoding: %v", err)
+			}
+			if a.ID != test.id || a.Inbox != test.inbox || a.PublicKey.KeyId != test.keyId || a.Approves != test.approves {
+				t.Errorf("Got id %q, inbox %q, key %q, approves %v", a.ID, a.Inbox, a.PublicKey.KeyId, a.Approves)
+			}
+			if a.Endpoints == nil || a.Endpoints.SharedInbox != test.sharedInbox {
+				t.Errorf("Got endpoints %+v; want shared inbox %q", a.Endpoints, test.sharedInbox)
+			}
+			if a.Icon == nil || a.Icon.Url.String() != test.icon {
+				t.Errorf("Got icon %+v; want %q", a.Icon, test.icon)
+			}
+			if !reflect.DeepEqual(a.AlsoKnownAs, test.alsoKnownAs) {
+				t.Errorf("Got alsoKnownAs %v; want %v", a.AlsoKnownAs, test.alsoKnownAs)
+			}
+			for _, key := range test.extra {
+				if _, ok := a.Extra[key]; !ok {
+					t.Errorf("Property %q not kept; have %v", key, a.Extra)
+				}
+			}
+		})
+	}
+}
+
+// TestFixtureRoundTrip checks that decoding and encoding a payload keeps every
+// property that carries information, unknown ones verbatim, as well as the
+// embedded object and @context.
+func TestFixtureRoundTrip(t *testing.T) {
+	fixtures, err := filepath.Glob(filepath.Join("testdata", "*.json"))
+	if err != nil || len(fixtures) == 0 {
+		t.Fatalf("No fixtures: %v", err)
+	}
+	for _, fixture := range fixtures {
+		name := filepath.Base(fixture)
+		t.Run(name, func(t *testing.T) {
+			data := readFixture(t, name)
+			var out []byte
+			var extra Extra
+			var err error
+			if generic(t, data).(map[string]interface{})["type"] == "Person" {
+				var a Actor
+				if err := json.Unmarshal(data, &a); err != nil {
+					t.Fatalf("Error decoding: %v", err)
+				}
+				extra = a.Extra
+				out, err = json.Marshal(a)
+			} else {
+				var a Activity
+				if err := json.Unmarshal(data, &a); err != nil {
+					t.Fatalf("Error decoding: %v", err)
+				}
+				extra = a.Extra
+				out, err = json.Marshal(a)
+			}
+			if err != nil {
+				t.Fatalf("Error encoding: %v", err)
+			}
+			in, got := generic(t, data).(map[string]interface{}), generic(t, out).(map[string]interface{})
+			for key, v := range in {
+				if _, ok := got[key]; !ok && !empty(v) {
+					t.Errorf("Property %q lost", key)
+				}
+			}
+			for key := range extra {
+				if !reflect.DeepEqual(in[key], got[key]) {
+					t.Errorf("Property %q changed: %v became %v", key, in[key], got[key])
+				}
+			}
+			for _, key := range []string{"@context", "object"} {
+				if !reflect.DeepEqual(in[key], got[key]) {
+					t.Errorf("Property %q changed: %v became %v", key, in[key], got[key])
+				}
+			}
+		})
+	}
+}
+
+func TestIRIForms(t *testing.T) {
+	tests := []struct {
+		json string
+		iri  IRI
+		iris IRIs
+	}{
+		{`"https://a.example/1"`, "https://a.example/1", IRIs{"https://a.example/1"}},
+		{`["https://a.example/1", "https://a.example/2"]`, "https://a.example/1", IRIs{"https://a.example/1", "https://a.example/2"}},
+		{`{"id": "https://a.example/1", "type": "Person"}`, "https://a.example/1", IRIs{"https://a.example/1"}},
+		{`[{"id": "https://a.example/1"}, "https://a.example/2"]`, "https://a.example/1", IRIs{"https://a.example/1", "https://a.example/2"}},
+		{`{"type": "Link", "href": "https://a.example/1"}`, "https://a.example/1", IRIs{"https://a.example/1"}},
+		{`null`, "", nil},
+		{`[]`, "", nil},
+	}
+	for _, test := range tests {
+		var iri IRI
+		if err := json.Unmarshal([]byte(test.json), &iri); err != nil || iri != test.iri {
+			t.Errorf("IRI of %v: got %q (%v), want %q", test.json, iri, err, test.iri)
+		}
+		var iris IRIs
+		if err := json.Unmarshal([]byte(test.json), &iris); err != nil || !reflect.DeepEqual(iris, test.iris) {
+			t.Errorf("IRIs of %v: got %v (%v), want %v", test.json, iris, err, test.iris)
+		}
+	}
+}
+
+func TestObjectRefForms(t *testing.T) {
+	tests := []struct {
+		json     string
+		id       string
+		typ      string
+		embedded bool
+		out      string // encoded again, if not the same
+	}{
+		{json: `"https://a.example/1"`, id: "https://a.example/1"},
+		{json: `{"id":"https://a.example/1","type":"Note"}`, id: "https://a.example/1", typ: "Note", embedded: true},
+		{json: `{"id":"https://a.example/1","type":["Note","Page"]}`, id: "https://a.example/1", typ: "Note", embedded: true},
+		{json: `[{"id":"https://a.example/1","type":"Note"}]`, id: "https://a.example/1", typ: "Note", embedded: true, out: `{"id":"https://a.example/1","type":"Note"}`},
+		{json: `["https://a.example/1","https://a.example/2"]`, id: "https://a.example/1", out: `"https://a.example/1"`},
+		{json: `null`},
+	}
+	for _, test := range tests {
+		var o ObjectRef
+		if err := json.Unmarshal([]byte(test.json), &o); err != nil {
+			t.Errorf("Error decoding %v: %v", test.json, err)
+			continue
+		}
+		if o.ID() != test.id || o.Type() != test.typ || o.Embedded() != test.embedded {
+			t.Errorf("%v: got id %q, type %q, embedded %v", test.json, o.ID(), o.Type(), o.Embedded())
+		}
+		want := test.out
+		if want == "" {
+			want = test.json
+		}
+		if out, err := json.Marshal(o); err != nil || string(out) != want {
+			t.Errorf("%v: encoded as %s (%v), want %v", test.json, out, err, want)
+		}
+	}
+}
+
+func TestContextForms(t *testing.T) {
+	tests := []string{
+		`"https://www.w3.org/ns/activitystreams"`,
+		`["https://www.w3.org/ns/activitystreams","https://w3id.org/security/v1"]`,
+		`["https://www.w3.org/ns/activitystreams",{"@language":"und"}]`,
+		`["https://www.w3.org/ns/activitystreams",{"toot":"http://joinmastodon.org/ns#","featured":{"@id":"toot:featured","@type":"@id"}}]`,
+		`{"@vocab":"https://www.w3.org/ns/activitystreams"}`,
+	}
+	for _, test := range tests {
+		data := []byte(`{"@context":` + test + `,"id":"https://a.example/1","type":"Follow"}`)
+		var a Activity
+		if err := json.Unmarshal(data, &a); err != nil {
+			t.Errorf("Error decoding %v: %v", test, err)
+			continue
+		}
+		out, err := json.Marshal(a)
+		if err != nil {
+			t.Errorf("Error encoding %v: %v", test, err)
+			continue
+		}
+		if !reflect.DeepEqual(generic(t, data), generic(t, out)) {
+			t.Errorf("@context %v encoded as %s", test, out)
+		}
+	}
+}
@@ -0,0 +1,292 @@
+// Operating the bridge: an API for the admin CLI, authenticated by a token,
+// and a dashboard for operators signed in with the token or through OIDC.
+package admin
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/ml8/ap-bot/activitypub"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/util"
+)
+
+var log = util.Logger("admin")
+
+const (
+	ApiUrl                 = "/admin/api"
+	StatusUrl              = ApiUrl + "/status"
+	UsersUrl               = ApiUrl + "/users"
+	UserUrlTemplate        = UsersUrl + "/{name}"
+	UserActionUrlTemplate  = UserUrlTemplate + "/{action}"
+	FollowersUrl           = ApiUrl + "/followers"
+	FollowersUrlTemplate   = FollowersUrl + "/{name}"
+	QueueUrl               = ApiUrl + "/queue"
+	QueueActionUrlTemplate = QueueUrl + "/{action}"
+	ExportUrl              = ApiUrl + "/export"
+	OverviewUrl            = ApiUrl + "/overview"
+	tokenLen               = 32
+)
+
+// Ops are the operations available to the operator, carried out either in
+// this process or by a running server.
+type Ops interface {
+	Users() ([]activitypub.UserInfo, error)
+	User(name string) (activitypub.UserInfo, error)
+	DeleteUser(name string) error
+	Pause(name string, paused bool) error
+	Suspend(name string, suspended bool) error
+	Followers(name string) ([]string, error)
+	RemoveFollower(name, actor string) error
+	PostNow(name string) error
+	Queue() (Queue, error)
+	Retry(id string) (int, error)
+	Purge(id string) (int, error)
+	RotateKey(name string, ed25519 bool) error
+	Export() (State, error)
+	Import(state State) error
+	Overview() (Overview, error)
+}
+
+type Queue struct {
+	Queued []activitypub.Delivery `json:"queued"`
+	Dead   []activitypub.Delivery `json:"dead"`
+}
+
+// State is the persisted state of every component, by state name, as stored:
+// secrets stay sealed.
+type State map[string]map[string]json.RawMessage
+
+type Status struct {
+	Version string `json:"version"`
+}
+
+// Overview is the health of the instance, as shown on the dashboard.
+type Overview struct {
+	Users           []activitypub.UserInfo   `json:"users"`
+	FollowerDomains []DomainCount            `json:"followerdomains"`
+	Queued          int                      `json:"queued"`
+	Failing         []activitypub.Delivery   `json:"failing"` // queued, but failed before
+	Dead            []activitypub.Delivery   `json:"dead"`
+	Inbox           []activitypub.InboxEvent `json:"inbox"`
+	InstanceBlocks  []moderation.DomainBlock `json:"instanceblocks"`
+	Allowlist       []string                 `json:"allowlist"`
+	Relays          []activitypub.Relay      `json:"relays"`
+}
+
+type DomainCount struct {
+	Domain    string `json:"domain"`
+	Followers int    `json:"followers"`
+}
+
+type Admin interface {
+	StatusHandler(w http.ResponseWriter, r *http.Request)
+	UsersHandler(w http.ResponseWriter, r *http.Request)
+	UserHandler(w http.ResponseWriter, r *http.Request)
+	UserActionHandler(w http.ResponseWriter, r *http.Request)
+	FollowersHandler(w http.ResponseWriter, r *http.Request)
+	QueueHandler(w http.ResponseWriter, r *http.Request)
+	QueueActionHandler(w http.ResponseWriter, r *http.Request)
+	ExportHandler(w http.ResponseWriter, r *http.Request)
+	OverviewHandler(w http.ResponseWriter, r *http.Request)
+	DashboardHandler(w http.ResponseWriter, r *http.Request)
+	LoginHandler(w http.ResponseWriter, r *http.Request)
+	OIDCCallbackHandler(w http.ResponseWriter, r *http.Request)
+	ActionHandler(w http.ResponseWriter, r *http.Request)
+	LogoutHandler(w http.ResponseWriter, r *http.Request)
+}
+
+type admin struct {
+	Ops     Ops
+	Token   string
+	Cookies *util.CookieSigner
+	OIDC    *oidc // nil unless configured
+}
+
+// Init serves ops to holders of token, and to operators signed in through
+// OIDC if oidcConfig is set. Without a token the API is disabled.
+func Init(ops Ops, token string, cookies *util.CookieSigner, oidcConfig *OIDCConfig) Admin {
+	if token == "" {
+		log.Warn("No admin token; the admin API is disabled")
+	}
+	a := &admin{Ops: ops, Token: token, Cookies: cookies}
+	if oidcConfig != nil {
+		a.OIDC = &oidc{Config: *oidcConfig, Client: http.Client{Timeout: oidcTimeout}}
+	}
+	return a
+}
+
+// LoadOrCreateToken reads the admin token from fname, creating it on first
+// use.
+func LoadOrCreateToken(fname string) string {
+	if data, err := os.ReadFile(fname); err == nil {
+		if token := strings.TrimSpace(string(data)); token != "" {
+			return token
+		}
+	}
+	token := util.RandomToken(tokenLen)
+	if err := os.WriteFile(fname, []byte(token+"\n"), 0600); err != nil {
+		log.Error("Error writing admin token", "file", fname, "error", err)
+	}
+	return token
+}
+
+// authorized checks the request's bearer token, answering it if it is
+// missing or wrong.
+func (a *admin) authorized(w http.ResponseWriter, r *http.Request) bool {
+	if a.Token == "" {
+		http.NotFound(w, r)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+		log.WarnContext(r.Context(), "Unauthorized admin request", "remote", r.RemoteAddr)
+		util.ErrorResponse(w, http.StatusUnauthorized, "Invalid admin token")
+		return false
+	}
+	return true
+}
+
+// allow answers requests that are unauthorized or use another method.
+func (a *admin) allow(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	if !a.authorized(w, r) {
+		return false
+	}
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	util.ErrorResponse(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v not supported", r.Method))
+	return false
+}
+
+// respond answers with payload, or with err if there is one.
+func respond(w http.ResponseWriter, payload interface{}, err error) {
+	if err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if payload == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, payload)
+}
+
+func (a *admin) StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET") {
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, Status{Version: activitypub.Version})
+}
+
+func (a *admin) UsersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET") {
+		return
+	}
+	users, err := a.Ops.Users()
+	respond(w, users, err)
+}
+
+func (a *admin) UserHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET", "DELETE") {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if r.Method == "DELETE" {
+		respond(w, nil, a.Ops.DeleteUser(name))
+		return
+	}
+	user, err := a.Ops.User(name)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusNotFound, err.Error())
+		return
+	}
+	util.JsonResponse(w, http.StatusOK, user)
+}
+
+func (a *admin) UserActionHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "POST") {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	var err error
+	switch action := mux.Vars(r)["action"]; action {
+	case "pause", "resume":
+		err = a.Ops.Pause(name, action == "pause")
+	case "suspend", "unsuspend":
+		err = a.Ops.Suspend(name, action == "suspend")
+	case "post":
+		err = a.Ops.PostNow(name)
+	case "rotate-key":
+		err = a.Ops.RotateKey(name, r.FormValue("ed25519") != "")
+	default:
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Unknown action %q", action))
+		return
+	}
+	respond(w, nil, err)
+}
+
+func (a *admin) FollowersHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET", "DELETE") {
+		return
+	}
+	name := mux.Vars(r)["name"]
+	if r.Method == "DELETE" {
+		respond(w, nil, a.Ops.RemoveFollower(name, r.FormValue("actor")))
+		return
+	}
+	followers, err := a.Ops.Followers(name)
+	if followers == nil {
+		followers = []string{}
+	}
+	respond(w, followers, err)
+}
+
+func (a *admin) QueueHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET") {
+		return
+	}
+	queue, err := a.Ops.Queue()
+	respond(w, queue, err)
+}
+
+func (a *admin) QueueActionHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "POST") {
+		return
+	}
+	var n int
+	var err error
+	switch action := mux.Vars(r)["action"]; action {
+	case "retry":
+		n, err = a.Ops.Retry(r.FormValue("id"))
+	case "purge":
+		n, err = a.Ops.Purge(r.FormValue("id"))
+	default:
+		util.ErrorResponse(w, http.StatusNotFound, fmt.Sprintf("Unknown action %q", action))
+		return
+	}
+	respond(w, map[string]int{"count": n}, err)
+}
+
+func (a *admin) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET") {
+		return
+	}
+	state, err := a.Ops.Export()
+	respond(w, state, err)
+}
+
+func (a *admin) OverviewHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.allow(w, r, "GET") {
+		return
+	}
+	overview, err := a.Ops.Overview()
+	respond(w, overview, err)
+}
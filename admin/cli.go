@@ -0,0 +1,304 @@
+package admin
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+)
+
+const Usage = `Usage: ap-bot [flags] [command]
+
+Commands:
+  serve                             run the server (the default)
+  users list                        list users
+  users show <user>                 show a user
+  users delete <user>               delete a user, telling their followers
+  users pause|resume <user>         stop or restart periodic posting
+  users suspend|unsuspend <user>    hide a user from other servers and stop
+                                    their posts, or undo that
+  followers list <user>             list a user's followers
+  followers remove <user> <actor>   remove and reject a follower
+  post-now <user>                   post an article for a user now
+  queue inspect                     list queued and failed deliveries
+  queue retry [id]                  retry a delivery, or every failed one
+  queue purge [id]                  drop a delivery, or every failed one
+  keys rotate [-ed25519] <user>     replace a user's signing key
+  export [file]                     write all state as JSON (default: stdout)
+  import <file>                     replace state with an export
+  migrate [-force]                  move JSON state into the bolt store
+  restore <state> [n]               replace a JSON state file, e.g.
+                                    activitypub, with its nth backup
+                                    (default 1)
+
+Commands go through the admin API when the server is running, and work on
+the store under -db directly when it is not. import, migrate and restore
+need the server to be stopped.
+`
+
+// UsageError reports a malformed command line.
+type UsageError struct {
+	Message string
+}
+
+func (e *UsageError) Error() string {
+	return e.Message
+}
+
+func usage(format string, v ...interface{}) error {
+	return &UsageError{fmt.Sprintf(format, v...)}
+}
+
+// wantArgs checks that a command got exactly n arguments.
+func wantArgs(cmd string, got []string, n int, names string) error {
+	if len(got) != n {
+		return usage("%v takes %v", cmd, names)
+	}
+	return nil
+}
+
+// Run carries out the command in args with ops, writing results to out.
+func Run(ops Ops, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return usage("No command")
+	}
+	cmd, rest := args[0], args[1:]
+	switch cmd {
+	case "users":
+		return runUsers(ops, rest, out)
+	case "followers":
+		return runFollowers(ops, rest, out)
+	case "post-now":
+		if err := wantArgs("post-now", rest, 1, "<user>"); err != nil {
+			return err
+		}
+		if err := ops.PostNow(rest[0]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Posted for %v\n", rest[0])
+		return nil
+	case "queue":
+		return runQueue(ops, rest, out)
+	case "keys":
+		return runKeys(ops, rest, out)
+	case "export":
+		return runExport(ops, rest, out)
+	case "import":
+		return runImport(ops, rest, out)
+	}
+	return usage("Unknown command %q", cmd)
+}
+
+func subcommand(cmd string, rest []string) (string, []string, error) {
+	if len(rest) == 0 {
+		return "", nil, usage("%v needs a subcommand", cmd)
+	}
+	return rest[0], rest[1:], nil
+}
+
+func runUsers(ops Ops, rest []string, out io.Writer) error {
+	sub, rest, err := subcommand("users", rest)
+	if err != nil {
+		return err
+	}
+	if sub == "list" {
+		users, err := ops.Users()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tLINKED\tFOLLOWERS\tPENDING\tPOSTS\tLAST POST\tPAUSED\tSUSPENDED")
+		for _, u := range users {
+			fmt.Fprintf(tw, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", u.Name, u.Linked, u.Followers, u.Pending, u.Posted, when(u.LastPost), u.Settings.Paused, u.Suspended)
+		}
+		return tw.Flush()
+	}
+	if err := wantArgs("users "+sub, rest, 1, "<user>"); err != nil {
+		return err
+	}
+	name := rest[0]
+	switch sub {
+	case "show":
+		user, err := ops.User(name)
+		if err != nil {
+			return err
+		}
+		return writeJSON(out, user)
+	case "delete":
+		err = ops.DeleteUser(name)
+	case "pause", "resume":
+		err = ops.Pause(name, sub == "pause")
+	case "suspend", "unsuspend":
+		err = ops.Suspend(name, sub == "suspend")
+	default:
+		return usage("Unknown users subcommand %q", sub)
+	}
+	if err == nil {
+		fmt.Fprintf(out, "%v: %v done\n", name, sub)
+	}
+	return err
+}
+
+func runFollowers(ops Ops, rest []string, out io.Writer) error {
+	sub, rest, err := subcommand("followers", rest)
+	if err != nil {
+		return err
+	}
+	switch sub {
+	case "list":
+		if err := wantArgs("followers list", rest, 1, "<user>"); err != nil {
+			return err
+		}
+		followers, err := ops.Followers(rest[0])
+		if err != nil {
+			return err
+		}
+		for _, f := range followers {
+			fmt.Fprintln(out, f)
+		}
+		return nil
+	case "remove":
+		if err := wantArgs("followers remove", rest, 2, "<user> <actor>"); err != nil {
+			return err
+		}
+		if err := ops.RemoveFollower(rest[0], rest[1]); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Removed %v from the followers of %v\n", rest[1], rest[0])
+		return nil
+	}
+	return usage("Unknown followers subcommand %q", sub)
+}
+
+func runQueue(ops Ops, rest []string, out io.Writer) error {
+	sub, rest, err := subcommand("queue", rest)
+	if err != nil {
+		return err
+	}
+	if sub == "inspect" {
+		queue, err := ops.Queue()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tSTATE\tUSER\tACTOR\tATTEMPTS\tNEXT TRY\tLAST ERROR")
+		for _, dl := range queue.Queued {
+			fmt.Fprintf(tw, "%v\tqueued\t%v\t%v\t%v\t%v\t%v\n", dl.ID, dl.User, dl.Actor, dl.Attempts, when(dl.NextTry), dl.LastError)
+		}
+		for _, dl := range queue.Dead {
+			fmt.Fprintf(tw, "%v\tfailed\t%v\t%v\t%v\t-\t%v\n", dl.ID, dl.User, dl.Actor, dl.Attempts, dl.LastError)
+		}
+		return tw.Flush()
+	}
+	if len(rest) > 1 {
+		return usage("queue %v takes at most one id", sub)
+	}
+	id := ""
+	if len(rest) == 1 {
+		id = rest[0]
+	}
+	var n int
+	switch sub {
+	case "retry":
+		n, err = ops.Retry(id)
+	case "purge":
+		n, err = ops.Purge(id)
+	default:
+		return usage("Unknown queue subcommand %q", sub)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "%v: %v deliveries\n", sub, n)
+	return nil
+}
+
+func runKeys(ops Ops, rest []string, out io.Writer) error {
+	sub, rest, err := subcommand("keys", rest)
+	if err != nil {
+		return err
+	}
+	if sub != "rotate" {
+		return usage("Unknown keys subcommand %q", sub)
+	}
+	fs := flag.NewFlagSet("keys rotate", flag.ContinueOnError)
+	ed25519 := fs.Bool("ed25519", false, "also publish a new Ed25519 key")
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(rest); err != nil {
+		return usage("keys rotate: %v", err)
+	}
+	if err := wantArgs("keys rotate", fs.Args(), 1, "<user>"); err != nil {
+		return err
+	}
+	name := fs.Arg(0)
+	if err := ops.RotateKey(name, *ed25519); err != nil {
+		return err
+	}
+	user, err := ops.User(name)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Rotated key of %v; now signing as %v\n", name, user.KeyId)
+	return nil
+}
+
+func runExport(ops Ops, rest []string, out io.Writer) error {
+	if len(rest) > 1 {
+		return usage("export takes at most a file")
+	}
+	state, err := ops.Export()
+	if err != nil {
+		return err
+	}
+	if len(rest) == 0 {
+		return writeJSON(out, state)
+	}
+	f, err := os.OpenFile(rest[0], os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := writeJSON(f, state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Exported %v states to %v\n", len(state), rest[0])
+	return nil
+}
+
+func runImport(ops Ops, rest []string, out io.Writer) error {
+	if err := wantArgs("import", rest, 1, "<file>"); err != nil {
+		return err
+	}
+	data, err := os.ReadFile(rest[0])
+	if err != nil {
+		return err
+	}
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("Error reading %v: %v", rest[0], err)
+	}
+	if err := ops.Import(state); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Imported %v states from %v\n", len(state), rest[0])
+	return nil
+}
+
+func writeJSON(out io.Writer, v interface{}) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func when(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.DateTime)
+}
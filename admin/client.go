@@ -0,0 +1,176 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/activitypub"
+)
+
+// ErrNotRunning is returned by Dial when no server answers at the URL.
+var ErrNotRunning = errors.New("server is not running")
+
+var errNotFound = errors.New("not found")
+
+// client carries out operations through the API of a running server.
+type client struct {
+	Url    string // scheme and host of the server
+	Token  string
+	Client *http.Client
+}
+
+// Dial connects to the server at siteUrl, returning ErrNotRunning if nothing
+// is listening there.
+func Dial(siteUrl, token string) (Ops, error) {
+	c := &client{Url: strings.TrimSuffix(siteUrl, "/"), Token: token, Client: &http.Client{Timeout: time.Minute}}
+	var status Status
+	err := c.do("GET", StatusUrl, nil, &status)
+	var op *net.OpError
+	switch {
+	case errors.As(err, &op) && op.Op == "dial":
+		return nil, ErrNotRunning
+	case errors.Is(err, errNotFound):
+		return nil, fmt.Errorf("The server at %v has no admin API; is it configured with an admin token?", c.Url)
+	case err != nil:
+		return nil, err
+	}
+	return c, nil
+}
+
+// do makes an API request, decoding the response into out, if given.
+func (c *client) do(method, path string, form url.Values, out interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequest(method, c.Url+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Token)
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%v %v: %w", method, path, errNotFound)
+		}
+		return fmt.Errorf("%v %v: %v", method, path, resp.Status)
+	}
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+func userPath(name string, rest ...string) string {
+	return strings.Join(append([]string{UsersUrl, url.PathEscape(name)}, rest...), "/")
+}
+
+func (c *client) Users() (users []activitypub.UserInfo, err error) {
+	err = c.do("GET", UsersUrl, nil, &users)
+	return
+}
+
+func (c *client) User(name string) (user activitypub.UserInfo, err error) {
+	err = c.do("GET", userPath(name), nil, &user)
+	return
+}
+
+func (c *client) DeleteUser(name string) error {
+	return c.do("DELETE", userPath(name), nil, nil)
+}
+
+func (c *client) Pause(name string, paused bool) error {
+	action := "resume"
+	if paused {
+		action = "pause"
+	}
+	return c.do("POST", userPath(name, action), url.Values{}, nil)
+}
+
+func (c *client) Suspend(name string, suspended bool) error {
+	action := "unsuspend"
+	if suspended {
+		action = "suspend"
+	}
+	return c.do("POST", userPath(name, action), url.Values{}, nil)
+}
+
+func (c *client) Followers(name string) (followers []string, err error) {
+	err = c.do("GET", FollowersUrl+"/"+url.PathEscape(name), nil, &followers)
+	return
+}
+
+func (c *client) RemoveFollower(name, actor string) error {
+	return c.do("DELETE", FollowersUrl+"/"+url.PathEscape(name)+"?"+url.Values{"actor": {actor}}.Encode(), nil, nil)
+}
+
+func (c *client) PostNow(name string) error {
+	return c.do("POST", userPath(name, "post"), url.Values{}, nil)
+}
+
+func (c *client) Queue() (queue Queue, err error) {
+	err = c.do("GET", QueueUrl, nil, &queue)
+	return
+}
+
+func (c *client) queueAction(action, id string) (int, error) {
+	var result struct {
+		Count int `json:"count"`
+	}
+	err := c.do("POST", QueueUrl+"/"+action, url.Values{"id": {id}}, &result)
+	return result.Count, err
+}
+
+func (c *client) Retry(id string) (int, error) {
+	return c.queueAction("retry", id)
+}
+
+func (c *client) Purge(id string) (int, error) {
+	return c.queueAction("purge", id)
+}
+
+func (c *client) RotateKey(name string, ed25519 bool) error {
+	form := url.Values{}
+	if ed25519 {
+		form.Set("ed25519", "on")
+	}
+	return c.do("POST", userPath(name, "rotate-key"), form, nil)
+}
+
+func (c *client) Export() (state State, err error) {
+	err = c.do("GET", ExportUrl, nil, &state)
+	return
+}
+
+func (c *client) Import(state State) error {
+	return fmt.Errorf("The server is running at %v; stop it before importing state", c.Url)
+}
+
+func (c *client) Overview() (overview Overview, err error) {
+	err = c.do("GET", OverviewUrl, nil, &overview)
+	return
+}
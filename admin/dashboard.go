@@ -0,0 +1,387 @@
+package admin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+const (
+	DashboardUrl    = "/admin"
+	LoginUrl        = DashboardUrl + "/login"
+	OIDCCallbackUrl = DashboardUrl + "/oidc/callback"
+	ActionUrl       = DashboardUrl + "/action"
+	LogoutUrl       = DashboardUrl + "/logout"
+	maxShown        = 50 // failing and dead deliveries listed on the dashboard
+	tokenOperator   = "token"
+	oidcOperator    = "oidc:" // followed by the admin's email address
+)
+
+// dashboardEnabled is whether operators have any way to sign in.
+func (a *admin) dashboardEnabled() bool {
+	return a.Token != "" || a.OIDC != nil
+}
+
+// operator returns who is signed in to the dashboard, or "". Sessions are
+// only honoured for a way of signing in that is still configured, and an
+// OIDC session only for an address that is still an admin.
+func (a *admin) operator(r *http.Request) string {
+	who := a.Cookies.AdminSession(r)
+	switch {
+	case who == tokenOperator && a.Token != "":
+		return who
+	case strings.HasPrefix(who, oidcOperator) && a.OIDC != nil && a.OIDC.admitted(strings.TrimPrefix(who, oidcOperator)):
+		return who
+	}
+	return ""
+}
+
+func (a *admin) DashboardHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	who := a.operator(r)
+	if who == "" {
+		a.renderLogin(w, http.StatusOK, r.FormValue("message"))
+		return
+	}
+	a.render(w, r, who, r.FormValue("message"))
+}
+
+func (a *admin) renderLogin(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := loginTemplate.Execute(w, loginData{
+		Message: message,
+		Token:   a.Token != "",
+		OIDC:    a.OIDC != nil,
+	})
+	if err != nil {
+		log.Error("Error rendering admin login", "error", err)
+	}
+}
+
+func (a *admin) render(w http.ResponseWriter, r *http.Request, who, message string) {
+	overview, err := a.Ops.Overview()
+	if err != nil {
+		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(overview.Failing) > maxShown {
+		overview.Failing = overview.Failing[:maxShown]
+	}
+	if len(overview.Dead) > maxShown {
+		overview.Dead = overview.Dead[:maxShown]
+	}
+	data := dashboardData{
+		Overview: overview,
+		Operator: who,
+		Message:  message,
+		CSRF:     a.Cookies.AdminCSRFToken(r),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.ErrorContext(r.Context(), "Error rendering admin dashboard", "error", err)
+	}
+}
+
+// LoginHandler signs the operator in with the admin token, or sends them to
+// the OIDC provider.
+func (a *admin) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if !a.dashboardEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == "POST" {
+		token := r.FormValue("token")
+		if a.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) != 1 {
+			log.WarnContext(r.Context(), "Failed admin sign in", "remote", r.RemoteAddr)
+			a.renderLogin(w, http.StatusUnauthorized, "Invalid admin token")
+			return
+		}
+		log.InfoContext(r.Context(), "Admin signed in with the token", "remote", r.RemoteAddr)
+		a.Cookies.SetAdminSession(w, tokenOperator)
+		http.Redirect(w, r, DashboardUrl, http.StatusSeeOther)
+		return
+	}
+	if a.OIDC == nil {
+		http.Redirect(w, r, DashboardUrl, http.StatusFound)
+		return
+	}
+	state := util.RandomToken(tokenLen)
+	redirect, err := a.OIDC.authUrl(state)
+	if err != nil {
+		log.ErrorContext(r.Context(), "Error starting OIDC sign in", "error", err)
+		a.renderLogin(w, http.StatusBadGateway, "Sign in with the identity provider is unavailable")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     OIDCStateCookie,
+		Value:    a.Cookies.Sign(OIDCStateCookie, state, OIDCStateTTL),
+		Path:     OIDCCallbackUrl,
+		MaxAge:   int(OIDCStateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   a.Cookies.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (a *admin) OIDCCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if a.OIDC == nil {
+		http.NotFound(w, r)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: OIDCStateCookie, Path: OIDCCallbackUrl, MaxAge: -1})
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(OIDCStateCookie)
+	if state == "" || err != nil {
+		a.renderLogin(w, http.StatusBadRequest, "Missing sign in state; please start again")
+		return
+	}
+	if value, ok := a.Cookies.Verify(OIDCStateCookie, cookie.Value); !ok || subtle.ConstantTimeCompare([]byte(value), []byte(state)) != 1 {
+		a.renderLogin(w, http.StatusBadRequest, "Invalid sign in state; please start again")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		a.renderLogin(w, http.StatusUnauthorized, fmt.Sprintf("Sign in failed: %v", e))
+		return
+	}
+	email, err := a.OIDC.exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		log.WarnContext(r.Context(), "OIDC sign in failed", "remote", r.RemoteAddr, "error", err)
+		a.renderLogin(w, http.StatusForbidden, "Sign in failed")
+		return
+	}
+	log.InfoContext(r.Context(), "Admin signed in", "admin", email, "remote", r.RemoteAddr)
+	a.Cookies.SetAdminSession(w, oidcOperator+email)
+	http.Redirect(w, r, DashboardUrl, http.StatusSeeOther)
+}
+
+// ActionHandler carries out an action from the dashboard and returns to it.
+func (a *admin) ActionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		util.ErrorResponse(w, http.StatusMethodNotAllowed, fmt.Sprintf("%v not supported", r.Method))
+		return
+	}
+	who := a.operator(r)
+	if who == "" {
+		http.Redirect(w, r, DashboardUrl, http.StatusSeeOther)
+		return
+	}
+	if !a.Cookies.CheckAdminCSRF(r) {
+		util.ErrorResponse(w, http.StatusForbidden, "Invalid form token")
+		return
+	}
+	name, actor, id := r.FormValue("user"), r.FormValue("actor"), r.FormValue("id")
+	var message string
+	var err error
+	switch action := r.FormValue("action"); action {
+	case "suspend", "unsuspend":
+		err = a.Ops.Suspend(name, action == "suspend")
+		message = fmt.Sprintf("%v: %v done.", name, action)
+	case "post":
+		err = a.Ops.PostNow(name)
+		message = fmt.Sprintf("Posted for %v.", name)
+	case "drop-follower":
+		err = a.Ops.RemoveFollower(name, actor)
+		message = fmt.Sprintf("Removed %v from the followers of %v.", actor, name)
+	case "retry", "purge":
+		var n int
+		if action == "retry" {
+			n, err = a.Ops.Retry(id)
+		} else {
+			n, err = a.Ops.Purge(id)
+		}
+		message = fmt.Sprintf("%v: %v deliveries.", action, n)
+	default:
+		err = fmt.Errorf("Unknown action %q", action)
+	}
+	if err != nil {
+		message = err.Error()
+	} else {
+		log.InfoContext(r.Context(), "Admin action", "admin", who, "action", r.FormValue("action"), "user", name, "actor", actor, "id", id)
+	}
+	http.Redirect(w, r, DashboardUrl+"?"+url.Values{"message": {message}}.Encode(), http.StatusSeeOther)
+}
+
+func (a *admin) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	a.Cookies.ClearAdminSession(w)
+	http.Redirect(w, r, DashboardUrl, http.StatusFound)
+}
+
+type loginData struct {
+	Message string
+	Token   bool
+	OIDC    bool
+}
+
+type dashboardData struct {
+	Overview
+	Operator string
+	Message  string
+	CSRF     string
+}
+
+var loginTemplate = template.Must(template.New("login").Parse(`
+<html>
+  <head><title>Admin</title></head>
+  <body>
+    <h1>Admin</h1>
+    {{if .Message}}<p><em>{{.Message}}</em></p>{{end}}
+    {{if .Token}}
+    <form method="post" action="` + LoginUrl + `">
+      <label>Admin token <input type="password" name="token" autocomplete="current-password"/></label>
+      <button type="submit">Sign in</button>
+    </form>
+    {{end}}
+    {{if .OIDC}}
+    <p><a href="` + LoginUrl + `">Sign in with your identity provider</a></p>
+    {{end}}
+  </body>
+</html>
+`))
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(`
+{{define "action"}}
+<input type="hidden" name="csrf" value="{{.}}"/>
+{{end}}
+<html>
+  <head><title>Admin</title></head>
+  <body>
+    <h1>Admin</h1>
+    <p>Signed in as {{.Operator}}. <a href="` + LogoutUrl + `">Sign out</a></p>
+    {{if .Message}}<p><em>{{.Message}}</em></p>{{end}}
+
+    <h2>Users ({{len .Users}})</h2>
+    <table>
+      <tr><th>Name</th><th>Linked</th><th>Followers</th><th>Pending</th><th>Posts</th><th>Last post</th><th>State</th><th></th></tr>
+      {{range .Users}}
+      <tr>
+        <td>{{.Name}}</td>
+        <td>{{if .Linked}}yes{{else}}no{{end}}</td>
+        <td>{{.Followers}}</td>
+        <td>{{.Pending}}</td>
+        <td>{{.Posted}}</td>
+        <td>{{if .LastPost.IsZero}}-{{else}}{{.LastPost.Format "2006-01-02 15:04"}}{{end}}</td>
+        <td>{{if .Suspended}}suspended{{else if .Settings.Paused}}paused{{else}}active{{end}}{{if .MovedTo}}, moved{{end}}</td>
+        <td>
+          <form method="post" action="` + ActionUrl + `" style="display:inline">
+            {{template "action" $.CSRF}}
+            <input type="hidden" name="user" value="{{.Name}}"/>
+            <button type="submit" name="action" value="post">Post now</button>
+            {{if .Suspended}}
+            <button type="submit" name="action" value="unsuspend">Unsuspend</button>
+            {{else}}
+            <button type="submit" name="action" value="suspend">Suspend</button>
+            {{end}}
+          </form>
+        </td>
+      </tr>
+      {{end}}
+    </table>
+
+    <h3>Drop a follower</h3>
+    <form method="post" action="` + ActionUrl + `">
+      {{template "action" .CSRF}}
+      <input type="hidden" name="action" value="drop-follower"/>
+      <label>User <select name="user">{{range .Users}}<option>{{.Name}}</option>{{end}}</select></label>
+      <label>Follower <input type="url" name="actor" size="50" placeholder="https://example.com/users/someone"/></label>
+      <button type="submit">Drop</button>
+    </form>
+
+    <h2>Followers by domain</h2>
+    {{if .FollowerDomains}}
+    <table>
+      {{range .FollowerDomains}}<tr><td>{{.Domain}}</td><td>{{.Followers}}</td></tr>{{end}}
+    </table>
+    {{else}}
+    <p>No followers yet.</p>
+    {{end}}
+
+    <h2>Deliveries</h2>
+    <p>{{.Queued}} queued, {{len .Failing}} retrying, {{len .Dead}} failed.</p>
+    {{if or .Failing .Dead}}
+    <form method="post" action="` + ActionUrl + `">
+      {{template "action" .CSRF}}
+      <button type="submit" name="action" value="retry">Retry all failed</button>
+      <button type="submit" name="action" value="purge">Purge all failed</button>
+    </form>
+    <table>
+      <tr><th>State</th><th>User</th><th>Recipient</th><th>Attempts</th><th>Last error</th><th></th></tr>
+      {{range .Failing}}
+      <tr>
+        <td>retrying</td><td>{{.User}}</td><td>{{.Actor}}</td><td>{{.Attempts}}</td><td>{{.LastError}}</td>
+        <td>
+          <form method="post" action="` + ActionUrl + `" style="display:inline">
+            {{template "action" $.CSRF}}
+            <input type="hidden" name="id" value="{{.ID}}"/>
+            <button type="submit" name="action" value="retry">Retry now</button>
+            <button type="submit" name="action" value="purge">Purge</button>
+          </form>
+        </td>
+      </tr>
+      {{end}}
+      {{range .Dead}}
+      <tr>
+        <td>failed</td><td>{{.User}}</td><td>{{.Actor}}</td><td>{{.Attempts}}</td><td>{{.LastError}}</td>
+        <td>
+          <form method="post" action="` + ActionUrl + `" style="display:inline">
+            {{template "action" $.CSRF}}
+            <input type="hidden" name="id" value="{{.ID}}"/>
+            <button type="submit" name="action" value="retry">Retry</button>
+            <button type="submit" name="action" value="purge">Purge</button>
+          </form>
+        </td>
+      </tr>
+      {{end}}
+    </table>
+    {{end}}
+
+    <h2>Recent inbox activity</h2>
+    {{if .Inbox}}
+    <table>
+      <tr><th>Received</th><th>To</th><th>From</th><th>Type</th><th>Object</th><th>Result</th></tr>
+      {{range .Inbox}}
+      <tr>
+        <td>{{.Received.Format "2006-01-02 15:04:05"}}</td>
+        <td>{{if .User}}{{.User}}{{else}}(instance){{end}}</td>
+        <td>{{.Actor}}</td><td>{{.Type}}</td><td>{{.Object}}</td><td>{{.Result}}</td>
+      </tr>
+      {{end}}
+    </table>
+    {{else}}
+    <p>Nothing received since the server started.</p>
+    {{end}}
+
+    <h2>Moderation</h2>
+    <h3>Domain blocks ({{len .InstanceBlocks}})</h3>
+    {{if .InstanceBlocks}}
+    <table>
+      {{range .InstanceBlocks}}<tr><td>{{.Domain}}</td><td>{{.Severity}}</td><td>{{.Comment}}</td></tr>{{end}}
+    </table>
+    {{end}}
+    <h3>Allowlist</h3>
+    {{if .Allowlist}}
+    <ul>{{range .Allowlist}}<li>{{.}}</li>{{end}}</ul>
+    {{else}}
+    <p>Not in allowlist mode; every domain that is not blocked federates.</p>
+    {{end}}
+
+    <h2>Relays</h2>
+    {{if .Relays}}
+    <table>
+      {{range .Relays}}<tr><td>{{.Url}}</td><td>{{.State}}</td></tr>{{end}}
+    </table>
+    {{else}}
+    <p>No relays.</p>
+    {{end}}
+  </body>
+</html>
+`))
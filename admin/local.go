@@ -0,0 +1,141 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/ml8/ap-bot/activitypub"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/util"
+)
+
+// local carries out operations in this process: in the server, or against
+// the store when the server is stopped.
+type local struct {
+	ActivityPub activitypub.ActivityPub
+	Moderation  moderation.Moderation
+	States      map[string]string // state name -> file the state is persisted as
+}
+
+func NewLocal(ap activitypub.ActivityPub, mod moderation.Moderation, states map[string]string) Ops {
+	return &local{ActivityPub: ap, Moderation: mod, States: states}
+}
+
+func (l *local) Users() ([]activitypub.UserInfo, error) {
+	return l.ActivityPub.ListUsers(), nil
+}
+
+func (l *local) User(name string) (activitypub.UserInfo, error) {
+	return l.ActivityPub.UserInfo(name)
+}
+
+func (l *local) DeleteUser(name string) error {
+	if _, err := l.ActivityPub.UserInfo(name); err != nil {
+		return err
+	}
+	return l.ActivityPub.DeleteUser(name)
+}
+
+func (l *local) Pause(name string, paused bool) error {
+	if _, err := l.ActivityPub.UserInfo(name); err != nil {
+		return err
+	}
+	settings, err := l.ActivityPub.Settings(name)
+	if err != nil {
+		return err
+	}
+	settings.Paused = paused
+	return l.ActivityPub.UpdateSettings(name, settings)
+}
+
+func (l *local) Suspend(name string, suspended bool) error {
+	return l.ActivityPub.Suspend(name, suspended)
+}
+
+func (l *local) Followers(name string) ([]string, error) {
+	if _, err := l.ActivityPub.UserInfo(name); err != nil {
+		return nil, err
+	}
+	return l.ActivityPub.Followers(name), nil
+}
+
+func (l *local) RemoveFollower(name, actor string) error {
+	return l.ActivityPub.RemoveFollower(name, actor)
+}
+
+func (l *local) PostNow(name string) error {
+	return l.ActivityPub.PostNow(name)
+}
+
+func (l *local) Queue() (Queue, error) {
+	queued, dead := l.ActivityPub.Queue()
+	return Queue{Queued: queued, Dead: dead}, nil
+}
+
+func (l *local) Retry(id string) (int, error) {
+	return l.ActivityPub.RetryDeliveries(id), nil
+}
+
+func (l *local) Purge(id string) (int, error) {
+	return l.ActivityPub.PurgeDeliveries(id), nil
+}
+
+func (l *local) RotateKey(name string, ed25519 bool) error {
+	return l.ActivityPub.RotateKey(name, ed25519)
+}
+
+func (l *local) Export() (State, error) {
+	state := make(State)
+	for name, fname := range l.States {
+		entries := make(map[string]json.RawMessage)
+		if err := util.NewPersister(fname).Read(&entries); err != nil {
+			return nil, fmt.Errorf("Error reading %v: %v", name, err)
+		}
+		state[name] = entries
+	}
+	return state, nil
+}
+
+// Import replaces the stored state of each component in state. Components in
+// memory are not updated, so the server must not be running.
+func (l *local) Import(state State) error {
+	for name := range state {
+		if _, ok := l.States[name]; !ok {
+			return fmt.Errorf("Unknown state %q", name)
+		}
+	}
+	for name, entries := range state {
+		if err := util.NewPersister(l.States[name]).Write(entries); err != nil {
+			return fmt.Errorf("Error writing %v: %v", name, err)
+		}
+		log.Info("Imported state", "entries", len(entries), "state", name)
+	}
+	return nil
+}
+
+func (l *local) Overview() (Overview, error) {
+	o := Overview{
+		Users:          l.ActivityPub.ListUsers(),
+		Inbox:          l.ActivityPub.RecentInbox(),
+		InstanceBlocks: l.Moderation.InstanceBlocks(),
+		Allowlist:      l.Moderation.Allowlist(),
+		Relays:         l.ActivityPub.Relays(),
+	}
+	for domain, n := range l.ActivityPub.FollowerDomains() {
+		o.FollowerDomains = append(o.FollowerDomains, DomainCount{Domain: domain, Followers: n})
+	}
+	sort.Slice(o.FollowerDomains, func(i, j int) bool {
+		a, b := o.FollowerDomains[i], o.FollowerDomains[j]
+		return a.Followers > b.Followers || a.Followers == b.Followers && a.Domain < b.Domain
+	})
+	queued, dead := l.ActivityPub.Queue()
+	o.Queued = len(queued)
+	for _, dl := range queued {
+		if dl.Attempts > 0 {
+			o.Failing = append(o.Failing, dl)
+		}
+	}
+	o.Dead = dead
+	return o, nil
+}
@@ -0,0 +1,169 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slices"
+)
+
+const (
+	OIDCStateCookie = "admin_oidc_state"
+	OIDCStateTTL    = 10 * time.Minute
+	discoveryPath   = "/.well-known/openid-configuration"
+	maxOIDCResponse = 1 << 20
+	oidcTimeout     = 30 * time.Second
+)
+
+// OIDCConfig lets operators sign in to the dashboard with an OpenID Connect
+// provider. Only the listed, verified email addresses are admitted.
+type OIDCConfig struct {
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	RedirectUrl  string // the OIDC callback of this server
+	Admins       []string
+	TrustEmail   bool // admit addresses whose email_verified claim is missing
+}
+
+type providerMetadata struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+}
+
+type oidc struct {
+	sync.Mutex
+	Config   OIDCConfig
+	Provider *providerMetadata // protected by mutex; discovered on first use
+	Client   http.Client
+}
+
+func (o *oidc) getJSON(req *http.Request, v interface{}) error {
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxOIDCResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%v %v: %v", req.Method, req.URL, resp.Status)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// provider returns the endpoints of the issuer, discovering them if need be.
+func (o *oidc) provider() (*providerMetadata, error) {
+	o.Lock()
+	defer o.Unlock()
+	if o.Provider != nil {
+		return o.Provider, nil
+	}
+	req, err := http.NewRequest("GET", strings.TrimSuffix(o.Config.Issuer, "/")+discoveryPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	md := &providerMetadata{}
+	if err := o.getJSON(req, md); err != nil {
+		return nil, fmt.Errorf("Error discovering %v: %v", o.Config.Issuer, err)
+	}
+	if md.AuthorizationEndpoint == "" || md.TokenEndpoint == "" || md.UserinfoEndpoint == "" {
+		return nil, fmt.Errorf("Issuer %v lacks an authorization, token or userinfo endpoint", o.Config.Issuer)
+	}
+	o.Provider = md
+	return md, nil
+}
+
+// authUrl is where the operator is sent to sign in, with state to be
+// returned to the callback.
+func (o *oidc) authUrl(state string) (string, error) {
+	md, err := o.provider()
+	if err != nil {
+		return "", err
+	}
+	q := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.Config.ClientId},
+		"redirect_uri":  {o.Config.RedirectUrl},
+		"scope":         {"openid email"},
+		"state":         {state},
+	}
+	sep := "?"
+	if strings.Contains(md.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return md.AuthorizationEndpoint + sep + q.Encode(), nil
+}
+
+// exchange trades an authorization code for the operator's email address,
+// which is returned only if it is verified and listed as an admin. The
+// address comes from the userinfo endpoint, fetched directly from the issuer
+// with the access token, so the ID token need not be verified.
+func (o *oidc) exchange(code string) (string, error) {
+	md, err := o.provider()
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type":   {"authorization_code"},
+		"code":         {code},
+		"redirect_uri": {o.Config.RedirectUrl},
+	}
+	req, err := http.NewRequest("POST", md.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(o.Config.ClientId), url.QueryEscape(o.Config.ClientSecret))
+	var token struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+	}
+	if err := o.getJSON(req, &token); err != nil {
+		return "", fmt.Errorf("Error redeeming code: %v", err)
+	}
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("No access token from %v", md.TokenEndpoint)
+	}
+
+	req, err = http.NewRequest("GET", md.UserinfoEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+	var info struct {
+		Email         string `json:"email"`
+		EmailVerified *bool  `json:"email_verified"`
+	}
+	if err := o.getJSON(req, &info); err != nil {
+		return "", fmt.Errorf("Error fetching user info: %v", err)
+	}
+	verified := info.EmailVerified != nil && *info.EmailVerified
+	if info.EmailVerified == nil && o.Config.TrustEmail {
+		verified = true
+	}
+	if info.Email == "" || !verified {
+		return "", fmt.Errorf("No verified email address from %v", o.Config.Issuer)
+	}
+	if !o.admitted(info.Email) {
+		log.Warn("Refused admin sign in", "email", info.Email)
+		return "", fmt.Errorf("%v is not an admin", info.Email)
+	}
+	return info.Email, nil
+}
+
+// admitted is whether email is one of the configured admins.
+func (o *oidc) admitted(email string) bool {
+	return email != "" && slices.ContainsFunc(o.Config.Admins, func(admin string) bool { return strings.EqualFold(admin, email) })
+}
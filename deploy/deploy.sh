@@ -13,5 +13,5 @@ gcloud compute instances create-with-container ${AP_VM} \
   --container-arg="-pocketAppKey=${AP_POCKET_KEY}" \
   --container-arg="-db=/disks/data-disk/state" \
   --container-arg="-postInterval=60m" \
-  --container-arg="-logtostderr"
+  --container-arg="-logLevels=info"
   
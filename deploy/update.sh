@@ -8,5 +8,5 @@ gcloud compute instances update-container ${AP_VM} \
   --container-arg="-certDir=/disks/data-disk/state" \
   --container-arg="-db=/disks/data-disk/state" \
   --container-arg="-postInterval=60m" \
-  --container-arg="-logtostderr"
+  --container-arg="-logLevels=info"
   
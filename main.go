@@ -3,38 +3,93 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	stdlog "log"
 	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
-	"golang.org/x/crypto/acme/autocert"
-
+	"github.com/ml8/ap-bot/account"
 	"github.com/ml8/ap-bot/activitypub"
+	"github.com/ml8/ap-bot/admin"
+	"github.com/ml8/ap-bot/moderation"
+	"github.com/ml8/ap-bot/notify"
 	"github.com/ml8/ap-bot/pocket"
+	"github.com/ml8/ap-bot/util"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/acme/autocert"
 )
 
+var log = util.Logger("main")
+var tracer = otel.Tracer("github.com/ml8/ap-bot")
+
 var (
 	// Flags
-	port         = flag.String("port", ":8080", "port to listen on")
-	certDir      = flag.String("certDir", ".", "directory for certificate storage")
-	prod         = flag.Bool("prod", false, "whether to run in production mode")
-	domain       = flag.String("domain", "hq.jerry.business", "domain for TLS")
-	silent       = flag.Bool("silent", false, "whether to silence library logging")
-	pocketAppKey = flag.String("pocketAppKey", "", "application key for pocket")
-	initUser     = flag.String("initUser", "", "bootstrap user for testing")
-	initTok      = flag.String("initTok", "", "bootstrap token for testing")
-	db           = flag.String("db", "", "file-backed store path")
-	postInterval = flag.String("postInterval", "1m", "periodic posting interval")
+	port               = flag.String("port", ":8080", "port to listen on")
+	certDir            = flag.String("certDir", ".", "directory for certificate storage")
+	prod               = flag.Bool("prod", false, "whether to run in production mode")
+	domain             = flag.String("domain", "hq.jerry.business", "domain for TLS")
+	silent             = flag.Bool("silent", false, "whether to silence library logging")
+	logLevels          = flag.String("logLevels", "info", "log levels: a default, then subsystem=level overrides, e.g. warn,activitypub=debug")
+	pocketAppKey       = flag.String("pocketAppKey", "", "application key for pocket")
+	initUser           = flag.String("initUser", "", "bootstrap user for testing")
+	initTok            = flag.String("initTok", "", "bootstrap token for testing")
+	db                 = flag.String("db", "", "file-backed store path")
+	masterKey          = flag.String("masterKey", "", "file of master keys (id:base64key, newest first) sealing secrets at rest; $AP_MASTER_KEY overrides")
+	genMasterKey       = flag.String("genMasterKey", "", "print a new master key entry with this id and exit")
+	store              = flag.String("store", "json", "state backend under -db: json files, or bolt (imports the json files on first use)")
+	postInterval       = flag.String("postInterval", "1m", "periodic posting interval")
+	domainBlocks       = flag.String("domainBlocks", "", "mastodon domain block CSV to import at startup")
+	allowDomains       = flag.String("allowDomains", "", "comma-separated allowlist; if set, only these domains federate")
+	mediaDir           = flag.String("mediaDir", "", "directory for uploaded images (default: <db>/media)")
+	requireSignedFetch = flag.Bool("requireSignedFetch", false, "whether GETs of actors and collections must be signed; browsers then get a limited profile page and no RSS feed")
+	relays             = flag.String("relays", "", "comma-separated relays for the instance actor to subscribe to")
+	smtpAddr           = flag.String("smtpAddr", "", "SMTP server (host:port) for email notifications")
+	smtpUser           = flag.String("smtpUser", "", "SMTP username")
+	smtpPassword       = flag.String("smtpPassword", os.Getenv("SMTP_PASSWORD"), "SMTP password (default: $SMTP_PASSWORD)")
+	smtpFrom           = flag.String("smtpFrom", "", "sender address for email notifications")
+	adminTokenFlag     = flag.String("adminToken", os.Getenv("AP_ADMIN_TOKEN"), "token for the admin API (default: $AP_ADMIN_TOKEN, or one kept under -db)")
+	adminUrl           = flag.String("adminUrl", "", "where admin commands reach the running server (default: the site url)")
+	oidcIssuer         = flag.String("oidcIssuer", "", "OpenID Connect issuer for signing in to the admin dashboard")
+	oidcClientId       = flag.String("oidcClientId", "", "OpenID Connect client id")
+	oidcClientSecret   = flag.String("oidcClientSecret", os.Getenv("OIDC_CLIENT_SECRET"), "OpenID Connect client secret (default: $OIDC_CLIENT_SECRET)")
+	oidcAdmins         = flag.String("oidcAdmins", "", "comma-separated email addresses admitted to the admin dashboard through OIDC")
+	oidcTrustEmail     = flag.Bool("oidcTrustEmail", false, "admit OIDC sign ins whose email_verified claim is missing, for providers that only hand out verified addresses")
+	traceExporter      = flag.String("trace", "", "export traces: otlp, or stdout for local debugging (default: off)")
+	otlpEndpoint       = flag.String("otlpEndpoint", "", "OTLP/HTTP traces url (default: $OTEL_EXPORTER_OTLP_ENDPOINT, or localhost:4318)")
+	traceSampleRatio   = flag.Float64("traceSampleRatio", 1, "fraction of new traces to sample")
 )
 
 const (
 	pocketDbFile      = "pocket.json"
 	activitypubDbFile = "activitypub.json"
+	moderationDbFile  = "moderation.json"
+	deliveriesDbFile  = "deliveries.json"
+	notifyDbFile      = "notifications.json"
+	relaysDbFile      = "relays.json"
+	storeDbFile       = "ap-bot.db"
+	cookieKeyFile     = "cookie.key"
+	instanceKeyFile   = "instance.key"
+	adminTokenFile    = "admin.token"
+	metricsUrl        = "/metrics"
+	healthzUrl        = "/healthz"
+	readyzUrl         = "/readyz"
+	mediaDirName      = "media"
+	requestIdHeader   = "X-Request-Id"
+	requestIdLen      = 12
+	maxRequestIdLen   = 64
 	signupSrc         = `
 <html>
   <head>
@@ -45,7 +100,7 @@ const (
           cur = cur + "/";
         }
         const url = cur + 
-          document.getElementById("username").value;
+          encodeURIComponent(document.getElementById("username").value);
         console.log(url);
         window.open(url, "_self");
       }
@@ -89,48 +144,501 @@ func activitypubDb() string {
 	return *db + "/" + activitypubDbFile
 }
 
+func deliveriesDb() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + deliveriesDbFile
+}
+
+func moderationDb() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + moderationDbFile
+}
+
+func relaysDb() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + relaysDbFile
+}
+
+func notifyDb() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + notifyDbFile
+}
+
+func cookieKey() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + cookieKeyFile
+}
+
+func instanceKey() string {
+	if *db == "" {
+		return ""
+	}
+	return *db + "/" + instanceKeyFile
+}
+
+func media() string {
+	if *mediaDir != "" {
+		return *mediaDir
+	}
+	if *db == "" {
+		return os.TempDir() + "/ap-bot-" + mediaDirName
+	}
+	return *db + "/" + mediaDirName
+}
+
+// Health is the answer to health checks: "ok" or "unavailable", with the
+// result of each check.
+type Health struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// healthz answers as long as the server is serving.
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	util.JsonResponse(w, http.StatusOK, Health{Status: "ok"})
+}
+
+// readyz answers whether the server can do its work: state can be saved and
+// deliveries are going out.
+func readyz(ap activitypub.ActivityPub) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		checks := map[string]func() error{
+			"store":    func() error { return util.CheckWritable(*db) },
+			"delivery": ap.DeliveryWorkerAlive,
+		}
+		health := Health{Status: "ok", Checks: make(map[string]string)}
+		status := http.StatusOK
+		for name, check := range checks {
+			health.Checks[name] = "ok"
+			if err := check(); err != nil {
+				log.Warn("Readiness check failed", "check", name, "error", err)
+				health.Checks[name] = err.Error()
+				health.Status = "unavailable"
+				status = http.StatusServiceUnavailable
+			}
+		}
+		util.JsonResponse(w, status, health)
+	}
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	Status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// requestId is the id of r: the one it came with, from a proxy in front of
+// us, if it is sane, or a new one.
+func requestId(r *http.Request) string {
+	id := r.Header.Get(requestIdHeader)
+	if id == "" || len(id) > maxRequestIdLen || strings.ContainsFunc(id, func(c rune) bool {
+		return !(c == '-' || c == '_' || c == '.' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z')
+	}) {
+		return util.RandomToken(requestIdLen)
+	}
+	return id
+}
+
+// tracing runs each request in a span named after its route, continuing the
+// caller's trace if it sent one.
+func tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				name = tmpl
+			}
+		}
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+name, trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attribute.String("http.request.method", r.Method), attribute.String("http.route", name),
+				attribute.String("url.path", r.URL.Path), attribute.String("client.address", r.RemoteAddr)))
+		defer span.End()
+		sw := &statusWriter{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", sw.Status))
+		if sw.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.Status))
+		}
+	})
+}
+
+// logger tags each request with an id, which is logged with everything done
+// for it and returned to the client, and logs the request once answered.
 func logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		glog.Infof("%s - %s (%s)", r.Method, r.URL.Path, r.RemoteAddr)
-		next.ServeHTTP(w, r)
+		start := time.Now()
+		id := requestId(r)
+		w.Header().Set(requestIdHeader, id)
+		r = r.WithContext(util.WithRequestId(r.Context(), id))
+		sw := &statusWriter{ResponseWriter: w, Status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+		log.InfoContext(r.Context(), "Request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr,
+			"status", sw.Status, "duration", time.Since(start))
 	})
 }
 
-func main() {
-	flag.Parse()
+// bridge holds the components that make up the service.
+type bridge struct {
+	Cookies     *util.CookieSigner
+	Pocket      pocket.Pocket
+	Moderation  moderation.Moderation
+	Notifier    notify.Notifier
+	ActivityPub activitypub.ActivityPub
+	Store       *util.BoltStore // nil unless -store bolt
+}
 
-	if *silent {
-		glog.Info("Silence system logging, application logging only...")
-		log.SetOutput(io.Discard)
+func (b *bridge) Close() {
+	if b.Store != nil {
+		b.Store.Close()
+	}
+}
+
+// stateFiles maps the name of each component's state to its file.
+func stateFiles() map[string]string {
+	states := make(map[string]string)
+	for _, f := range []string{pocketDb(), activitypubDb(), moderationDb(), deliveriesDb(), notifyDb(), relaysDb()} {
+		if f != "" {
+			states[util.StoreName(f)] = f
+		}
+	}
+	return states
+}
+
+// adminToken is the token for the admin API, from -adminToken or the token
+// file under -db. Without either the API is disabled.
+func adminToken() string {
+	if *adminTokenFlag != "" {
+		return *adminTokenFlag
 	}
+	if *db == "" {
+		return ""
+	}
+	return admin.LoadOrCreateToken(*db + "/" + adminTokenFile)
+}
 
-	b := &pocket.BootstrapData{Users: make(map[string]string)}
+// oidcConfig is how operators sign in to the dashboard through OIDC, or nil.
+func oidcConfig() *admin.OIDCConfig {
+	if *oidcIssuer == "" {
+		return nil
+	}
+	var admins []string
+	for _, a := range strings.Split(*oidcAdmins, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			admins = append(admins, a)
+		}
+	}
+	if *oidcClientId == "" || len(admins) == 0 {
+		util.Fatal(log, "-oidcIssuer needs -oidcClientId and -oidcAdmins")
+	}
+	return &admin.OIDCConfig{
+		Issuer:       *oidcIssuer,
+		ClientId:     *oidcClientId,
+		ClientSecret: *oidcClientSecret,
+		RedirectUrl:  urlPrefix() + admin.OIDCCallbackUrl,
+		Admins:       admins,
+		TrustEmail:   *oidcTrustEmail,
+	}
+}
+
+func adminSite() string {
+	if *adminUrl != "" {
+		return *adminUrl
+	}
+	return urlPrefix()
+}
+
+// setup recovers the state of every component, without serving anything.
+func setup() *bridge {
+	keyring, err := util.LoadKeyring(*masterKey)
+	if err != nil {
+		util.Fatal(log, "Could not load master key", "error", err)
+	}
+	util.UseKeyring(keyring)
+	util.WarnIfPlaintext()
+
+	b := &bridge{}
+	if *db != "" && *store == "bolt" {
+		s, err := util.OpenStore(*db + "/" + storeDbFile)
+		if err != nil {
+			util.Fatal(log, "Could not open store", "error", err)
+		}
+		b.Store = s
+		util.UseStore(s)
+	} else if *store != "json" && *store != "bolt" {
+		util.Fatal(log, "Unknown store", "store", *store)
+	}
+
+	b.Cookies = util.NewCookieSigner(util.LoadOrCreateKey(cookieKey()), *prod)
+
+	bootstrap := &pocket.BootstrapData{Users: make(map[string]string)}
 	if *initUser != "" {
-		b.Users[*initUser] = *initTok
+		bootstrap.Users[*initUser] = *initTok
 	}
-	p := pocket.Init(
+	b.Pocket = pocket.Init(
 		*pocketAppKey,
 		pocket.ResourceMap{
 			AppUrl: pocketUrl(),
 			Host:   *domain,
 		},
-		b,
-		pocketDb())
+		bootstrap,
+		pocketDb(),
+		b.Cookies)
+
+	b.Moderation = moderation.Init(moderationDb())
+	if *allowDomains != "" {
+		b.Moderation.SetAllowlist(strings.Split(*allowDomains, ","))
+	}
+
+	b.Notifier = notify.Init(notifyDb(), notify.SMTPConfig{
+		Addr:     *smtpAddr,
+		Username: *smtpUser,
+		Password: *smtpPassword,
+		From:     *smtpFrom,
+	})
 
 	dur, err := time.ParseDuration(*postInterval)
 	if err != nil {
-		glog.Fatalf("Could not parse duration %v: %v", *postInterval, err)
+		util.Fatal(log, "Could not parse posting interval", "interval", *postInterval, "error", err)
 	}
-	ap := activitypub.Init(
-		p,
+	b.ActivityPub = activitypub.Init(
+		b.Pocket,
 		activitypub.ResourceMap{
-			BaseUrl: apUrl(),
-			Host:    *domain,
+			BaseUrl:     apUrl(),
+			SiteUrl:     urlPrefix(),
+			Host:        *domain,
+			MediaDir:    media(),
+			InstanceKey: instanceKey(),
 		},
 		activitypubDb(),
-		dur)
+		deliveriesDb(),
+		relaysDb(),
+		dur,
+		b.Cookies,
+		b.Moderation,
+		b.Notifier)
+	b.ActivityPub.RequireSignedFetch(*requireSignedFetch)
+
+	if keyring != nil && util.PlaintextSecrets() > 0 {
+		// The stores have just been sealed; don't leave plaintext copies.
+		for _, f := range []string{pocketDb(), activitypubDb(), deliveriesDb()} {
+			if f == "" {
+				continue
+			}
+			if err := util.PurgeBackups(f); err != nil {
+				log.Error("Could not remove plaintext backups", "file", f, "error", err)
+			}
+		}
+		log.Warn("Sealed plaintext secrets", "count", util.PlaintextSecrets(), "master_key_id", keyring.Primary)
+	}
+	if keyring != nil && b.Store != nil {
+		// Files imported into the store are no longer read, and were never
+		// sealed.
+		for _, f := range []string{pocketDb(), activitypubDb(), deliveriesDb()} {
+			if f == "" {
+				continue
+			}
+			if err := b.Store.RemoveImported(util.StoreName(f), f); err != nil {
+				log.Error("Could not remove imported state file", "file", f, "error", err)
+			}
+		}
+	}
+	return b
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), admin.Usage)
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if err := util.SetLogLevels(*logLevels); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	if *silent {
+		log.Info("Silence system logging, application logging only...")
+		stdlog.SetOutput(io.Discard)
+	}
+
+	if *genMasterKey != "" {
+		fmt.Println(util.NewMasterKey(*genMasterKey))
+		return
+	}
+
+	args := flag.Args()
+	if len(args) == 0 || args[0] == "serve" {
+		serve()
+		return
+	}
+	var err error
+	switch args[0] {
+	case "migrate":
+		err = migrate(args[1:])
+	case "restore":
+		err = restore(args[1:])
+	default:
+		err = runAdmin(args)
+	}
+	var usageErr *admin.UsageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintf(os.Stderr, "%v\n\n", err)
+		flag.Usage()
+		os.Exit(2)
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// runAdmin carries out an admin command through the running server, or
+// directly against the state if there is none.
+func runAdmin(args []string) error {
+	if token := adminToken(); token != "" {
+		ops, err := admin.Dial(adminSite(), token)
+		if err == nil {
+			return admin.Run(ops, args, os.Stdout)
+		} else if err != admin.ErrNotRunning {
+			return err
+		}
+	}
+	b := setup()
+	defer b.Close()
+	return admin.Run(admin.NewLocal(b.ActivityPub, b.Moderation, stateFiles()), args, os.Stdout)
+}
+
+// migrate moves the JSON state files into the bolt store, bringing its
+// schema up to date.
+func migrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	force := fs.Bool("force", false, "import files even if they were imported before")
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return &admin.UsageError{Message: "migrate takes only -force"}
+	}
+	if *db == "" {
+		return fmt.Errorf("migrate needs -db")
+	}
+	if token := adminToken(); token != "" {
+		if _, err := admin.Dial(adminSite(), token); err != admin.ErrNotRunning {
+			return fmt.Errorf("Stop the server before migrating")
+		}
+	}
+	s, err := util.OpenStore(*db + "/" + storeDbFile)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	version, err := s.Version()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Store %v is at schema version %v\n", *db+"/"+storeDbFile, version)
+	states := stateFiles()
+	names := make([]string, 0, len(states))
+	for name := range states {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := states[name]
+		if _, err := os.Stat(f); os.IsNotExist(err) {
+			continue
+		}
+		n, err := s.Import(name, f, *force)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			fmt.Printf("%v: nothing imported\n", name)
+		} else {
+			fmt.Printf("%v: imported %v entries from %v\n", name, n, f)
+		}
+	}
+	fmt.Println("Run the server with -store bolt to use the store.")
+	return nil
+}
+
+// restore replaces a component's JSON state file with one of its backups.
+func restore(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return &admin.UsageError{Message: "restore takes <state> [n]"}
+	}
+	n := 1
+	if len(args) == 2 {
+		var err error
+		if n, err = strconv.Atoi(args[1]); err != nil || n < 1 || n > util.PersistBackups {
+			return &admin.UsageError{Message: fmt.Sprintf("Backups are numbered 1 to %v", util.PersistBackups)}
+		}
+	}
+	if *store != "json" {
+		return fmt.Errorf("restore works on JSON state; the bolt store keeps no backups")
+	}
+	f, ok := stateFiles()[args[0]]
+	if !ok {
+		return fmt.Errorf("No state %q under -db", args[0])
+	}
+	if token := adminToken(); token != "" {
+		if _, err := admin.Dial(adminSite(), token); err != admin.ErrNotRunning {
+			return fmt.Errorf("Stop the server before restoring")
+		}
+	}
+	if err := util.RestoreBackup(f, n); err != nil {
+		return err
+	}
+	fmt.Printf("%v: restored backup %v; the replaced file is %v.bad\n", args[0], n, f)
+	return nil
+}
+
+// serve runs the server until it fails.
+func serve() {
+	b := setup()
+	defer b.Close()
+	p, mod, n, ap, cookies := b.Pocket, b.Moderation, b.Notifier, b.ActivityPub, b.Cookies
+
+	// Imported after activitypub is listening for blocks, so that existing
+	// followers are purged.
+	if *domainBlocks != "" {
+		data, err := os.ReadFile(*domainBlocks)
+		if err != nil {
+			util.Fatal(log, "Could not read domain blocks", "file", *domainBlocks, "error", err)
+		}
+		n, err := mod.ImportCSV(string(data))
+		if err != nil {
+			util.Fatal(log, "Could not import domain blocks", "file", *domainBlocks, "error", err)
+		}
+		log.Info("Imported domain blocks", "count", n)
+	}
+
+	acct := account.Init(p, ap, mod, n, cookies, *domain)
+	adm := admin.Init(admin.NewLocal(ap, mod, stateFiles()), adminToken(), cookies, oidcConfig())
+
+	shutdown, err := util.InitTracing(context.Background(), *traceExporter, *otlpEndpoint, *traceSampleRatio)
+	if err != nil {
+		util.Fatal(log, "Could not set up tracing", "error", err)
+	}
+	defer shutdown(context.Background())
 
 	r := mux.NewRouter()
+	// Traced first, so that request logs carry the trace id.
+	r.Use(tracing)
 	r.Use(logger)
 
 	// GET routes
@@ -143,10 +651,47 @@ func main() {
 	routes["/pocket"+pocket.ArticleUrlTemplate] = p.ArticleHandler
 	routes["/activitypub"+activitypub.ActorUrlTemplate] = ap.ActorHandler
 	routes["/activitypub"+activitypub.ActorCollectionUrlTemplate] = ap.CollectionHandler
+	routes["/activitypub"+activitypub.PostUrlTemplate] = ap.PostHandler
+	routes["/activitypub"+activitypub.PostCollectionUrlTemplate] = ap.PostCollectionHandler
+	routes["/activitypub"+activitypub.MediaUrlTemplate] = ap.MediaHandler
+	routes["/activitypub"+activitypub.InstanceActorUrl] = ap.InstanceActorHandler
+	routes["/activitypub"+activitypub.InstanceInboxUrl] = ap.InstanceInboxHandler
+	routes["/activitypub"+activitypub.RelayAnnounceUrlTemplate] = ap.RelayAnnounceHandler
 	routes[activitypub.WebFingerUrl] = ap.WebFingerHandler
+	routes[activitypub.NodeInfoWellKnownUrl] = ap.NodeInfoWellKnownHandler
+	routes[activitypub.NodeInfoUrlTemplate] = ap.NodeInfoHandler
+	routes[activitypub.HostMetaUrl] = ap.HostMetaHandler
+	routes[activitypub.HostMetaJsonUrl] = ap.HostMetaJsonHandler
+	routes[account.AccountUrl] = acct.PageHandler
+	routes[account.SettingsUrl] = acct.SettingsHandler
+	routes[account.ProfileUrl] = acct.ProfileHandler
+	routes[account.FollowRequestUrl] = acct.FollowRequestHandler
+	routes[account.BlocksUrl] = acct.BlocksHandler
+	routes[account.MigrationUrl] = acct.MigrationHandler
+	routes[account.NotificationsUrl] = acct.NotificationsHandler
+	routes[account.KeysUrl] = acct.KeysHandler
+	routes[account.DeleteUrl] = acct.DeleteHandler
+	routes[account.LogoutUrl] = acct.LogoutHandler
+	routes[admin.StatusUrl] = adm.StatusHandler
+	routes[admin.UsersUrl] = adm.UsersHandler
+	routes[admin.UserUrlTemplate] = adm.UserHandler
+	routes[admin.UserActionUrlTemplate] = adm.UserActionHandler
+	routes[admin.FollowersUrlTemplate] = adm.FollowersHandler
+	routes[admin.QueueUrl] = adm.QueueHandler
+	routes[admin.QueueActionUrlTemplate] = adm.QueueActionHandler
+	routes[admin.ExportUrl] = adm.ExportHandler
+	routes[admin.OverviewUrl] = adm.OverviewHandler
+	routes[admin.DashboardUrl] = adm.DashboardHandler
+	routes[admin.LoginUrl] = adm.LoginHandler
+	routes[admin.OIDCCallbackUrl] = adm.OIDCCallbackHandler
+	routes[admin.ActionUrl] = adm.ActionHandler
+	routes[admin.LogoutUrl] = adm.LogoutHandler
+	routes[metricsUrl] = promhttp.Handler().ServeHTTP
+	routes[healthzUrl] = healthz
+	routes[readyzUrl] = readyz(ap)
 
 	for u, h := range routes {
-		glog.Infof("Registering %v", u)
+		log.Debug("Registering route", "route", u)
 		r.Handle(u, h)
 	}
 
@@ -154,16 +699,34 @@ func main() {
 	r.NotFoundHandler = r.NewRoute().HandlerFunc(http.NotFound).GetHandler()
 
 	ap.Start()
+	n.Start()
+
+	if *relays != "" {
+		go func() {
+			subscribed := make(map[string]bool)
+			for _, relay := range ap.Relays() {
+				subscribed[relay.Url] = true
+			}
+			for _, relay := range strings.Split(*relays, ",") {
+				if relay = strings.TrimSpace(relay); relay == "" || subscribed[relay] {
+					continue
+				}
+				if err := ap.Subscribe(relay); err != nil {
+					log.Error("Could not subscribe to relay", "relay", relay, "error", err)
+				}
+			}
+		}()
+	}
 
 	if !*prod {
-		glog.Infof("Listening on %v", *port)
+		log.Info("Listening", "port", *port)
 		http.ListenAndServe(*port, r)
 	} else {
 		certManager := autocert.Manager{
 			Prompt: autocert.AcceptTOS,
 			HostPolicy: func(ctx context.Context, host string) error {
 				allowedHost := *domain
-				glog.Infof("Host: %v", host)
+				log.Info("Certificate requested", "host", host)
 				if host == allowedHost {
 					return nil
 				}
@@ -178,8 +741,8 @@ func main() {
 				GetCertificate: certManager.GetCertificate,
 			},
 		}
-		glog.Infof("Listening...")
+		log.Info("Listening", "port", server.Addr)
 		go http.ListenAndServe(":80", certManager.HTTPHandler(nil))
-		glog.Fatal(server.ListenAndServeTLS("", ""))
+		util.Fatal(log, "Server failed", "error", server.ListenAndServeTLS("", ""))
 	}
 }
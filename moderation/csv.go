@@ -0,0 +1,67 @@
+package moderation
+
+import (
+	"encoding/csv"
+	"fmt"
+	"strings"
+)
+
+// ImportCSV adds the blocks in a mastodon domain block export, e.g.
+//
+//	#domain,#severity,#reject_media,#reject_reports,#public_comment,#obfuscate
+//	bad.example,suspend,false,false,Spam,false
+//
+// Older exports omit the leading '#' on column names.
+func (m *moderation) ImportCSV(data string) (int, error) {
+	r := csv.NewReader(strings.NewReader(data))
+	r.FieldsPerRecord = -1
+	records, err := r.ReadAll()
+	if err != nil {
+		return 0, fmt.Errorf("Error parsing domain blocks: %v", err)
+	}
+	if len(records) == 0 {
+		return 0, nil
+	}
+	columns := map[string]int{}
+	for i, name := range records[0] {
+		columns[strings.TrimPrefix(strings.TrimSpace(name), "#")] = i
+	}
+	domainCol, ok := columns["domain"]
+	if !ok {
+		return 0, fmt.Errorf("Domain blocks have no domain column")
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	var suspended []string
+	n := 0
+	m.Lock()
+	for _, record := range records[1:] {
+		if domainCol >= len(record) {
+			continue
+		}
+		severity := Severity(field(record, "severity"))
+		if severity == "" {
+			severity = Suspend
+		}
+		s, err := m.addInstanceBlock(record[domainCol], severity, field(record, "public_comment"))
+		if err != nil {
+			log.Warn("Skipping domain block", "record", record, "error", err)
+			continue
+		}
+		if s {
+			suspended = append(suspended, Domain(record[domainCol]))
+		}
+		n += 1
+	}
+	m.Persist()
+	m.Unlock()
+	for _, domain := range suspended {
+		m.notify("", domain)
+	}
+	return n, nil
+}
@@ -0,0 +1,310 @@
+// Domain-level moderation: instance-wide and per-user blocks and allowlists.
+package moderation
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+var log = util.Logger("moderation")
+
+type Severity string
+
+const (
+	// Accept follows only with the owner's approval.
+	Silence Severity = "silence"
+	// Neither accept nor deliver anything.
+	Suspend Severity = "suspend"
+	// Recorded, but without effect (mastodon's "noop").
+	Noop Severity = "noop"
+)
+
+type Decision int
+
+const (
+	Allow Decision = iota
+	Silenced
+	Suspended
+)
+
+type DomainBlock struct {
+	Domain   string    `json:"domain"`
+	Severity Severity  `json:"severity"`
+	Comment  string    `json:"comment,omitempty"`
+	Created  time.Time `json:"created"`
+}
+
+// BlockListener is told about new suspensions so that existing followers from
+// the domain can be removed. user is empty for instance-wide blocks.
+type BlockListener func(user, domain string)
+
+type Moderation interface {
+	// Check returns how activity from or to actor should be treated for user.
+	Check(user, actor string) Decision
+	Blocked(user, actor string) bool
+
+	InstanceBlocks() []DomainBlock
+	BlockInstance(domain string, severity Severity, comment string) error
+	UnblockInstance(domain string)
+	ImportCSV(csv string) (int, error)
+
+	Allowlist() []string
+	SetAllowlist(domains []string)
+
+	UserBlocks(user string) []DomainBlock
+	BlockForUser(user, domain string) error
+	UnblockForUser(user, domain string)
+	DeleteUser(user string)
+
+	OnBlock(listener BlockListener)
+}
+
+type state struct {
+	Instance  map[string]DomainBlock            `json:"instance,omitempty"`
+	Users     map[string]map[string]DomainBlock `json:"users,omitempty"`
+	Allowlist []string                          `json:"allowlist,omitempty"` // if set, only these domains federate
+}
+
+type moderation struct {
+	sync.Mutex
+	State          state // protected by mutex
+	Listeners      []BlockListener
+	StateInterface util.Persister
+}
+
+func Init(statefile string) Moderation {
+	m := &moderation{
+		State: state{
+			Instance: make(map[string]DomainBlock),
+			Users:    make(map[string]map[string]DomainBlock),
+		},
+		StateInterface: util.NewPersister(statefile),
+	}
+	m.Recover()
+	return m
+}
+
+func (m *moderation) Recover() {
+	// Requires mutex
+	if err := m.StateInterface.Read(&m.State); err != nil {
+		util.Fatal(log, "Could not recover moderation state", "error", err)
+	}
+	if m.State.Instance == nil {
+		m.State.Instance = make(map[string]DomainBlock)
+	}
+	if m.State.Users == nil {
+		m.State.Users = make(map[string]map[string]DomainBlock)
+	}
+	log.Info("Recovered moderation state", "instance_blocks", len(m.State.Instance))
+}
+
+func (m *moderation) Persist() {
+	// Requires mutex
+	if err := m.StateInterface.Write(m.State); err != nil {
+		log.Error("Error persisting moderation state", "error", err)
+	}
+}
+
+// Domain returns the normalized host of an actor IRI or bare domain.
+func Domain(s string) string {
+	if u, err := url.Parse(s); err == nil && u.Host != "" {
+		return strings.ToLower(u.Hostname())
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), ".")
+}
+
+// InDomain reports whether actor belongs to domain or one of its subdomains.
+func InDomain(actor, domain string) bool {
+	return matches([]string{Domain(domain)}, Domain(actor))
+}
+
+// lookup finds the block covering domain or any of its parent domains.
+func lookup(blocks map[string]DomainBlock, domain string) (DomainBlock, bool) {
+	for d := domain; d != ""; {
+		if b, ok := blocks[d]; ok {
+			return b, true
+		}
+		idx := strings.Index(d, ".")
+		if idx < 0 {
+			break
+		}
+		d = d[idx+1:]
+	}
+	return DomainBlock{}, false
+}
+
+func matches(domains []string, domain string) bool {
+	for _, d := range domains {
+		if domain == d || strings.HasSuffix(domain, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *moderation) Check(user, actor string) Decision {
+	domain := Domain(actor)
+	m.Lock()
+	defer m.Unlock()
+	if len(m.State.Allowlist) > 0 && !matches(m.State.Allowlist, domain) {
+		return Suspended
+	}
+	if _, ok := lookup(m.State.Users[user], domain); ok {
+		return Suspended
+	}
+	if b, ok := lookup(m.State.Instance, domain); ok {
+		switch b.Severity {
+		case Suspend:
+			return Suspended
+		case Silence:
+			return Silenced
+		}
+	}
+	return Allow
+}
+
+func (m *moderation) Blocked(user, actor string) bool {
+	return m.Check(user, actor) == Suspended
+}
+
+func sorted(blocks map[string]DomainBlock) []DomainBlock {
+	var list []DomainBlock
+	for _, b := range blocks {
+		list = append(list, b)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Domain < list[j].Domain })
+	return list
+}
+
+func (m *moderation) InstanceBlocks() []DomainBlock {
+	m.Lock()
+	defer m.Unlock()
+	return sorted(m.State.Instance)
+}
+
+func (m *moderation) UserBlocks(user string) []DomainBlock {
+	m.Lock()
+	defer m.Unlock()
+	return sorted(m.State.Users[user])
+}
+
+func (m *moderation) notify(user, domain string) {
+	m.Lock()
+	listeners := m.Listeners
+	m.Unlock()
+	for _, l := range listeners {
+		l(user, domain)
+	}
+}
+
+// addInstanceBlock reports whether domain was newly suspended.
+func (m *moderation) addInstanceBlock(domain string, severity Severity, comment string) (bool, error) {
+	// Requires mutex
+	domain = Domain(domain)
+	if domain == "" {
+		return false, fmt.Errorf("Empty domain")
+	}
+	switch severity {
+	case Suspend, Silence, Noop:
+	default:
+		return false, fmt.Errorf("Unknown severity %v", severity)
+	}
+	old, existed := m.State.Instance[domain]
+	m.State.Instance[domain] = DomainBlock{
+		Domain:   domain,
+		Severity: severity,
+		Comment:  comment,
+		Created:  time.Now(),
+	}
+	log.Info("Blocked instance", "domain", domain, "severity", severity)
+	return severity == Suspend && (!existed || old.Severity != Suspend), nil
+}
+
+func (m *moderation) BlockInstance(domain string, severity Severity, comment string) error {
+	m.Lock()
+	suspended, err := m.addInstanceBlock(domain, severity, comment)
+	if err == nil {
+		m.Persist()
+	}
+	m.Unlock()
+	if suspended {
+		m.notify("", Domain(domain))
+	}
+	return err
+}
+
+func (m *moderation) UnblockInstance(domain string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.State.Instance, Domain(domain))
+	m.Persist()
+	log.Info("Unblocked instance", "domain", domain)
+}
+
+func (m *moderation) Allowlist() []string {
+	m.Lock()
+	defer m.Unlock()
+	return append([]string(nil), m.State.Allowlist...)
+}
+
+func (m *moderation) SetAllowlist(domains []string) {
+	var list []string
+	for _, d := range domains {
+		if d = Domain(d); d != "" {
+			list = append(list, d)
+		}
+	}
+	m.Lock()
+	m.State.Allowlist = list
+	m.Persist()
+	m.Unlock()
+	log.Info("Allowlist set", "domains", list)
+}
+
+func (m *moderation) BlockForUser(user, domain string) error {
+	domain = Domain(domain)
+	if domain == "" {
+		return fmt.Errorf("Empty domain")
+	}
+	m.Lock()
+	blocks, ok := m.State.Users[user]
+	if !ok {
+		blocks = make(map[string]DomainBlock)
+		m.State.Users[user] = blocks
+	}
+	_, existed := blocks[domain]
+	blocks[domain] = DomainBlock{Domain: domain, Severity: Suspend, Created: time.Now()}
+	m.Persist()
+	m.Unlock()
+	log.Info("User blocked domain", "user", user, "domain", domain)
+	if !existed {
+		m.notify(user, domain)
+	}
+	return nil
+}
+
+func (m *moderation) UnblockForUser(user, domain string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.State.Users[user], Domain(domain))
+	m.Persist()
+}
+
+func (m *moderation) DeleteUser(user string) {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.State.Users, user)
+	m.Persist()
+}
+
+func (m *moderation) OnBlock(listener BlockListener) {
+	m.Lock()
+	defer m.Unlock()
+	m.Listeners = append(m.Listeners, listener)
+}
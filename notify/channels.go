@@ -0,0 +1,103 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/smtp"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+var htmlTags = regexp.MustCompile(`<[^>]*>`)
+
+// plainText reduces the HTML content of a note to text.
+func plainText(s string) string {
+	s = strings.NewReplacer("<br>", "\n", "<br/>", "\n", "<br />", "\n", "</p>", "\n").Replace(s)
+	s = htmlTags.ReplaceAllString(s, "")
+	s = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&quot;", `"`, "&#39;", "'", "&amp;", "&").Replace(s)
+	return strings.TrimSpace(s)
+}
+
+// summary renders a batch of notifications as text, optionally with their
+// full content.
+func summary(batch []Notification, full bool) string {
+	var b strings.Builder
+	if len(batch) > 1 {
+		fmt.Fprintf(&b, "%v new notifications:\n\n", len(batch))
+	}
+	for _, n := range batch {
+		switch n.Kind {
+		case Reply:
+			fmt.Fprintf(&b, "%v replied", n.Actor)
+			if n.Post != "" {
+				fmt.Fprintf(&b, " to %q", n.Post)
+			}
+		default:
+			fmt.Fprintf(&b, "%v mentioned you", n.Actor)
+		}
+		text := plainText(n.Content)
+		if r := []rune(text); !full && len(r) > 280 {
+			text = string(r[:280]) + "…"
+		}
+		if text != "" {
+			fmt.Fprintf(&b, ":\n%v", text)
+		}
+		if n.Url != "" {
+			fmt.Fprintf(&b, "\n%v", n.Url)
+		}
+		b.WriteString("\n\n")
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func (n *notifier) sendEmail(user, to string, batch []Notification) error {
+	subject := fmt.Sprintf("New %v for %v", batch[0].Kind, user)
+	if len(batch) > 1 {
+		subject = fmt.Sprintf("%v new notifications for %v", len(batch), user)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %v\r\n", n.SMTP.From)
+	fmt.Fprintf(&msg, "To: %v\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %v\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %v\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(summary(batch, true), "\n", "\r\n"))
+	msg.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if n.SMTP.Username != "" {
+		host, _, _ := strings.Cut(n.SMTP.Addr, ":")
+		auth = smtp.PlainAuth("", n.SMTP.Username, n.SMTP.Password, host)
+	}
+	return smtp.SendMail(n.SMTP.Addr, auth, n.SMTP.From, []string{to}, msg.Bytes())
+}
+
+type webhookPayload struct {
+	User          string         `json:"user"`
+	Notifications []Notification `json:"notifications"`
+	Text          string         `json:"text"` // summary, for chat services
+}
+
+// webhookClient only posts to public addresses, as webhooks are set by users.
+var webhookClient = util.PublicClient(30 * time.Second)
+
+func sendWebhook(user, url string, batch []Notification) error {
+	body, err := json.Marshal(webhookPayload{User: user, Notifications: batch, Text: summary(batch, false)})
+	if err != nil {
+		return err
+	}
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %v returned %v", url, resp.Status)
+	}
+	return nil
+}
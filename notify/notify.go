@@ -0,0 +1,350 @@
+// Notifications to users about replies and mentions of their actors.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+)
+
+var log = util.Logger("notify")
+
+type Kind string
+
+const (
+	Reply   Kind = "reply"
+	Mention Kind = "mention"
+)
+
+const (
+	FlushInterval = time.Minute
+	// Notifications kept for a user whose channels keep failing.
+	MaxPending = 500
+)
+
+type Notification struct {
+	Kind     Kind      `json:"kind"`
+	Actor    string    `json:"actor"`
+	Content  string    `json:"content,omitempty"`
+	Url      string    `json:"url,omitempty"`
+	Post     string    `json:"post,omitempty"` // title of the post replied to
+	Received time.Time `json:"received"`
+}
+
+// Preferences say where a user's notifications go. Any combination of
+// channels may be set; none disables notifications.
+type Preferences struct {
+	Fediverse string        `json:"fediverse,omitempty"` // @user@domain or actor url to DM
+	Email     string        `json:"email,omitempty"`
+	Webhook   string        `json:"webhook,omitempty"`
+	Digest    time.Duration `json:"digest,omitempty"` // 0 sends each notification right away
+}
+
+func (p Preferences) Enabled() bool {
+	return p.Fediverse != "" || p.Email != "" || p.Webhook != ""
+}
+
+// DirectSender sends a direct message from user's actor to the fediverse
+// account to.
+type DirectSender func(user, to, text string) error
+
+type SMTPConfig struct {
+	Addr     string // host:port; empty disables email
+	Username string
+	Password string
+	From     string
+}
+
+type Notifier interface {
+	Notify(user string, n Notification)
+	Preferences(user string) Preferences
+	SetPreferences(user string, prefs Preferences) error
+	DeleteUser(user string)
+	EmailEnabled() bool
+
+	OnDirect(sender DirectSender)
+	Start()
+}
+
+type state struct {
+	Preferences map[string]Preferences    `json:"preferences,omitempty"`
+	Pending     map[string][]Notification `json:"pending,omitempty"` // awaiting the next digest
+	LastSent    map[string]time.Time      `json:"last_sent,omitempty"`
+}
+
+type notifier struct {
+	sync.Mutex
+	State          state          // protected by mutex
+	Flushing       map[string]int // protected by mutex; user -> notifications at the head of Pending being sent
+	SMTP           SMTPConfig
+	Direct         DirectSender
+	StateInterface util.Persister
+}
+
+func Init(statefile string, smtp SMTPConfig) Notifier {
+	n := &notifier{
+		State: state{
+			Preferences: make(map[string]Preferences),
+			Pending:     make(map[string][]Notification),
+			LastSent:    make(map[string]time.Time),
+		},
+		Flushing:       make(map[string]int),
+		SMTP:           smtp,
+		StateInterface: util.NewPersister(statefile),
+	}
+	n.Recover()
+	return n
+}
+
+func (n *notifier) Recover() {
+	// Requires mutex
+	if err := n.StateInterface.Read(&n.State); err != nil {
+		util.Fatal(log, "Could not recover notifications", "error", err)
+	}
+	if n.State.Preferences == nil {
+		n.State.Preferences = make(map[string]Preferences)
+	}
+	if n.State.Pending == nil {
+		n.State.Pending = make(map[string][]Notification)
+	}
+	if n.State.LastSent == nil {
+		n.State.LastSent = make(map[string]time.Time)
+	}
+	log.Info("Recovered notification preferences", "users", len(n.State.Preferences))
+}
+
+func (n *notifier) Persist() {
+	// Requires mutex
+	if err := n.StateInterface.Write(n.State); err != nil {
+		log.Error("Error persisting notifications", "error", err)
+	}
+}
+
+func (n *notifier) OnDirect(sender DirectSender) {
+	n.Lock()
+	defer n.Unlock()
+	n.Direct = sender
+}
+
+func (n *notifier) EmailEnabled() bool {
+	return n.SMTP.Addr != ""
+}
+
+func (n *notifier) Preferences(user string) Preferences {
+	n.Lock()
+	defer n.Unlock()
+	return n.State.Preferences[user]
+}
+
+func (n *notifier) SetPreferences(user string, prefs Preferences) error {
+	prefs.Fediverse = strings.TrimSpace(prefs.Fediverse)
+	prefs.Email = strings.TrimSpace(prefs.Email)
+	prefs.Webhook = strings.TrimSpace(prefs.Webhook)
+	if prefs.Email != "" && !n.EmailEnabled() {
+		return fmt.Errorf("Email notifications are not available on this server")
+	}
+	if prefs.Email != "" && !strings.Contains(prefs.Email, "@") {
+		return fmt.Errorf("Invalid email address %q", prefs.Email)
+	}
+	if prefs.Webhook != "" {
+		if err := checkWebhook(prefs.Webhook); err != nil {
+			return err
+		}
+	}
+	if prefs.Fediverse != "" {
+		if err := checkFediverse(prefs.Fediverse); err != nil {
+			return err
+		}
+	}
+	if prefs.Digest < 0 {
+		prefs.Digest = 0
+	}
+	n.Lock()
+	defer n.Unlock()
+	if prefs.Enabled() {
+		n.State.Preferences[user] = prefs
+	} else {
+		delete(n.State.Preferences, user)
+		delete(n.State.Pending, user)
+	}
+	n.Persist()
+	return nil
+}
+
+// checkWebhook fails unless webhook is an http(s) url of a public host.
+// Where it resolves to is checked again on every post.
+func checkWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Hostname() == "" {
+		return fmt.Errorf("Webhook %q must be an http(s) url", webhook)
+	}
+	if err := util.CheckPublicHost(context.Background(), u.Hostname()); err != nil {
+		return fmt.Errorf("Webhook %q is not allowed: %v", webhook, err)
+	}
+	return nil
+}
+
+// checkFediverse fails unless account is a handle or an http(s) actor url on
+// a public host. Where it resolves to is checked again on every message.
+func checkFediverse(account string) error {
+	var host string
+	if strings.HasPrefix(account, "https://") || strings.HasPrefix(account, "http://") {
+		u, err := url.Parse(account)
+		if err != nil || u.Hostname() == "" {
+			return fmt.Errorf("Invalid actor url %q", account)
+		}
+		host = u.Hostname()
+	} else {
+		user, domain, ok := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(account, "acct:"), "@"), "@")
+		if !ok || user == "" || domain == "" || strings.ContainsAny(domain, ":/?#@") {
+			return fmt.Errorf("%q is neither an actor url nor a handle", account)
+		}
+		host = domain
+	}
+	if err := util.CheckPublicHost(context.Background(), host); err != nil {
+		return fmt.Errorf("Fediverse account %q is not allowed: %v", account, err)
+	}
+	return nil
+}
+
+func (n *notifier) DeleteUser(user string) {
+	n.Lock()
+	defer n.Unlock()
+	delete(n.State.Preferences, user)
+	delete(n.State.Pending, user)
+	delete(n.State.LastSent, user)
+	n.Persist()
+}
+
+// Notify queues a notification for user, sending it right away unless the
+// user wants digests.
+func (n *notifier) Notify(user string, notification Notification) {
+	if notification.Received.IsZero() {
+		notification.Received = time.Now()
+	}
+	n.Lock()
+	prefs, ok := n.State.Preferences[user]
+	if !ok {
+		n.Unlock()
+		return
+	}
+	pending := append(n.State.Pending[user], notification)
+	if len(pending) > MaxPending {
+		dropped := len(pending) - MaxPending
+		pending = pending[dropped:]
+		if sending, ok := n.Flushing[user]; ok {
+			n.Flushing[user] = max(sending-dropped, 0)
+		}
+	}
+	n.State.Pending[user] = pending
+	n.Persist()
+	n.Unlock()
+	log.Info("Queued notification", "kind", notification.Kind, "user", user, "actor", notification.Actor)
+	if prefs.Digest == 0 {
+		go n.flush(user)
+	}
+}
+
+// due returns the users whose pending notifications should be sent.
+func (n *notifier) due(now time.Time) []string {
+	n.Lock()
+	defer n.Unlock()
+	var users []string
+	for user, pending := range n.State.Pending {
+		if len(pending) == 0 {
+			continue
+		}
+		if now.Sub(n.State.LastSent[user]) >= n.State.Preferences[user].Digest {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+// flush sends user's pending notifications through each of their channels,
+// unless they are already being sent. Notifications that arrive meanwhile
+// are sent after, or with the next digest.
+func (n *notifier) flush(user string) {
+	n.Lock()
+	if _, ok := n.Flushing[user]; ok {
+		n.Unlock()
+		return
+	}
+	n.Flushing[user] = 0
+	n.Unlock()
+	for n.flushOnce(user) {
+	}
+	n.Lock()
+	delete(n.Flushing, user)
+	n.Unlock()
+}
+
+// flushOnce sends a batch of user's pending notifications, reporting whether
+// more are due right away. Notifications are kept for a later attempt if
+// every channel fails.
+func (n *notifier) flushOnce(user string) bool {
+	n.Lock()
+	prefs := n.State.Preferences[user]
+	batch := n.State.Pending[user]
+	n.Flushing[user] = len(batch)
+	direct := n.Direct
+	n.Unlock()
+	if len(batch) == 0 {
+		return false
+	}
+
+	sent := false
+	if prefs.Fediverse != "" && direct != nil {
+		if err := direct(user, prefs.Fediverse, summary(batch, false)); err != nil {
+			log.Error("Error sending notifications", "user", user, "to", prefs.Fediverse, "error", err)
+		} else {
+			sent = true
+		}
+	}
+	if prefs.Email != "" && n.EmailEnabled() {
+		if err := n.sendEmail(user, prefs.Email, batch); err != nil {
+			log.Error("Error emailing notifications", "user", user, "error", err)
+		} else {
+			sent = true
+		}
+	}
+	if prefs.Webhook != "" {
+		if err := sendWebhook(user, prefs.Webhook, batch); err != nil {
+			log.Error("Error posting notifications to webhook", "user", user, "error", err)
+		} else {
+			sent = true
+		}
+	}
+	if !sent {
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+	// Keep anything that arrived while sending.
+	n.State.Pending[user] = n.State.Pending[user][min(n.Flushing[user], len(n.State.Pending[user])):]
+	more := len(n.State.Pending[user]) != 0
+	if !more {
+		delete(n.State.Pending, user)
+	}
+	n.State.LastSent[user] = time.Now()
+	n.Persist()
+	log.Info("Sent notifications", "count", len(batch), "user", user)
+	return more && n.State.Preferences[user].Digest == 0
+}
+
+func (n *notifier) Start() {
+	go func() {
+		for {
+			for _, user := range n.due(time.Now()) {
+				n.flush(user)
+			}
+			time.Sleep(FlushInterval)
+		}
+	}()
+}
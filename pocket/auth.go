@@ -2,14 +2,17 @@ package pocket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"regexp"
+	"strings"
 	"time"
 
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/ml8/ap-bot/util"
 )
@@ -33,12 +36,37 @@ type AuthResponse struct {
 	Username    string `json:"username"`
 }
 
+var (
+	handlePattern   = regexp.MustCompile(`^[A-Za-z0-9_]([A-Za-z0-9_.-]{0,28}[A-Za-z0-9_])?$`)
+	reservedHandles = map[string]bool{
+		"about": true, "abuse": true, "account": true, "activitypub": true,
+		"actor": true, "admin": true, "administrator": true, "api": true,
+		"callback": true, "inbox": true, "instance": true, "login": true,
+		"logout": true, "media": true, "nodeinfo": true, "outbox": true,
+		"pocket": true, "postmaster": true, "register": true, "relay": true,
+		"root": true, "security": true, "settings": true, "static": true,
+		"support": true, "webmaster": true, "www": true,
+	}
+)
+
+// ValidHandle reports why name cannot be used as a bridge handle, if at all.
+func ValidHandle(name string) error {
+	if !handlePattern.MatchString(name) {
+		return fmt.Errorf("Handle %q must be 1-30 letters, digits, '_', '.' or '-'", name)
+	}
+	if reservedHandles[strings.ToLower(name)] {
+		return fmt.Errorf("Handle %q is reserved", name)
+	}
+	return nil
+}
+
 const (
 	successSrc = `
 <html>
 	<head></head>
 	<body>
 	  Now, you may follow %v@%v from your mastodon (etc) account.
+	  <p><a href="/account">Manage your account</a></p>
 	</body>
 </html>
 `
@@ -55,31 +83,36 @@ func (p *pocket) redirectUrl(token, uri string) string {
 
 func (p *pocket) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 	acct := mux.Vars(r)["account"]
-	glog.Infof("Registering %v", acct)
+	log.InfoContext(r.Context(), "Registering", "user", acct)
 	if acct == "" {
 		util.ErrorResponse(w, http.StatusPreconditionFailed, "No user found")
 		return
 	}
+	if err := ValidHandle(acct); err != nil {
+		util.ErrorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
-	// Create + send auth request
+	// Create + send auth request. The state nonce travels through pocket in the
+	// redirect uri and must match the signed cookie set on this browser.
+	state := util.RandomToken(24)
 	authReq := PreAuthRequest{
 		ConsumerKey: p.AppKey,
-		RedirectUri: p.Resources.AppUrl + CallbackUrlRoot + "/" + acct,
+		RedirectUri: p.Resources.AppUrl + CallbackUrlRoot + "/" + acct + "?state=" + state,
 	}
 	jsonData, err := json.Marshal(authReq)
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error marshalling request: %v", err))
 		return
 	}
-	req, err := http.NewRequest("POST", PocketUrl+PocketAuthRequestUrl, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(r.Context(), "POST", PocketUrl+PocketAuthRequestUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Accept", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := call(PocketAuthRequestUrl, req)
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return
@@ -97,26 +130,96 @@ func (p *pocket) RegisterHandler(w http.ResponseWriter, r *http.Request) {
 		util.ErrorResponse(w, http.StatusInternalServerError, msg)
 		return
 	}
-	glog.Infof("Got code %v for user %v", authResp.Code, acct)
+	log.InfoContext(r.Context(), "Got request token", "user", acct)
 
+	// Existing registrations are left untouched until pocket tells us who
+	// authorized; the code is held against the state nonce instead.
 	p.Lock()
-	p.Tokens[acct] = Userdata{
-		Username:    acct,
-		AccessToken: "",
-		AuthCode:    authResp.Code,
+	p.prunePending()
+	p.Pending[state] = pendingAuth{
+		Account:  acct,
+		AuthCode: util.Secret(authResp.Code),
+		Created:  time.Now(),
 	}
 	p.Unlock()
 
+	http.SetCookie(w, &http.Cookie{
+		Name:     StateCookie,
+		Value:    p.Cookies.Sign(StateCookie, acct+"|"+state, StateTTL),
+		Path:     "/pocket" + CallbackUrlRoot,
+		MaxAge:   int(StateTTL.Seconds()),
+		HttpOnly: true,
+		Secure:   p.Cookies.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+
 	// Redirect user to pocket auth
 	redirect := p.redirectUrl(authResp.Code, authReq.RedirectUri)
-	http.Redirect(w, r, redirect, 301)
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func (p *pocket) prunePending() {
+	// Requires mutex
+	for state, pending := range p.Pending {
+		if time.Since(pending.Created) > StateTTL {
+			delete(p.Pending, state)
+		}
+	}
 }
 
-func (p *pocket) GetToken(w http.ResponseWriter, user *Userdata) *AuthResponse {
+// checkState consumes the pending registration for the request's state
+// parameter, provided the state cookie was issued for the same account.
+func (p *pocket) checkState(acct string, r *http.Request) (pendingAuth, error) {
+	state := r.URL.Query().Get("state")
+	cookie, err := r.Cookie(StateCookie)
+	if state == "" || err != nil {
+		return pendingAuth{}, errors.New("Missing registration state")
+	}
+	value, ok := p.Cookies.Verify(StateCookie, cookie.Value)
+	if !ok || value != acct+"|"+state {
+		return pendingAuth{}, errors.New("Invalid registration state")
+	}
+	p.Lock()
+	defer p.Unlock()
+	pending, ok := p.Pending[state]
+	delete(p.Pending, state)
+	if !ok || pending.Account != acct || time.Since(pending.Created) > StateTTL {
+		return pendingAuth{}, errors.New("Registration expired; please start again")
+	}
+	return pending, nil
+}
+
+// claim binds acct to the pocket account that just authorized. A handle that
+// is already linked may only be re-authorized by the same pocket account;
+// handles linked before usernames were recorded must match the pocket name.
+func (p *pocket) claim(acct string, auth *AuthResponse) error {
+	// Requires mutex
+	existing, ok := p.Tokens[acct]
+	if !ok {
+		for name, u := range p.Tokens {
+			if u.PocketUsername != "" && u.PocketUsername == auth.Username {
+				return fmt.Errorf("Pocket account is already linked as %v", name)
+			}
+		}
+		return nil
+	}
+	if existing.PocketUsername != "" {
+		if existing.PocketUsername != auth.Username {
+			return fmt.Errorf("Handle %v is linked to a different pocket account", acct)
+		}
+		return nil
+	}
+	if !strings.EqualFold(acct, auth.Username) {
+		return fmt.Errorf("Handle %v is already taken", acct)
+	}
+	return nil
+}
+
+func (p *pocket) GetToken(ctx context.Context, w http.ResponseWriter, user *Userdata) *AuthResponse {
 	// User is authenticated; get the token for them.
 	authReq := AuthRequest{
 		ConsumerKey: p.AppKey,
-		Code:        user.AuthCode,
+		Code:        user.AuthCode.Reveal(),
 	}
 
 	jsonData, err := json.Marshal(authReq)
@@ -124,15 +227,14 @@ func (p *pocket) GetToken(w http.ResponseWriter, user *Userdata) *AuthResponse {
 		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error marshalling request: %v", err))
 		return nil
 	}
-	req, err := http.NewRequest("POST", PocketUrl+PocketAuthAuthorizeUrl, bytes.NewBuffer(jsonData))
+	req, err := http.NewRequestWithContext(ctx, "POST", PocketUrl+PocketAuthAuthorizeUrl, bytes.NewBuffer(jsonData))
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return nil
 	}
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Accept", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := call(PocketAuthAuthorizeUrl, req)
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error sending %v: %v", req, err))
 		return nil
@@ -144,7 +246,7 @@ func (p *pocket) GetToken(w http.ResponseWriter, user *Userdata) *AuthResponse {
 		util.ErrorResponse(w, http.StatusInternalServerError, err.Error())
 		return nil
 	}
-	glog.Infof("Got %+v: %v", resp, body)
+	log.InfoContext(ctx, "Token request", "user", user.Username, "status", resp.StatusCode)
 	if resp.StatusCode != http.StatusOK {
 		return nil
 	}
@@ -158,26 +260,26 @@ func (p *pocket) GetToken(w http.ResponseWriter, user *Userdata) *AuthResponse {
 
 func (p *pocket) RegisterCallback(w http.ResponseWriter, r *http.Request) {
 	acct := mux.Vars(r)["account"]
-	glog.Infof("Authorizing %v", acct)
+	log.InfoContext(r.Context(), "Authorizing", "user", acct)
 	if acct == "" {
 		util.ErrorResponse(w, http.StatusPreconditionFailed, "No user found")
 		return
 	}
 
-	p.Lock()
-	user, ok := p.Tokens[acct]
-	p.Unlock()
-	if !ok {
-		util.ErrorResponse(w, http.StatusPreconditionFailed, fmt.Sprintf("Unknown user %v", acct))
+	pending, err := p.checkState(acct, r)
+	if err != nil {
+		util.ErrorResponse(w, http.StatusForbidden, err.Error())
 		return
 	}
+	http.SetCookie(w, &http.Cookie{Name: StateCookie, Path: "/pocket" + CallbackUrlRoot, MaxAge: -1})
 
-	authResp := p.GetToken(w, &user)
+	user := Userdata{Username: acct, AuthCode: pending.AuthCode}
+	authResp := p.GetToken(r.Context(), w, &user)
 	backOff := time.Second * 1
 	for i := 0; authResp == nil && i < 5; i += 1 {
-		glog.Warningf("Got non-OK status, backing off for %vs", backOff.Seconds())
+		log.WarnContext(r.Context(), "Token request failed; backing off", "user", acct, "backoff", backOff)
 		time.Sleep(backOff)
-		authResp = p.GetToken(w, &user)
+		authResp = p.GetToken(r.Context(), w, &user)
 	}
 	if authResp == nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, "Error retrieving user token")
@@ -186,11 +288,20 @@ func (p *pocket) RegisterCallback(w http.ResponseWriter, r *http.Request) {
 
 	// sweet.
 	p.Lock()
-	user, _ = p.Tokens[acct]
-	user.AccessToken = authResp.AccessToken
+	if err := p.claim(acct, authResp); err != nil {
+		p.Unlock()
+		util.ErrorResponse(w, http.StatusConflict, err.Error())
+		return
+	}
+	user.PocketUsername = authResp.Username
+	user.AccessToken = util.Secret(authResp.AccessToken)
+	user.AuthCode = ""
+	// Linking starts a new generation of sessions, ending any from before.
+	user.Session = util.RandomToken(sessionGenerationLen)
 	p.Tokens[acct] = user
 	p.Persist()
 	p.Unlock()
-	glog.Infof("Got token %v for user %v", authResp.AccessToken, acct)
+	log.InfoContext(r.Context(), "Linked user to pocket account", "user", acct, "pocket_user", authResp.Username)
+	p.Cookies.SetSession(w, acct, user.Session)
 	w.Write([]byte(fmt.Sprintf(successSrc, acct, p.Resources.Host)))
 }
@@ -0,0 +1,72 @@
+package pocket
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ml8/ap-bot/util"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Pocket reports its rate limits in these headers: per user, and per
+// application key.
+var rateLimitHeaders = map[string]string{
+	"user": "X-Limit-User-Remaining",
+	"key":  "X-Limit-Key-Remaining",
+}
+
+var (
+	apiDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "pocket_request_duration_seconds",
+		Help:      "Latency of Pocket API requests, by endpoint.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint"})
+	apiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "pocket_request_errors_total",
+		Help:      "Pocket API requests that failed or were refused, by endpoint.",
+	}, []string{"endpoint"})
+	rateLimitRemaining = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: util.MetricsNamespace,
+		Name:      "pocket_rate_limit_remaining",
+		Help:      "Requests left in the current Pocket rate limit window, as last reported, by scope (user or key).",
+	}, []string{"scope"})
+)
+
+var tracer = otel.Tracer("github.com/ml8/ap-bot/pocket")
+
+// call sends req to the Pocket API endpoint, recording its latency, errors
+// and the rate limit Pocket reports, in a span of the request's trace.
+func call(endpoint string, req *http.Request) (*http.Response, error) {
+	_, span := tracer.Start(req.Context(), "pocket "+endpoint, trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.request.method", req.Method), attribute.String("url.full", req.URL.String())))
+	defer span.End()
+	client := &http.Client{}
+	start := time.Now()
+	resp, err := client.Do(req)
+	apiDuration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+	if err != nil {
+		apiErrors.WithLabelValues(endpoint).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode != http.StatusOK {
+		apiErrors.WithLabelValues(endpoint).Inc()
+		span.SetStatus(codes.Error, resp.Status)
+	}
+	for scope, header := range rateLimitHeaders {
+		if n, err := strconv.Atoi(resp.Header.Get(header)); err == nil {
+			rateLimitRemaining.WithLabelValues(scope).Set(float64(n))
+		}
+	}
+	return resp, nil
+}
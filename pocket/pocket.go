@@ -2,13 +2,17 @@
 package pocket
 
 import (
+	"context"
+	"crypto/subtle"
 	"net/http"
 	"sync"
+	"time"
 
-	"github.com/golang/glog"
 	"github.com/ml8/ap-bot/util"
 )
 
+var log = util.Logger("pocket")
+
 const (
 	PocketUrl              = "https://getpocket.com"
 	PocketAuthRequestUrl   = "/v3/oauth/request"
@@ -17,14 +21,20 @@ const (
 	RegisterUrlTemplate    = RegisterUrlRoot + "/{account}"
 	CallbackUrlRoot        = "/callback"
 	CallbackUrlTemplate    = CallbackUrlRoot + "/{account}"
+	StateCookie            = "pocket_state"
+	StateTTL               = 15 * time.Minute
+	sessionGenerationLen   = 16
 )
 
 type Pocket interface {
 	RegisterHandler(w http.ResponseWriter, r *http.Request)
 	RegisterCallback(w http.ResponseWriter, r *http.Request)
 	ArticleHandler(w http.ResponseWriter, r *http.Request)
-	RandArticleForUser(user string) (Article, error)
+	RandArticleForUser(ctx context.Context, user string) (Article, error)
 	IsLoggedIn(user string) bool
+	ValidSession(user, generation string) bool
+	RevokeSessions(user string)
+	Unlink(user string)
 }
 
 type BootstrapData struct {
@@ -32,9 +42,18 @@ type BootstrapData struct {
 }
 
 type Userdata struct {
-	Username    string `json:"username,omitempty"`
-	AccessToken string `json:"accesstoken,omitempty"`
-	AuthCode    string `json:"authcode,omitempty"`
+	Username       string      `json:"username,omitempty"`
+	PocketUsername string      `json:"pocketusername,omitempty"` // account the handle is bound to
+	AccessToken    util.Secret `json:"accesstoken,omitempty"`
+	AuthCode       util.Secret `json:"authcode,omitempty"`
+	Session        string      `json:"session,omitempty"` // generation of the user's sessions; replaced to revoke them
+}
+
+// An in-flight registration, keyed by the state nonce handed to the browser.
+type pendingAuth struct {
+	Account  string
+	AuthCode util.Secret
+	Created  time.Time
 }
 
 type ResourceMap struct {
@@ -44,25 +63,35 @@ type ResourceMap struct {
 
 type pocket struct {
 	sync.Mutex
-	Tokens         map[string]Userdata // protected by mutex
+	Tokens         map[string]Userdata    // protected by mutex
+	Pending        map[string]pendingAuth // protected by mutex
 	AppKey         string
 	Resources      ResourceMap
 	StateInterface util.Persister
+	Cookies        *util.CookieSigner
 }
 
-func Init(key string, resources ResourceMap, bootstrap *BootstrapData, statefile string) Pocket {
-	glog.Infof("Application at %v", resources.AppUrl)
-	p := &pocket{Tokens: make(map[string]Userdata), Resources: resources, AppKey: key}
+func Init(key string, resources ResourceMap, bootstrap *BootstrapData, statefile string, cookies *util.CookieSigner) Pocket {
+	log.Info("Application started", "url", resources.AppUrl)
+	p := &pocket{
+		Tokens:    make(map[string]Userdata),
+		Pending:   make(map[string]pendingAuth),
+		Resources: resources,
+		AppKey:    key,
+		Cookies:   cookies,
+	}
 	for u, c := range bootstrap.Users {
 		p.Tokens[u] = Userdata{
 			Username:    u,
-			AccessToken: c,
+			AccessToken: util.Secret(c),
 			AuthCode:    "",
 		}
 	}
 	p.StateInterface = util.NewPersister(statefile)
 	p.Recover()
-	if len(bootstrap.Users) != 0 {
+	// Persisting also seals tokens stored before encryption was enabled, or
+	// with a master key that has since been rotated.
+	if len(bootstrap.Users) != 0 || util.SecretsEncrypted() {
 		p.Persist()
 	}
 	return p
@@ -70,13 +99,17 @@ func Init(key string, resources ResourceMap, bootstrap *BootstrapData, statefile
 
 func (p *pocket) Recover() {
 	// Requires mutex
-	p.StateInterface.Read(&p.Tokens)
-	glog.Infof("Recovered %+v", p.Tokens)
+	if err := p.StateInterface.Read(&p.Tokens); err != nil {
+		util.Fatal(log, "Could not recover tokens", "error", err)
+	}
+	log.Info("Recovered users", "users", len(p.Tokens))
 }
 
 func (p *pocket) Persist() {
 	// Requires mutex
-	p.StateInterface.Write(p.Tokens)
+	if err := p.StateInterface.Write(p.Tokens); err != nil {
+		log.Error("Error persisting tokens", "error", err)
+	}
 }
 
 func (p *pocket) IsLoggedIn(user string) bool {
@@ -85,3 +118,37 @@ func (p *pocket) IsLoggedIn(user string) bool {
 	u, ok := p.Tokens[user]
 	return ok && u.AccessToken != ""
 }
+
+// ValidSession is whether a session of user issued in generation is still
+// good: the user is linked, and has not been relinked or signed out
+// everywhere since.
+func (p *pocket) ValidSession(user, generation string) bool {
+	p.Lock()
+	defer p.Unlock()
+	u, ok := p.Tokens[user]
+	return ok && u.AccessToken != "" && u.Session != "" &&
+		subtle.ConstantTimeCompare([]byte(u.Session), []byte(generation)) == 1
+}
+
+// RevokeSessions ends every session of user.
+func (p *pocket) RevokeSessions(user string) {
+	p.Lock()
+	defer p.Unlock()
+	u, ok := p.Tokens[user]
+	if !ok {
+		return
+	}
+	u.Session = util.RandomToken(sessionGenerationLen)
+	p.Tokens[user] = u
+	p.Persist()
+	log.Info("Revoked sessions", "user", user)
+}
+
+// Unlink forgets the user's pocket token; the handle becomes free again.
+func (p *pocket) Unlink(user string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.Tokens, user)
+	p.Persist()
+	log.Info("Unlinked user", "user", user)
+}
@@ -2,6 +2,7 @@ package pocket
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,7 +11,6 @@ import (
 	"net/http"
 	"reflect"
 
-	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 	"github.com/ml8/ap-bot/util"
 )
@@ -51,7 +51,7 @@ func (p *pocket) getQuery(u *Userdata) (q []byte, err error) {
 	// Return a json query
 	req := GetRequest{
 		ConsumerKey: p.AppKey,
-		AccessToken: u.AccessToken,
+		AccessToken: u.AccessToken.Reveal(),
 		Count:       Limit,
 		DetailType:  "simple",
 		Sort:        "newest",
@@ -62,7 +62,7 @@ func (p *pocket) getQuery(u *Userdata) (q []byte, err error) {
 
 func (p *pocket) ArticleHandler(w http.ResponseWriter, r *http.Request) {
 	user := mux.Vars(r)["account"]
-	a, err := p.RandArticleForUser(user)
+	a, err := p.RandArticleForUser(r.Context(), user)
 	if err != nil {
 		util.ErrorResponse(w, http.StatusInternalServerError, fmt.Sprintf("Error retrieving article for user %v: %v", user, err))
 		return
@@ -70,7 +70,7 @@ func (p *pocket) ArticleHandler(w http.ResponseWriter, r *http.Request) {
 	util.JsonResponse(w, http.StatusOK, a)
 }
 
-func (p *pocket) RandArticleForUser(user string) (a Article, err error) {
+func (p *pocket) RandArticleForUser(ctx context.Context, user string) (a Article, err error) {
 	p.Lock()
 	u, ok := p.Tokens[user]
 	p.Unlock()
@@ -87,20 +87,19 @@ func (p *pocket) RandArticleForUser(user string) (a Article, err error) {
 	var q []byte
 	q, err = p.getQuery(&u)
 	if err != nil {
-		glog.Errorf("Error marshalling json for %v: %v", u, err)
+		log.Error("Error encoding saves query", "user", user, "error", err)
 		return
 	}
-	req, err := http.NewRequest("POST", PocketUrl+GetUrl, bytes.NewBuffer(q))
+	req, err := http.NewRequestWithContext(ctx, "POST", PocketUrl+GetUrl, bytes.NewBuffer(q))
 	if err != nil {
-		glog.Errorf("Error creating query for %v: %v", user, err)
+		log.Error("Error creating saves query", "user", user, "error", err)
 		return
 	}
 	req.Header.Set("Content-Type", "application/json; charset=UTF-8")
 	req.Header.Set("X-Accept", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := call(GetUrl, req)
 	if err != nil {
-		glog.Errorf("Error posting login request: %v", err)
+		log.ErrorContext(ctx, "Error fetching saves", "user", user, "error", err)
 		return
 	}
 	defer resp.Body.Close()
@@ -112,7 +111,7 @@ func (p *pocket) RandArticleForUser(user string) (a Article, err error) {
 
 	get := &GetResponse{}
 	if err = json.Unmarshal(body, get); err != nil {
-		glog.Errorf("Error unmarshalling %v: %v", string(body), err)
+		log.Error("Error decoding saves", "user", user, "status", resp.StatusCode, "error", err)
 		return
 	}
 
@@ -120,7 +119,7 @@ func (p *pocket) RandArticleForUser(user string) (a Article, err error) {
 	i := rand.Intn(len(get.Items))
 	keys := reflect.ValueOf(get.Items).MapKeys()
 	art := get.Items[keys[i].String()]
-	glog.Infof("Got %v articles; chose %v: %v", len(get.Items), i, art)
+	log.Info("Chose article", "user", user, "articles", len(get.Items), "url", art.ResolvedUrl)
 	a = Article{
 		Title:   art.ResolvedTitle,
 		Excerpt: art.Excerpt,
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const cookieKeyLen = 32
+
+// CookieSigner produces and verifies HMAC-signed, expiring cookie values.
+type CookieSigner struct {
+	key    []byte
+	Secure bool // whether cookies should only be sent over https
+}
+
+func NewCookieSigner(key []byte, secure bool) *CookieSigner {
+	return &CookieSigner{key: key, Secure: secure}
+}
+
+// LoadOrCreateKey reads a signing key from fname, creating it if it does not
+// exist. An empty fname yields a random key that only lives for this process.
+func LoadOrCreateKey(fname string) []byte {
+	if fname != "" {
+		if key, err := os.ReadFile(fname); err == nil && len(key) >= cookieKeyLen {
+			return key
+		}
+	}
+	key := RandomBytes(cookieKeyLen)
+	if fname != "" {
+		if err := os.WriteFile(fname, key, 0600); err != nil {
+			log.Error("Error writing key", "file", fname, "error", err)
+		}
+	}
+	return key
+}
+
+// RandomBytes returns n bytes from the system CSPRNG.
+func RandomBytes(n int) []byte {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		Fatal(log, "Error reading random bytes", "error", err)
+	}
+	return b
+}
+
+// RandomToken returns a URL-safe random string with n bytes of entropy.
+func RandomToken(n int) string {
+	return base64.RawURLEncoding.EncodeToString(RandomBytes(n))
+}
+
+func (s *CookieSigner) mac(payload string) string {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Sign returns value with an expiry and MAC appended. The MAC also covers
+// purpose, usually the name of the cookie the value is carried in, so that a
+// value signed for one purpose is not accepted for another.
+func (s *CookieSigner) Sign(purpose, value string, ttl time.Duration) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(value)) + "." +
+		strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return payload + "." + s.mac(purpose+"|"+payload)
+}
+
+// Verify returns the original value if signed is authentic, unexpired and
+// was signed for purpose.
+func (s *CookieSigner) Verify(purpose, signed string) (value string, ok bool) {
+	idx := strings.LastIndex(signed, ".")
+	if idx < 0 {
+		return
+	}
+	payload, mac := signed[:idx], signed[idx+1:]
+	if !hmac.Equal([]byte(mac), []byte(s.mac(purpose+"|"+payload))) {
+		return
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expiry {
+		return
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return
+	}
+	return string(raw), true
+}
@@ -0,0 +1,210 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Logging is structured, as JSON lines through log/slog. Each subsystem has
+// its own logger with its own level, and everything written passes through a
+// redaction layer that strips credentials.
+
+const redacted = "[redacted]"
+
+type requestIdKey struct{}
+
+var (
+	logMu        sync.Mutex
+	logLevels    = make(map[string]*slog.LevelVar) // protected by logMu
+	logOverrides = make(map[string]slog.Level)     // protected by logMu
+	logDefault   = slog.LevelInfo                  // protected by logMu
+	// Levels are checked by each subsystem, so the output takes everything.
+	logOutput = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug - 4, ReplaceAttr: redactAttr})
+
+	log = Logger("util")
+)
+
+// Attribute keys whose values are always credentials.
+var secretKeys = []string{"token", "secret", "password", "signature", "authorization", "cookie", "private"}
+
+// exactSecretKeys are credentials only as a whole key, e.g. "code" but not
+// "status_code".
+var exactSecretKeys = map[string]bool{"code": true, "auth_code": true, "key": true, "consumer_key": true}
+
+// Credentials embedded in strings: headers, query strings, JSON and PEM.
+var secretPatterns = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`), redacted},
+	{regexp.MustCompile(`(?i)(signature=")[^"]*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)((?:bearer|basic)\s+)[A-Za-z0-9._~+/=-]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)("?\b(?:[a-z_]*(?:token|secret|password)|auth_code|code|consumer_key)"?\s*[:=]\s*"?)[^"&,;\s}]+`), "${1}" + redacted},
+}
+
+// Logger returns the logger of subsystem, whose level is set by
+// SetLogLevels.
+func Logger(subsystem string) *slog.Logger {
+	logMu.Lock()
+	defer logMu.Unlock()
+	level, ok := logLevels[subsystem]
+	if !ok {
+		level = &slog.LevelVar{}
+		level.Set(levelFor(subsystem))
+		logLevels[subsystem] = level
+	}
+	return slog.New(&subsystemHandler{
+		Level:  level,
+		Output: logOutput.WithAttrs([]slog.Attr{slog.String("subsystem", subsystem)}),
+	})
+}
+
+func levelFor(subsystem string) slog.Level {
+	// Requires logMu
+	if l, ok := logOverrides[subsystem]; ok {
+		return l
+	}
+	return logDefault
+}
+
+// SetLogLevels sets levels from spec: a comma-separated list of levels (debug,
+// info, warn or error), each optionally prefixed with a subsystem and "=".
+// A bare level applies to every subsystem not named, e.g.
+// "warn,activitypub=debug".
+func SetLogLevels(spec string) error {
+	def := slog.LevelInfo
+	overrides := make(map[string]slog.Level)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		subsystem, name, named := strings.Cut(part, "=")
+		if !named {
+			name = subsystem
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(strings.TrimSpace(name))); err != nil {
+			return fmt.Errorf("Invalid log level %q", part)
+		}
+		if named {
+			overrides[strings.TrimSpace(subsystem)] = level
+		} else {
+			def = level
+		}
+	}
+	logMu.Lock()
+	defer logMu.Unlock()
+	logDefault, logOverrides = def, overrides
+	for subsystem, level := range logLevels {
+		level.Set(levelFor(subsystem))
+	}
+	return nil
+}
+
+// Fatal logs msg as an error and exits.
+func Fatal(l *slog.Logger, msg string, args ...any) {
+	l.Error(msg, args...)
+	os.Exit(1)
+}
+
+// WithRequestId returns ctx carrying id, which is added to everything logged
+// with it.
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the id of the request ctx belongs to, or "".
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// subsystemHandler writes a subsystem's records at or above its level.
+type subsystemHandler struct {
+	Level  *slog.LevelVar
+	Output slog.Handler
+}
+
+func (h *subsystemHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.Level.Level()
+}
+
+func (h *subsystemHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := RequestId(ctx); id != "" {
+		r = r.Clone()
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r = r.Clone()
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()), slog.String("span_id", sc.SpanID().String()))
+	}
+	return h.Output.Handle(ctx, r)
+}
+
+func (h *subsystemHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &subsystemHandler{Level: h.Level, Output: h.Output.WithAttrs(attrs)}
+}
+
+func (h *subsystemHandler) WithGroup(name string) slog.Handler {
+	return &subsystemHandler{Level: h.Level, Output: h.Output.WithGroup(name)}
+}
+
+// Redact strips credentials from s.
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.re.ReplaceAllString(s, p.repl)
+	}
+	return s
+}
+
+func secretKey(key string) bool {
+	key = strings.ToLower(key)
+	if exactSecretKeys[key] {
+		return true
+	}
+	for _, k := range secretKeys {
+		if strings.Contains(key, k) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactAttr replaces credentials in a, which is named by a secret key or
+// holds a string that embeds one. Values of other kinds are logged as text,
+// so that nothing escapes redaction by being nested, and durations are
+// written to be read.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+		return a
+	}
+	if secretKey(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	v := a.Value.Resolve()
+	switch v.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, Redact(v.String()))
+	case slog.KindDuration:
+		return slog.String(a.Key, v.Duration().String())
+	case slog.KindAny:
+		if err, ok := v.Any().(error); ok {
+			return slog.String(a.Key, Redact(err.Error()))
+		}
+		return slog.String(a.Key, Redact(fmt.Sprintf("%+v", v.Any())))
+	}
+	return slog.Attr{Key: a.Key, Value: v}
+}
+
+// LogValue keeps secrets out of logs.
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(redacted)
+}
@@ -0,0 +1,96 @@
+package util
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	bolt "go.etcd.io/bbolt"
+)
+
+// MetricsNamespace prefixes the names of every metric the bridge exports.
+const MetricsNamespace = "apbot"
+
+var (
+	persistDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: MetricsNamespace,
+		Name:      "persist_write_duration_seconds",
+		Help:      "Time taken to persist a component's state.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"state"})
+	persistErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: MetricsNamespace,
+		Name:      "persist_write_errors_total",
+		Help:      "Failed writes of a component's state.",
+	}, []string{"state"})
+
+	healthKey = []byte("health_checked")
+
+	// The last writability check, so that probes, which are unauthenticated,
+	// cannot make the server sync a write to disk on every request.
+	writable struct {
+		sync.Mutex
+		Dir     string    // protected by mutex
+		Checked time.Time // protected by mutex
+		Err     error     // protected by mutex
+	}
+)
+
+// WritableCheckInterval is how long the result of CheckWritable is reused.
+const WritableCheckInterval = 5 * time.Second
+
+// observeWrite records a write of state that started at start.
+func observeWrite(state string, start time.Time, err error) {
+	persistDuration.WithLabelValues(state).Observe(time.Since(start).Seconds())
+	if err != nil {
+		persistErrors.WithLabelValues(state).Inc()
+	}
+}
+
+// CheckWritable verifies that state can be written: to the store if one is in
+// use, or else to dir. State kept only in memory is always writable. The
+// result is reused for WritableCheckInterval.
+func CheckWritable(dir string) error {
+	writable.Lock()
+	defer writable.Unlock()
+	if writable.Dir == dir && time.Since(writable.Checked) < WritableCheckInterval {
+		return writable.Err
+	}
+	writable.Dir = dir
+	writable.Err = checkWritable(dir)
+	writable.Checked = time.Now()
+	return writable.Err
+}
+
+func checkWritable(dir string) error {
+	if s := currentStore(); s != nil {
+		return s.DB.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(metaBucket)
+			if b == nil {
+				return errors.New("Store has no metadata")
+			}
+			return b.Put(healthKey, []byte(time.Now().UTC().Format(time.RFC3339)))
+		})
+	}
+	if dir == "" {
+		return nil
+	}
+	f, err := os.CreateTemp(dir, ".healthz-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(filepath.Join(dir, filepath.Base(f.Name())))
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,69 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"syscall"
+	"time"
+)
+
+// Urls given by users are only fetched from the public internet, so that they
+// cannot be used to reach the server itself or the network it runs in.
+
+// cgnat is the shared address space of carrier-grade NAT, which is not
+// routable on the internet either.
+var cgnat = netip.MustParsePrefix("100.64.0.0/10")
+
+// PublicAddr is whether addr is a public unicast address.
+func PublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() && addr.IsGlobalUnicast() && !addr.IsPrivate() && !cgnat.Contains(addr)
+}
+
+// CheckPublicHost resolves host and fails unless all of its addresses are
+// public.
+func CheckPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("Could not resolve %v: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !PublicAddr(addr) {
+			return fmt.Errorf("%v is not a public address", host)
+		}
+	}
+	return nil
+}
+
+// publicOnly refuses connections to anything but public addresses. It runs
+// on the address actually dialed, after resolution, so that a name cannot
+// resolve to a public address when checked and a private one when used.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !PublicAddr(addrPort.Addr()) {
+		return fmt.Errorf("Refusing to connect to non-public address %v", addrPort.Addr())
+	}
+	return nil
+}
+
+// PublicClient is an http.Client that only connects to public addresses,
+// including when following redirects. It does not use proxies, which would
+// dial on its behalf.
+func PublicClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: publicOnly}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: 10 * time.Second,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
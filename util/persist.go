@@ -1,17 +1,29 @@
 package util
 
 import (
-	"github.com/golang/glog"
-
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// Backups of a persisted file kept as <file>.1 (newest) to <file>.N.
+	PersistBackups = 3
+	// Minimum age of the newest backup before another is taken, so that the
+	// backups span some time rather than the last few writes.
+	BackupInterval = time.Hour
 )
 
 type Persister interface {
-	Write(state interface{})
-	Read(state interface{})
+	Write(state interface{}) error
+	Read(state interface{}) error
 }
 
+// FilePersister stores state as JSON. Writes replace the file atomically, and
+// reads fall back to the newest readable backup if the file is damaged.
 type FilePersister struct {
 	Fn string
 }
@@ -23,49 +35,164 @@ func NewPersister(fname string) Persister {
 	if fname == "" {
 		return &InMemoryPersister{}
 	}
+	if s := currentStore(); s != nil {
+		return newStorePersister(s, fname)
+	}
 	return &FilePersister{fname}
 }
 
-func (i *InMemoryPersister) Read(state interface{}) {
-	return
+func (i *InMemoryPersister) Read(state interface{}) error {
+	return nil
 }
 
-func (i *InMemoryPersister) Write(state interface{}) {
-	return
+func (i *InMemoryPersister) Write(state interface{}) error {
+	return nil
 }
 
-func (fp *FilePersister) Write(state interface{}) {
-	glog.Infof("Writing to %v", fp.Fn)
-	f, err := os.Create(fp.Fn)
+func backupName(fname string, n int) string {
+	return fmt.Sprintf("%v.%v", fname, n)
+}
+
+func (fp *FilePersister) Write(state interface{}) (err error) {
+	log.Debug("Writing state", "file", fp.Fn)
+	start := time.Now()
+	defer func() { observeWrite(StoreName(fp.Fn), start, err) }()
+	data, err := json.Marshal(state)
 	if err != nil {
-		glog.Fatalln("Error opening %v: %v", fp.Fn, err)
+		return fmt.Errorf("Error encoding state for %v: %v", fp.Fn, err)
 	}
+	if err := fp.rotate(); err != nil {
+		log.Warn("Error backing up state", "file", fp.Fn, "error", err)
+	}
+	return writeAtomic(fp.Fn, data)
+}
 
-	writer := json.NewEncoder(f)
-	err = writer.Encode(state)
-
+// writeAtomic replaces fname with data, so that readers (and a restart after
+// a crash) see either the old or the new contents.
+func writeAtomic(fname string, data []byte) error {
+	dir := filepath.Dir(fname)
+	f, err := os.CreateTemp(dir, filepath.Base(fname)+".tmp*")
 	if err != nil {
-		glog.Fatalf("Error encoding %v", state)
+		return fmt.Errorf("Error creating temporary file for %v: %v", fname, err)
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp) // no-op once renamed
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("Error writing %v: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("Error syncing %v: %v", tmp, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("Error closing %v: %v", tmp, err)
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		return fmt.Errorf("Error setting permissions of %v: %v", tmp, err)
+	}
+	if err := os.Rename(tmp, fname); err != nil {
+		return fmt.Errorf("Error replacing %v: %v", fname, err)
+	}
+	// Make the rename itself durable.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// rotate shifts the backups along and copies the current file to <file>.1,
+// unless the newest backup is recent.
+func (fp *FilePersister) rotate() error {
+	if info, err := os.Stat(backupName(fp.Fn, 1)); err == nil && time.Since(info.ModTime()) < BackupInterval {
+		return nil
 	}
-	return
+	data, err := os.ReadFile(fp.Fn)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		// Don't push a good backup out for a damaged file.
+		return fmt.Errorf("%v is not valid JSON; not backing it up", fp.Fn)
+	}
+	for n := PersistBackups - 1; n >= 1; n-- {
+		if err := os.Rename(backupName(fp.Fn, n), backupName(fp.Fn, n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeAtomic(backupName(fp.Fn, 1), data)
+}
+
+func (fp *FilePersister) Read(state interface{}) error {
+	log.Info("Reading state", "file", fp.Fn)
+	err := readFile(fp.Fn, state)
+	if err == nil {
+		return nil
+	} else if os.IsNotExist(err) {
+		log.Info("Nothing to recover", "file", fp.Fn)
+		return nil
+	} else if !errors.Is(err, errCorrupt) {
+		// The file is intact but can't be decoded (say, its secrets can't be
+		// opened); an older backup would silently lose changes.
+		return err
+	}
+	log.Error("Error reading state", "file", fp.Fn, "error", err)
+	for n := 1; n <= PersistBackups; n++ {
+		backup := backupName(fp.Fn, n)
+		if berr := readFile(backup, state); berr == nil {
+			log.Warn("Recovered state from backup", "file", fp.Fn, "backup", backup)
+			return nil
+		} else if !os.IsNotExist(berr) {
+			log.Error("Error reading backup", "backup", backup, "error", berr)
+		}
+	}
+	return fmt.Errorf("No readable copy of %v: %v", fp.Fn, err)
 }
 
-func (fp *FilePersister) Read(state interface{}) {
-	glog.Infof("Reading from %v", fp.Fn)
-	f, err := os.Open(fp.Fn)
+var errCorrupt = errors.New("truncated or corrupt")
+
+func readFile(fname string, state interface{}) error {
+	data, err := os.ReadFile(fname)
 	if err != nil {
-		if os.IsNotExist(err) {
-			glog.Infof("Nothing to recover...")
-			return
-		} else {
-			glog.Fatalln(err)
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%v is %w", fname, errCorrupt)
+	}
+	return json.Unmarshal(data, state)
+}
+
+// PurgeBackups removes the backups of fname, including one set aside by
+// RestoreBackup.
+func PurgeBackups(fname string) error {
+	names := []string{fname + ".bad"}
+	for n := 1; n <= PersistBackups; n++ {
+		names = append(names, backupName(fname, n))
+	}
+	for _, name := range names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
 		}
 	}
+	return nil
+}
 
-	reader := json.NewDecoder(f)
-	err = reader.Decode(state)
+// RestoreBackup replaces fname with its nth backup, keeping the replaced file
+// as <file>.bad.
+func RestoreBackup(fname string, n int) error {
+	backup := backupName(fname, n)
+	data, err := os.ReadFile(backup)
 	if err != nil {
-		glog.Fatalln(err)
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("Backup %v is corrupt", backup)
+	}
+	if err := os.Rename(fname, fname+".bad"); err != nil && !os.IsNotExist(err) {
+		return err
 	}
-	return
+	return writeAtomic(fname, data)
 }
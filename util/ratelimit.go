@@ -0,0 +1,48 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows each key, e.g. a client address, Limit events per
+// Window.
+type RateLimiter struct {
+	sync.Mutex
+	Limit   int
+	Window  time.Duration
+	Windows map[string]rateWindow // protected by mutex
+}
+
+type rateWindow struct {
+	Start time.Time
+	Count int
+}
+
+func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
+	return &RateLimiter{Limit: limit, Window: window, Windows: make(map[string]rateWindow)}
+}
+
+// Allow records an event for key, reporting whether it is within the limit.
+func (l *RateLimiter) Allow(key string) bool {
+	l.Lock()
+	defer l.Unlock()
+	now := time.Now()
+	w, ok := l.Windows[key]
+	if !ok || now.Sub(w.Start) >= l.Window {
+		l.prune(now)
+		w = rateWindow{Start: now}
+	}
+	w.Count++
+	l.Windows[key] = w
+	return w.Count <= l.Limit
+}
+
+func (l *RateLimiter) prune(now time.Time) {
+	// Requires mutex
+	for key, w := range l.Windows {
+		if now.Sub(w.Start) >= l.Window {
+			delete(l.Windows, key)
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Envelope encryption of secrets at rest. Each secret is encrypted with its
+// own data key, which is wrapped with a master key from the keyring. Master
+// keys are rotated by putting a new key first in the keyring: secrets are
+// re-wrapped with it the next time they are written, and the old key can be
+// dropped once they have been.
+
+const (
+	MasterKeyEnv  = "AP_MASTER_KEY"
+	MasterKeySize = 32
+)
+
+var (
+	ErrNotSealed = errors.New("Value is not a sealed secret")
+
+	keyring  *Keyring
+	keyringM sync.Mutex
+	// Sealed forms of secrets by key id and value, so that an unchanged
+	// secret marshals the same way every time and is not rewritten.
+	sealedCache = make(map[[sha256.Size]byte][]byte) // protected by keyringM
+	// Secrets read that were stored in plaintext.
+	plaintextRead atomic.Int64
+)
+
+// Keyring holds master keys by id. The first key read is the primary, used
+// for sealing; the rest only open secrets sealed before a rotation.
+type Keyring struct {
+	Primary string
+	Keys    map[string][]byte
+}
+
+// ParseKeyring reads master keys given as id:base64key, one per line or
+// comma-separated.
+func ParseKeyring(s string) (*Keyring, error) {
+	k := &Keyring{Keys: make(map[string][]byte)}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == '\n' || r == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("Master key entries must be id:base64key")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != MasterKeySize {
+			return nil, fmt.Errorf("Master key %v must be %v base64-encoded bytes", id, MasterKeySize)
+		}
+		if _, dup := k.Keys[id]; dup {
+			return nil, fmt.Errorf("Duplicate master key id %v", id)
+		}
+		k.Keys[id] = key
+		if k.Primary == "" {
+			k.Primary = id
+		}
+	}
+	if k.Primary == "" {
+		return nil, fmt.Errorf("No master keys found")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads the keyring from the environment, or else from fname.
+// It returns nil if neither is set.
+func LoadKeyring(fname string) (*Keyring, error) {
+	if env := os.Getenv(MasterKeyEnv); env != "" {
+		return ParseKeyring(env)
+	}
+	if fname == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return ParseKeyring(string(data))
+}
+
+// NewMasterKey returns a keyring entry for a fresh master key.
+func NewMasterKey(id string) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(RandomBytes(MasterKeySize))
+}
+
+// UseKeyring makes Secrets marshal sealed with k. Without a keyring they are
+// stored in plaintext.
+func UseKeyring(k *Keyring) {
+	keyringM.Lock()
+	defer keyringM.Unlock()
+	keyring = k
+	clear(sealedCache)
+}
+
+func currentKeyring() *Keyring {
+	keyringM.Lock()
+	defer keyringM.Unlock()
+	return keyring
+}
+
+// MarkPlaintext records that a secret was read from plaintext storage.
+func MarkPlaintext() {
+	plaintextRead.Add(1)
+}
+
+// PlaintextSecrets returns how many secrets were read from plaintext storage.
+func PlaintextSecrets() int64 {
+	return plaintextRead.Load()
+}
+
+// SecretsEncrypted reports whether secrets are sealed when written.
+func SecretsEncrypted() bool {
+	return currentKeyring() != nil
+}
+
+func cacheKey(kid string, s Secret) [sha256.Size]byte {
+	return sha256.Sum256([]byte(kid + "\x00" + string(s)))
+}
+
+func cachedSeal(kid string, s Secret) []byte {
+	keyringM.Lock()
+	defer keyringM.Unlock()
+	return sealedCache[cacheKey(kid, s)]
+}
+
+func cacheSeal(kid string, s Secret, sealed []byte) {
+	keyringM.Lock()
+	defer keyringM.Unlock()
+	sealedCache[cacheKey(kid, s)] = sealed
+}
+
+func seal(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := RandomBytes(gcm.NonceSize())
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("Sealed value is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+// Secret is a string that is sealed with the keyring when marshaled. Values
+// stored before encryption was enabled are read as plaintext.
+type Secret string
+
+type sealedSecret struct {
+	KeyId string `json:"kid"`
+	Key   []byte `json:"key"`  // data key, sealed with the master key
+	Data  []byte `json:"data"` // value, sealed with the data key
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	k := currentKeyring()
+	if k == nil || s == "" {
+		return json.Marshal(string(s))
+	}
+	if sealed := cachedSeal(k.Primary, s); sealed != nil {
+		return sealed, nil
+	}
+	dataKey := RandomBytes(MasterKeySize)
+	data, err := seal(dataKey, []byte(s))
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := seal(k.Keys[k.Primary], dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := json.Marshal(sealedSecret{KeyId: k.Primary, Key: wrapped, Data: data})
+	if err != nil {
+		return nil, err
+	}
+	cacheSeal(k.Primary, s, sealed)
+	return sealed, nil
+}
+
+func (s *Secret) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '"' {
+		var plain string
+		if err := json.Unmarshal(data, &plain); err != nil {
+			return err
+		}
+		*s = Secret(plain)
+		if plain != "" {
+			MarkPlaintext()
+		}
+		return nil
+	}
+	var sealed sealedSecret
+	if err := json.Unmarshal(data, &sealed); err != nil || sealed.KeyId == "" {
+		return ErrNotSealed
+	}
+	k := currentKeyring()
+	if k == nil {
+		return fmt.Errorf("Secret is sealed with master key %v, but no master key is configured", sealed.KeyId)
+	}
+	master, ok := k.Keys[sealed.KeyId]
+	if !ok {
+		return fmt.Errorf("Master key %v is not in the keyring", sealed.KeyId)
+	}
+	dataKey, err := open(master, sealed.Key)
+	if err != nil {
+		return fmt.Errorf("Error unwrapping data key: %v", err)
+	}
+	plain, err := open(dataKey, sealed.Data)
+	if err != nil {
+		return fmt.Errorf("Error opening secret: %v", err)
+	}
+	*s = Secret(plain)
+	if sealed.KeyId == k.Primary {
+		// Secrets sealed with an older key are resealed when next written.
+		cacheSeal(k.Primary, *s, append([]byte(nil), data...))
+	}
+	return nil
+}
+
+// String keeps secrets out of logs.
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return "[redacted]"
+}
+
+// Reveal returns the secret's value.
+func (s Secret) Reveal() string {
+	return string(s)
+}
+
+// warnPlaintext logs once that secrets are being stored unencrypted.
+var warnPlaintext sync.Once
+
+func WarnIfPlaintext() {
+	if !SecretsEncrypted() {
+		warnPlaintext.Do(func() {
+			log.Warn("No master key configured; secrets are stored unencrypted", "flag", "-masterKey", "env", MasterKeyEnv)
+		})
+	}
+}
@@ -0,0 +1,109 @@
+package util
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	SessionCookie      = "session"
+	SessionTTL         = 30 * 24 * time.Hour
+	AdminSessionCookie = "admin_session"
+	AdminSessionTTL    = 12 * time.Hour
+	CSRFField          = "csrf"
+)
+
+// SetSession issues a session cookie for user, who has just proven control
+// of their account. The session is only good while generation is the user's
+// current one, so that sessions can be revoked.
+func (s *CookieSigner) SetSession(w http.ResponseWriter, user, generation string) {
+	s.setSession(w, SessionCookie, user+"|"+generation, SessionTTL)
+}
+
+func (s *CookieSigner) ClearSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Path: "/", MaxAge: -1})
+}
+
+// SessionUser returns the user the request's session belongs to and the
+// generation it was issued in, or "".
+func (s *CookieSigner) SessionUser(r *http.Request) (user, generation string) {
+	value := s.sessionValue(r, SessionCookie)
+	i := strings.LastIndex(value, "|")
+	if i < 0 {
+		return "", ""
+	}
+	return value[:i], value[i+1:]
+}
+
+// CSRFToken returns a token tied to the request's session, for embedding in
+// forms that change state.
+func (s *CookieSigner) CSRFToken(r *http.Request) string {
+	return s.csrfToken(r, SessionCookie)
+}
+
+// CheckCSRF verifies the CSRF form field of a state-changing request.
+func (s *CookieSigner) CheckCSRF(r *http.Request) bool {
+	return s.checkCSRF(r, SessionCookie)
+}
+
+// Admin sessions are kept apart from user sessions, so that signing in as
+// the operator grants nothing on the account pages and vice versa.
+
+// SetAdminSession issues an admin session cookie for who, which names how
+// the operator signed in.
+func (s *CookieSigner) SetAdminSession(w http.ResponseWriter, who string) {
+	s.setSession(w, AdminSessionCookie, who, AdminSessionTTL)
+}
+
+func (s *CookieSigner) ClearAdminSession(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{Name: AdminSessionCookie, Path: "/", MaxAge: -1})
+}
+
+// AdminSession returns who the request's admin session belongs to, or "".
+func (s *CookieSigner) AdminSession(r *http.Request) string {
+	return s.sessionValue(r, AdminSessionCookie)
+}
+
+func (s *CookieSigner) AdminCSRFToken(r *http.Request) string {
+	return s.csrfToken(r, AdminSessionCookie)
+}
+
+func (s *CookieSigner) CheckAdminCSRF(r *http.Request) bool {
+	return s.checkCSRF(r, AdminSessionCookie)
+}
+
+func (s *CookieSigner) setSession(w http.ResponseWriter, cookie, value string, ttl time.Duration) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     cookie,
+		Value:    s.Sign(cookie, value, ttl),
+		Path:     "/",
+		MaxAge:   int(ttl.Seconds()),
+		HttpOnly: true,
+		Secure:   s.Secure,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func (s *CookieSigner) sessionValue(r *http.Request, cookie string) string {
+	c, err := r.Cookie(cookie)
+	if err != nil {
+		return ""
+	}
+	value, _ := s.Verify(cookie, c.Value)
+	return value
+}
+
+func (s *CookieSigner) csrfToken(r *http.Request, cookie string) string {
+	c, err := r.Cookie(cookie)
+	if err != nil {
+		return ""
+	}
+	return s.mac("csrf|" + c.Value)
+}
+
+func (s *CookieSigner) checkCSRF(r *http.Request, cookie string) bool {
+	want := s.csrfToken(r, cookie)
+	return want != "" && hmac.Equal([]byte(want), []byte(r.FormValue(CSRFField)))
+}
@@ -0,0 +1,299 @@
+package util
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// An embedded key/value store for state. Each persister gets a bucket, and
+// each top-level key of its state (a user, a token, a queue) is stored
+// separately, so that a write only touches the entries that changed.
+
+var (
+	metaBucket    = []byte("meta")
+	schemaKey     = []byte("schema_version")
+	importedKey   = "imported/"
+	statePrefix   = "state/"
+	defaultStore  *BoltStore
+	defaultStoreM sync.Mutex
+)
+
+type migration struct {
+	Version int
+	Name    string
+	Apply   func(tx *bolt.Tx) error
+}
+
+// Migrations are applied in order to bring a store up to date. Append to the
+// list; never change an entry once released.
+var migrations = []migration{
+	{1, "create metadata", func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	}},
+}
+
+// StoreSchemaVersion is the version of a fully migrated store.
+func StoreSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+// OpenStore opens (creating, if need be) the store at path and migrates it to
+// the current schema.
+func OpenStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %v: %v", path, err)
+	}
+	s := &BoltStore{DB: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStore) Close() error {
+	return s.DB.Close()
+}
+
+// Version returns the schema version of the store.
+func (s *BoltStore) Version() (int, error) {
+	version := 0
+	err := s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(metaBucket)
+		if b == nil {
+			return nil
+		}
+		if v := b.Get(schemaKey); v != nil {
+			n, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("Invalid schema version %q", v)
+			}
+			version = n
+		}
+		return nil
+	})
+	return version, err
+}
+
+func (s *BoltStore) migrate() error {
+	version, err := s.Version()
+	if err != nil {
+		return err
+	}
+	if version > StoreSchemaVersion() {
+		return fmt.Errorf("Store schema version %v is newer than this binary's (%v)", version, StoreSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.Version <= version {
+			continue
+		}
+		err := s.DB.Update(func(tx *bolt.Tx) error {
+			if err := m.Apply(tx); err != nil {
+				return err
+			}
+			b, err := tx.CreateBucketIfNotExists(metaBucket)
+			if err != nil {
+				return err
+			}
+			return b.Put(schemaKey, []byte(strconv.Itoa(m.Version)))
+		})
+		if err != nil {
+			return fmt.Errorf("Error applying migration %v (%v): %v", m.Version, m.Name, err)
+		}
+		log.Info("Migrated store", "version", m.Version, "migration", m.Name)
+	}
+	return nil
+}
+
+// UseStore makes NewPersister return persisters backed by s rather than
+// files. State is imported from a persister's file the first time it is used.
+func UseStore(s *BoltStore) {
+	defaultStoreM.Lock()
+	defer defaultStoreM.Unlock()
+	defaultStore = s
+}
+
+func currentStore() *BoltStore {
+	defaultStoreM.Lock()
+	defer defaultStoreM.Unlock()
+	return defaultStore
+}
+
+// StoreName is the name of the bucket holding the state of a JSON file.
+func StoreName(fname string) string {
+	return strings.TrimSuffix(filepath.Base(fname), ".json")
+}
+
+type BoltPersister struct {
+	Store  *BoltStore
+	Bucket []byte
+}
+
+// Persister returns a persister for the named state. If the state has never
+// been stored and legacyFile exists, the file is imported.
+func (s *BoltStore) Persister(name, legacyFile string) (Persister, error) {
+	bp := &BoltPersister{Store: s, Bucket: []byte(statePrefix + name)}
+	if legacyFile != "" {
+		if _, err := s.Import(name, legacyFile, false); err != nil {
+			return nil, err
+		}
+	}
+	return bp, nil
+}
+
+// Import copies the state in the JSON file fname into the named state. Unless
+// force is set, it does nothing if the state was imported or written before.
+// It returns the number of entries imported.
+func (s *BoltStore) Import(name, fname string, force bool) (int, error) {
+	marker := []byte(importedKey + name)
+	bucket := []byte(statePrefix + name)
+	done := false
+	s.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		done = tx.Bucket(metaBucket).Get(marker) != nil || (b != nil && b.Stats().KeyN > 0)
+		return nil
+	})
+	if done && !force {
+		return 0, nil
+	}
+	entries := make(map[string]json.RawMessage)
+	if err := (&FilePersister{fname}).Read(&entries); err != nil {
+		return 0, err
+	}
+	err := s.DB.Update(func(tx *bolt.Tx) error {
+		if err := writeEntries(tx, bucket, entries); err != nil {
+			return err
+		}
+		return tx.Bucket(metaBucket).Put(marker, []byte(time.Now().UTC().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return 0, fmt.Errorf("Error importing %v: %v", fname, err)
+	}
+	if len(entries) > 0 {
+		log.Info("Imported state into store", "entries", len(entries), "state", name, "file", fname)
+	}
+	return len(entries), nil
+}
+
+// RemoveImported removes the JSON file the named state was imported from, if
+// it was, along with its backups. They are left behind by the import and may
+// hold secrets that the store has since sealed.
+func (s *BoltStore) RemoveImported(name, fname string) error {
+	imported := false
+	s.DB.View(func(tx *bolt.Tx) error {
+		imported = tx.Bucket(metaBucket).Get([]byte(importedKey+name)) != nil
+		return nil
+	})
+	if !imported {
+		return nil
+	}
+	if err := PurgeBackups(fname); err != nil {
+		return err
+	}
+	if err := os.Remove(fname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	log.Info("Removed imported state file", "state", name, "file", fname)
+	return nil
+}
+
+// writeEntries makes bucket hold exactly entries, writing only what changed.
+func writeEntries(tx *bolt.Tx, bucket []byte, entries map[string]json.RawMessage) error {
+	b, err := tx.CreateBucketIfNotExists(bucket)
+	if err != nil {
+		return err
+	}
+	var stale [][]byte
+	b.ForEach(func(k, _ []byte) error {
+		if _, ok := entries[string(k)]; !ok {
+			stale = append(stale, append([]byte(nil), k...))
+		}
+		return nil
+	})
+	for _, k := range stale {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for k, v := range entries {
+		if bytes.Equal(b.Get([]byte(k)), v) {
+			continue
+		}
+		if err := b.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bp *BoltPersister) Write(state interface{}) (err error) {
+	start := time.Now()
+	defer func() { observeWrite(strings.TrimPrefix(string(bp.Bucket), statePrefix), start, err) }()
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("Error encoding state for %s: %v", bp.Bucket, err)
+	}
+	entries := make(map[string]json.RawMessage)
+	if !bytes.Equal(data, []byte("null")) {
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return fmt.Errorf("State for %s is not an object: %v", bp.Bucket, err)
+		}
+	}
+	return bp.Store.DB.Update(func(tx *bolt.Tx) error {
+		return writeEntries(tx, bp.Bucket, entries)
+	})
+}
+
+func (bp *BoltPersister) Read(state interface{}) error {
+	entries := make(map[string]json.RawMessage)
+	err := bp.Store.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bp.Bucket)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			entries[string(k)] = append(json.RawMessage(nil), v...)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		log.Info("Nothing to recover", "bucket", string(bp.Bucket))
+		return nil
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, state)
+}
+
+// newStorePersister is NewPersister when a store is in use.
+func newStorePersister(s *BoltStore, fname string) Persister {
+	legacy := fname
+	if _, err := os.Stat(fname); err != nil {
+		legacy = ""
+	}
+	p, err := s.Persister(StoreName(fname), legacy)
+	if err != nil {
+		Fatal(log, "Could not open store", "file", fname, "error", err)
+	}
+	return p
+}
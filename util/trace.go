@@ -0,0 +1,66 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"runtime/debug"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+const (
+	ServiceName    = "ap-bot"
+	OtlpExporter   = "otlp"
+	StdoutExporter = "stdout"
+)
+
+// InitTracing installs the global tracer provider, exporting spans with
+// exporter: OtlpExporter sends them over OTLP/HTTP to endpoint (or wherever
+// the OTEL_EXPORTER_OTLP_* variables point, if empty), StdoutExporter prints
+// them to stdout. Traces not continued from a caller are sampled at ratio.
+// With no exporter, spans are not recorded. The returned function flushes
+// and stops the exporter.
+func InitTracing(ctx context.Context, exporter, endpoint string, ratio float64) (shutdown func(context.Context) error, err error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	var opt sdktrace.TracerProviderOption
+	switch exporter {
+	case "":
+		return func(context.Context) error { return nil }, nil
+	case OtlpExporter:
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		exp, err := otlptracehttp.New(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Error creating OTLP exporter: %v", err)
+		}
+		opt = sdktrace.WithBatcher(exp)
+	case StdoutExporter:
+		exp, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("Error creating stdout exporter: %v", err)
+		}
+		opt = sdktrace.WithSyncer(exp)
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter %q", exporter)
+	}
+	attrs := []attribute.KeyValue{attribute.String("service.name", ServiceName)}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		attrs = append(attrs, attribute.String("service.version", info.Main.Version))
+	}
+	res := resource.NewWithAttributes("", attrs...)
+	tp := sdktrace.NewTracerProvider(opt,
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio))))
+	otel.SetTracerProvider(tp)
+	log.Info("Tracing", "exporter", exporter, "sample_ratio", ratio)
+	return tp.Shutdown, nil
+}
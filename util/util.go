@@ -1,15 +1,19 @@
 package util
 
 import (
+	"context"
 	"encoding/json"
+	"log/slog"
 	"net/http"
-
-	"github.com/golang/glog"
 )
 
 func ErrorResponse(w http.ResponseWriter, code int, message string) {
 	if message != "" {
-		glog.Errorf("%v", message)
+		level := slog.LevelWarn
+		if code >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		log.Log(context.Background(), level, "Error response", "status", code, "error", message)
 	}
 	JsonResponse(w, code, map[string]string{"error": message})
 }
@@ -19,12 +23,18 @@ func JsonResponse(w http.ResponseWriter, code int, payload interface{}) {
 }
 
 func JsonResponseCustom(w http.ResponseWriter, code int, payload interface{}, marshaler func(v any) ([]byte, error)) {
+	TypedResponse(w, code, "application/json", payload, marshaler)
+}
+
+// TypedResponse is JsonResponseCustom for JSON media types other than
+// application/json.
+func TypedResponse(w http.ResponseWriter, code int, contentType string, payload interface{}, marshaler func(v any) ([]byte, error)) {
 	response, err := marshaler(payload)
 	if err != nil {
-		glog.Fatalf("Error marshalling response %v: %v", payload, err)
+		Fatal(log, "Error marshalling response", "payload", payload, "error", err)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(code)
 	w.Write(response)
 }